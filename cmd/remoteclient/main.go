@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	cccontrol "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlClient"
@@ -16,10 +18,12 @@ func ReadCli() map[string]interface{} {
 	debug := flag.Bool("debug", false, "Activate debug output")
 	topo := flag.Bool("topology", false, "List topology of remote node")
 	config := flag.Bool("list", false, "List controls of remote node")
-	get := flag.String("get", "", "Get value of control from remote node (name@type-typeid)")
-	set := flag.String("set", "", "Set value of control from remote node (name@type-typeid=value)")
-	host := flag.String("host", "", "Hostname of remote node")
+	get := flag.String("get", "", "Get value of control from remote node (name@type-typeid, typeid may be '*' or a list like '0-15,32-47')")
+	set := flag.String("set", "", "Set value of control from remote node (name@type-typeid=value, typeid may be '*' or a list like '0-15,32-47')")
+	host := flag.String("host", "", "Hostname of remote node, a hostlist like node[001-128] for -get and -set")
 	requestsub := flag.String("request-subject", "cc-control", "NATS Subject to subscribe for control requests")
+	requestprefix := flag.String("request-subject-prefix", "", "NATS Subject prefix to address hosts by subject <prefix>.<host>")
+	identity := flag.String("identity", "", "Identity sent with requests, signed if CC_IDENTITY_SECRET is set")
 	//replysub := flag.String("reply-subject", "cc-control", "NATS Subject to send control replies to")
 
 	flag.Parse()
@@ -30,6 +34,8 @@ func ReadCli() map[string]interface{} {
 	m["port"] = *port
 	m["host"] = *host
 	m["request-subject"] = *requestsub
+	m["request-subject-prefix"] = *requestprefix
+	m["identity"] = *identity
 	//m["reply-subject"] = *replysub
 	if *debug {
 		m["debug"] = true
@@ -49,21 +55,56 @@ func ReadCli() map[string]interface{} {
 	return m
 }
 
+// isDeviceSet checks whether a type-id selects several devices
+func isDeviceSet(deviceId string) bool {
+	return deviceId == "*" || strings.ContainsAny(deviceId, ",-")
+}
+
+// printHostResults prints the results of a multi-host request sorted by hostname
+func printHostResults(results *cccontrol.HostResults[string]) {
+	hosts := make([]string, 0)
+	for h := range results.Success {
+		hosts = append(hosts, h)
+	}
+	for h := range results.Errors {
+		hosts = append(hosts, h)
+	}
+	for h := range results.Unreachable {
+		hosts = append(hosts, h)
+	}
+	slices.Sort(hosts)
+	for _, h := range hosts {
+		if v, ok := results.Success[h]; ok {
+			fmt.Printf("%s: %s\n", h, v)
+		} else if err, ok := results.Errors[h]; ok {
+			fmt.Printf("%s: failed: %v\n", h, err)
+		} else {
+			fmt.Printf("%s: unreachable: %v\n", h, results.Unreachable[h])
+		}
+	}
+	fmt.Printf("%d succeeded, %d failed, %d unreachable\n", len(results.Success), len(results.Errors), len(results.Unreachable))
+}
+
 func main() {
-	getregex := regexp.MustCompile(`^([a-z0-9\._]+)@([a-z]+)-([0-9]+)`)
-	setregex := regexp.MustCompile(`^([a-z0-9\._]+)@([a-z]+)-([0-9]+)=(.+)$`)
+	getregex := regexp.MustCompile(`^([a-z0-9\._/]+)@([a-z]+)-(\*|[0-9,\-]+)`)
+	setregex := regexp.MustCompile(`^([a-z0-9\._/]+)@([a-z]+)-(\*|[0-9,\-]+)=(.+)$`)
 	cliopts := ReadCli()
 
 	natsCfg := cccontrol.NatsConfig{
 		Server: cliopts["server"].(string),
 		Port: uint16(cliopts["port"].(int)),
 		RequestSubject: cliopts["request-subject"].(string),
+		RequestSubjectPrefix: cliopts["request-subject-prefix"].(string),
+		Identity: cliopts["identity"].(string),
+		// Not a flag to keep it out of the process list
+		IdentitySecret: os.Getenv("CC_IDENTITY_SECRET"),
 		//ReplySubject: cliopts["reply-subject"].(string),
 	}
 
 	c, err := cccontrol.NewCCControlClient(natsCfg)
 	if err != nil {
 		fmt.Println(err.Error())
+		os.Exit(1)
 	}
 	defer c.Close()
 	if len(cliopts["host"].(string)) == 0 {
@@ -71,7 +112,7 @@ func main() {
 		os.Exit(1)
 	}
 	if (!cliopts["topology"].(bool)) && (!cliopts["config"].(bool)) && len(cliopts["get"].(string)) == 0 && len(cliopts["set"].(string)) == 0 {
-		fmt.Println("Either -topology, -config, -get <control> or -set <control>=<value> required")
+		fmt.Println("Either -topology, -list, -get <control> or -set <control>=<value> required")
 		os.Exit(1)
 	}
 
@@ -97,18 +138,42 @@ func main() {
 			os.Exit(1)
 		}
 		for _, ctrl := range c.Controls {
-			fmt.Printf("%s.%s for type=%s (%s): %s\n", ctrl.Category, ctrl.Name, ctrl.DeviceType, ctrl.Methods, ctrl.Description)
+			fmt.Printf("%s/%s.%s for type=%s (%s): %s\n", ctrl.Provider, ctrl.Category, ctrl.Name, ctrl.DeviceType, ctrl.Methods, ctrl.Description)
 		}
 
 		os.Exit(0)
 	}
 
+	// With a hostlist, GET and SET are executed on all hosts concurrently
+	if strings.ContainsAny(cliopts["host"].(string), "[,") {
+		hosts := []string{cliopts["host"].(string)}
+		var results *cccontrol.HostResults[string]
+		var err error
+		if rematch := getregex.FindStringSubmatch(cliopts["get"].(string)); len(rematch) == 4 && !isDeviceSet(rematch[3]) {
+			results, err = c.GetControlValueHosts(hosts, rematch[1], rematch[2], rematch[3])
+		} else if rematch := setregex.FindStringSubmatch(cliopts["set"].(string)); len(rematch) == 5 && !isDeviceSet(rematch[3]) {
+			results, err = c.SetControlValueHosts(hosts, rematch[1], rematch[2], rematch[3], rematch[4])
+		} else {
+			fmt.Println("Hostlists are only supported for -get and -set of a single device")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		printHostResults(results)
+		if len(results.Errors) > 0 || len(results.Unreachable) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if len(cliopts["get"].(string)) > 0 {
 		fmt.Println("Executing GET path")
 
 		rematch := getregex.FindStringSubmatch(cliopts["get"].(string))
 		fmt.Println(strings.Join(rematch, " | "))
-		if len(rematch) == 4 {
+		if len(rematch) == 4 && !isDeviceSet(rematch[3]) {
 			v, err := c.GetControlValue(cliopts["host"].(string), rematch[1], rematch[2], rematch[3])
 			if err != nil {
 				fmt.Printf("Failed to get control %s of node %s: %v\n", rematch[1], cliopts["host"].(string), err.Error())
@@ -116,6 +181,25 @@ func main() {
 			}
 			fmt.Printf("Control %s at host %s (%s-%s): %s\n", rematch[0], cliopts["host"].(string), rematch[2], rematch[3], v)
 			os.Exit(0)
+		} else if len(rematch) == 4 {
+			values, err := c.GetControlValues(cliopts["host"].(string), rematch[1], rematch[2], rematch[3])
+			ids := make([]string, 0, len(values))
+			for id := range values {
+				ids = append(ids, id)
+			}
+			slices.SortFunc(ids, func(a, b string) int {
+				x, _ := strconv.Atoi(a)
+				y, _ := strconv.Atoi(b)
+				return x - y
+			})
+			for _, id := range ids {
+				fmt.Printf("Control %s at host %s (%s-%s): %s\n", rematch[1], cliopts["host"].(string), rematch[2], id, values[id])
+			}
+			if err != nil {
+				fmt.Printf("Failed to get control %s of node %s: %v\n", rematch[1], cliopts["host"].(string), err.Error())
+				os.Exit(1)
+			}
+			os.Exit(0)
 		} else {
 			fmt.Printf("Failed to parse control %s\n", cliopts["get"].(string))
 			os.Exit(1)
@@ -125,7 +209,12 @@ func main() {
 		fmt.Println("Executing SET path")
 		rematch := setregex.FindStringSubmatch(cliopts["set"].(string))
 		if len(rematch) == 5 {
-			err := c.SetControlValue(cliopts["host"].(string), rematch[1], rematch[2], rematch[3], rematch[4])
+			var err error
+			if isDeviceSet(rematch[3]) {
+				err = c.SetControlValues(cliopts["host"].(string), rematch[1], rematch[2], rematch[3], rematch[4])
+			} else {
+				err = c.SetControlValue(cliopts["host"].(string), rematch[1], rematch[2], rematch[3], rematch[4])
+			}
 			if err != nil {
 				fmt.Printf("Failed to set control %s of node %s: %v\n", rematch[1], cliopts["host"].(string), err.Error())
 				os.Exit(1)
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+	ccidentity "github.com/ClusterCockpit/cc-node-controller/pkg/ccIdentity"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+	"github.com/nats-io/nats.go"
+)
+
+// ACLRule grants methods on controls to an identity
+type ACLRule struct {
+	// Identity the rule applies to, '*' for all identities including anonymous requests
+	Identity string `json:"identity"`
+	// Pattern of the control name, see matchControl
+	Control string `json:"control"`
+	// Device type the rule applies to, empty or '*' for all device types
+	DeviceType string   `json:"type,omitempty"`
+	Methods    []string `json:"methods"` // Granted methods (GET, PUT)
+}
+
+// ACL is the access control list of cc-node-controller. A request is allowed if
+// any rule grants the method on the control and device type to its identity.
+type ACL struct {
+	// Accept the identity in the plain text header Cc-Identity. Only enable
+	// this if the NATS permissions prevent untrusted clients from publishing requests.
+	TrustIdentityHeader bool `json:"trustIdentityHeader,omitempty"`
+	// Secrets to verify signed tokens in the header Cc-Token, by identity
+	Secrets map[string]string `json:"secrets,omitempty"`
+	Rules   []ACLRule         `json:"rules"`
+	enabled bool
+}
+
+// RequestContext contains information about the sender of a request
+type RequestContext struct {
+	Identity  string // Empty for anonymous requests
+	RequestId string // ID of the processed request in the tag 'request-id', if sent by the client
+	authErr   error  // Set if the sender sent an invalid token
+}
+
+// ErrPermissionDenied is wrapped by all errors of denied requests
+var ErrPermissionDenied = errors.New("Permission denied")
+
+var (
+	aclLock sync.RWMutex
+	acl     ACL
+	// Request IDs of the tokens used recently, to reject replayed tokens
+	seenTokens = ccidentity.NewReplayCache()
+)
+
+// LoadACL reads an ACL file. An empty filename returns a disabled ACL that
+// allows all requests.
+func LoadACL(filename string) (ACL, error) {
+	var a ACL
+	if len(filename) == 0 {
+		return a, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return a, fmt.Errorf("Failed to read ACL file %s: %w", filename, err)
+	}
+	err = json.Unmarshal(data, &a)
+	if err != nil {
+		return a, fmt.Errorf("Failed to parse ACL file %s: %w", filename, err)
+	}
+	for i, r := range a.Rules {
+		if len(r.Identity) == 0 {
+			return a, fmt.Errorf("ACL rule %d has no identity", i)
+		}
+		if _, err := path.Match(r.Control, ""); err != nil || len(r.Control) == 0 {
+			return a, fmt.Errorf("Invalid control pattern '%s' in ACL rule %d", r.Control, i)
+		}
+		for _, m := range r.Methods {
+			if m != "GET" && m != "PUT" {
+				return a, fmt.Errorf("Invalid method '%s' in ACL rule %d", m, i)
+			}
+		}
+	}
+	a.enabled = true
+	return a, nil
+}
+
+// SetACL replaces the active ACL
+func SetACL(a ACL) {
+	aclLock.Lock()
+	defer aclLock.Unlock()
+	acl = a
+}
+
+// NewRequestContext determines the identity of the sender from the NATS headers
+// of a request. A signed token is preferred over the plain text identity. The token
+// has to be created for the payload of the request and the local hostname, and its
+// request ID may not have been used before.
+func NewRequestContext(header nats.Header, payload []byte, hostname string) RequestContext {
+	aclLock.RLock()
+	defer aclLock.RUnlock()
+
+	var ctx RequestContext
+	if token := header.Get(ccidentity.TokenHeader); len(token) > 0 {
+		now := time.Now()
+		claims, err := ccidentity.VerifyToken(token, acl.Secrets, hostname, payload, now)
+		if err == nil {
+			err = seenTokens.Check(claims, now)
+		}
+		if err != nil {
+			ctx.authErr = fmt.Errorf("%w: authentication failed: %w", ErrPermissionDenied, err)
+			return ctx
+		}
+		ctx.Identity = claims.Identity
+	} else if identity := header.Get(ccidentity.IdentityHeader); len(identity) > 0 {
+		if acl.TrustIdentityHeader {
+			ctx.Identity = identity
+		} else {
+			cclog.ComponentDebug("ACL", "Ignoring untrusted identity header", identity)
+		}
+	}
+	return ctx
+}
+
+// Authorize returns an error if the identity of the request context is not allowed
+// to use method on the control on a device of the given type
+func Authorize(ctx RequestContext, method, control, fullName, deviceType string) error {
+	aclLock.RLock()
+	defer aclLock.RUnlock()
+
+	if !acl.enabled {
+		return nil
+	}
+	if ctx.authErr != nil {
+		return ctx.authErr
+	}
+	for _, r := range acl.Rules {
+		if r.Identity != "*" && r.Identity != ctx.Identity {
+			continue
+		}
+		if len(r.DeviceType) > 0 && r.DeviceType != "*" && r.DeviceType != deviceType {
+			continue
+		}
+		if matchControl(r.Control, control, fullName) && slices.Contains(r.Methods, method) {
+			return nil
+		}
+	}
+	identity := ctx.Identity
+	if len(identity) == 0 {
+		identity = "anonymous"
+	}
+	return fmt.Errorf("%w: identity '%s' may not %s '%s' on device type '%s'", ErrPermissionDenied, identity, method, control, deviceType)
+}
+
+// AuthorizeMessage checks a request against the ACL. Management messages are
+// authorized as PUT on the control in their 'control' tag, a restore of all
+// controls requires PUT on '*'. Topology and control listings are always allowed.
+func AuthorizeMessage(ctx RequestContext, m lp.CCMessage) error {
+	var method, name string
+	switch m.Name() {
+	case "topology", "controls":
+		return nil
+	case "profile":
+		// Checked for each value of the profile by ApplyProfile
+		return nil
+	case "restore", "renew", "release":
+		method = "PUT"
+		name = "*"
+		if control, ok := m.GetTag("control"); ok {
+			name = control
+		}
+	default:
+		method, _ = m.GetControlMethod()
+		name = m.Name()
+	}
+	control, fullName := name, name
+	if _, entry, err := ccprovider.Lookup(name); err == nil {
+		control, fullName = entry.Control(), entry.FullName()
+	}
+	deviceType, _ := m.GetTag("type")
+	return Authorize(ctx, method, control, fullName, deviceType)
+}
+
+// makePermissionReply creates the ERROR reply for a denied request. It is marked
+// with the tag 'error=permission' to distinguish it from other errors.
+func makePermissionReply(request lp.CCMessage, err error) (lp.CCMessage, error) {
+	return makeErrorCodeReply(request, errorPermission, err)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ccidentity "github.com/ClusterCockpit/cc-node-controller/pkg/ccIdentity"
+	"github.com/nats-io/nats.go"
+)
+
+func TestLoadACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"valid", `{"rules": [{"identity": "*", "control": "rapl.*", "methods": ["GET", "PUT"]}]}`, true},
+		{"no identity", `{"rules": [{"control": "rapl.*", "methods": ["GET"]}]}`, false},
+		{"no control", `{"rules": [{"identity": "alice", "methods": ["GET"]}]}`, false},
+		{"invalid pattern", `{"rules": [{"identity": "alice", "control": "rapl.[", "methods": ["GET"]}]}`, false},
+		{"invalid method", `{"rules": [{"identity": "alice", "control": "rapl.*", "methods": ["POST"]}]}`, false},
+		{"invalid json", `{"rules": `, false},
+	}
+	for _, tc := range tests {
+		filename := filepath.Join(t.TempDir(), "acl.json")
+		if err := os.WriteFile(filename, []byte(tc.content), 0o600); err != nil {
+			t.Fatal(err.Error())
+		}
+		a, err := LoadACL(filename)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v but got error %v", tc.name, tc.valid, err)
+		}
+		if err == nil && !a.enabled {
+			t.Errorf("%s: loaded ACL not enabled", tc.name)
+		}
+	}
+
+	if a, err := LoadACL(""); err != nil || a.enabled {
+		t.Errorf("empty filename should return a disabled ACL")
+	}
+}
+
+func TestNewRequestContext(t *testing.T) {
+	defer SetACL(ACL{})
+	payload := []byte(`rapl.pkg_limit_1,hostname=node01,method=PUT,type=socket,type-id=0 value="120000"`)
+	token := func(identity, secret string, expires time.Time, tokenId, hostname string) string {
+		token, err := ccidentity.NewToken(identity, secret, expires, tokenId, hostname, payload)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return token
+	}
+	later := time.Now().Add(time.Minute)
+	replayed := token("alice", "secret-a", later, "id-replay", "node01")
+
+	tests := []struct {
+		name     string
+		trusted  bool
+		token    string
+		identity string
+		expected string
+		authErr  bool
+	}{
+		{"valid token", false, token("alice", "secret-a", later, "id-1", "node01"), "", "alice", false},
+		{"token before header", true, token("alice", "secret-a", later, "id-2", "node01"), "bob", "alice", false},
+		{"first use", false, replayed, "", "alice", false},
+		{"replayed token", false, replayed, "", "", true},
+		{"other host", false, token("alice", "secret-a", later, "id-3", "node02"), "", "", true},
+		{"wrong secret", false, token("alice", "secret-b", later, "id-4", "node01"), "", "", true},
+		{"unknown identity", false, token("carol", "secret-a", later, "id-5", "node01"), "", "", true},
+		{"expired token", false, token("alice", "secret-a", time.Now().Add(-time.Minute), "id-6", "node01"), "", "", true},
+		{"invalid token", false, "alice", "", "", true},
+		{"trusted header", true, "", "bob", "bob", false},
+		{"untrusted header", false, "", "bob", "", false},
+		{"anonymous", true, "", "", "", false},
+	}
+	for _, tc := range tests {
+		SetACL(ACL{
+			TrustIdentityHeader: tc.trusted,
+			Secrets:             map[string]string{"alice": "secret-a", "bob": "secret-b"},
+			enabled:             true,
+		})
+		header := nats.Header{}
+		if len(tc.token) > 0 {
+			header.Set(ccidentity.TokenHeader, tc.token)
+		}
+		if len(tc.identity) > 0 {
+			header.Set(ccidentity.IdentityHeader, tc.identity)
+		}
+		ctx := NewRequestContext(header, payload, "node01")
+		if ctx.Identity != tc.expected || (ctx.authErr != nil) != tc.authErr {
+			t.Errorf("%s: expected identity '%s' (error %v) but got '%s' (%v)", tc.name, tc.expected, tc.authErr, ctx.Identity, ctx.authErr)
+		}
+		if ctx.authErr != nil && !errors.Is(ctx.authErr, ErrPermissionDenied) {
+			t.Errorf("%s: authentication error does not wrap ErrPermissionDenied", tc.name)
+		}
+	}
+
+	// A token is only valid for the payload it was created for
+	header := nats.Header{}
+	header.Set(ccidentity.TokenHeader, token("alice", "secret-a", later, "id-7", "node01"))
+	if ctx := NewRequestContext(header, []byte(`rapl.pkg_limit_1,hostname=node01,method=PUT,type=socket,type-id=0 value="250000"`), "node01"); ctx.authErr == nil {
+		t.Errorf("token accepted for another payload")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	defer SetACL(ACL{})
+	SetACL(ACL{
+		Rules: []ACLRule{
+			{Identity: "*", Control: "*", Methods: []string{"GET"}},
+			{Identity: "alice", Control: "rapl.*", DeviceType: "socket", Methods: []string{"PUT"}},
+			{Identity: "bob", Control: "cpufreq/cpu_freq.*", DeviceType: "*", Methods: []string{"PUT"}},
+			{Identity: "admin", Control: "*", Methods: []string{"GET", "PUT"}},
+		},
+		enabled: true,
+	})
+	alice := RequestContext{Identity: "alice"}
+	bob := RequestContext{Identity: "bob"}
+
+	tests := []struct {
+		name       string
+		ctx        RequestContext
+		method     string
+		control    string
+		fullName   string
+		deviceType string
+		allowed    bool
+	}{
+		{"anonymous GET", RequestContext{}, "GET", "rapl.pkg_limit_1", "sysfeatures/rapl.pkg_limit_1", "socket", true},
+		{"anonymous PUT", RequestContext{}, "PUT", "rapl.pkg_limit_1", "sysfeatures/rapl.pkg_limit_1", "socket", false},
+		{"identity PUT", alice, "PUT", "rapl.pkg_limit_1", "sysfeatures/rapl.pkg_limit_1", "socket", true},
+		{"other device type", alice, "PUT", "rapl.pkg_limit_1", "sysfeatures/rapl.pkg_limit_1", "node", false},
+		{"other control", alice, "PUT", "cpu_freq.governor", "cpufreq/cpu_freq.governor", "hwthread", false},
+		{"provider pattern", bob, "PUT", "cpu_freq.governor", "cpufreq/cpu_freq.governor", "hwthread", true},
+		{"other provider", bob, "PUT", "cpu_freq.governor", "sysfeatures/cpu_freq.governor", "hwthread", false},
+		{"admin", RequestContext{Identity: "admin"}, "PUT", "prefetch.hwpf", "sysfeatures/prefetch.hwpf", "hwthread", true},
+		{"failed authentication", RequestContext{authErr: ErrPermissionDenied}, "GET", "rapl.pkg_limit_1", "sysfeatures/rapl.pkg_limit_1", "socket", false},
+	}
+	for _, tc := range tests {
+		err := Authorize(tc.ctx, tc.method, tc.control, tc.fullName, tc.deviceType)
+		if (err == nil) != tc.allowed {
+			t.Errorf("%s: expected allowed %v but got error %v", tc.name, tc.allowed, err)
+		}
+		if err != nil && !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("%s: error does not wrap ErrPermissionDenied", tc.name)
+		}
+	}
+
+	// A disabled ACL allows everything, even failed authentications
+	SetACL(ACL{})
+	if err := Authorize(RequestContext{authErr: ErrPermissionDenied}, "PUT", "rapl.pkg_limit_1", "sysfeatures/rapl.pkg_limit_1", "socket"); err != nil {
+		t.Errorf("request denied by disabled ACL: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+	"github.com/nats-io/nats.go"
+)
+
+// Requesters of changes made by cc-node-controller itself
+const (
+	requesterLeaseExpiry = "lease-expiry"
+	requesterShutdown    = "shutdown"
+)
+
+// AuditEntry records a single modification of a control
+type AuditEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Requester  string    `json:"requester"`
+	RequestId  string    `json:"request_id,omitempty"` // ID of the request that caused the write
+	Hostname   string    `json:"hostname"`
+	Control    string    `json:"control"` // Namespaced name <provider>/<category>.<name>
+	DeviceType string    `json:"device_type"`
+	DeviceId   string    `json:"device_id"`
+	OldValue   string    `json:"old_value"`
+	NewValue   string    `json:"new_value"`
+	Result     string    `json:"result"` // success, failure or rejected
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLog writes audit entries as JSON lines to a file and optionally publishes
+// them on a NATS subject. The file is rotated when it exceeds maxSize bytes,
+// keeping maxBackups old files <filename>.1 to <filename>.<maxBackups>.
+type AuditLog struct {
+	filename   string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	conn       *nats.Conn
+	subject    string
+}
+
+var (
+	auditLock sync.Mutex
+	auditLog  *AuditLog
+)
+
+// OpenAuditLog opens the audit log file for appending. With an empty filename,
+// entries are only published on NATS.
+func OpenAuditLog(filename string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if len(filename) > 0 {
+		if err := a.open(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log %s: %w", a.filename, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to stat audit log %s: %w", a.filename, err)
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate moves <filename>.N to <filename>.N+1 and the current file to <filename>.1
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	if a.maxBackups > 0 {
+		for i := a.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.filename, i), fmt.Sprintf("%s.%d", a.filename, i+1))
+		}
+		if err := os.Rename(a.filename, a.filename+".1"); err != nil {
+			return fmt.Errorf("Failed to rotate audit log %s: %w", a.filename, err)
+		}
+	} else if err := os.Truncate(a.filename, 0); err != nil {
+		return fmt.Errorf("Failed to truncate audit log %s: %w", a.filename, err)
+	}
+	return a.open()
+}
+
+func (a *AuditLog) write(e AuditEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		cclog.ComponentError("Audit", "Failed to encode audit entry:", err.Error())
+		return
+	}
+	if a.conn != nil && len(a.subject) > 0 {
+		if err := a.conn.Publish(a.subject, data); err != nil {
+			cclog.ComponentError("Audit", "Failed to publish audit entry:", err.Error())
+		}
+	}
+	if len(a.filename) == 0 {
+		return
+	}
+	data = append(data, '\n')
+	if a.file != nil && a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			cclog.ComponentError("Audit", err.Error())
+		}
+	}
+	if a.file == nil {
+		// Opening failed before, try again
+		if err := a.open(); err != nil {
+			cclog.ComponentError("Audit", err.Error())
+			return
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		cclog.ComponentError("Audit", "Failed to write audit entry:", err.Error())
+	}
+}
+
+// Close closes the audit log file
+func (a *AuditLog) Close() {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// SetAuditLog replaces the active audit log and returns the previous one
+func SetAuditLog(a *AuditLog) *AuditLog {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	old := auditLog
+	if old != nil && a != nil {
+		a.conn, a.subject = old.conn, old.subject
+	}
+	auditLog = a
+	return old
+}
+
+// SetAuditNats sets the NATS connection and subject to publish audit entries.
+// An empty subject disables publishing.
+func SetAuditNats(conn *nats.Conn, subject string) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditLog != nil {
+		auditLog.conn = conn
+		auditLog.subject = subject
+	}
+}
+
+// Audit records a modification of a control in the active audit log. Timestamp
+// and hostname are filled in. Without result, it is derived from err.
+func Audit(e AuditEntry, err error) {
+	e.Timestamp = time.Now()
+	e.Hostname = cc_node_control_hostname
+	if len(e.Requester) == 0 {
+		e.Requester = "anonymous"
+	}
+	if err != nil {
+		e.Error = err.Error()
+		if len(e.Result) == 0 {
+			e.Result = "failure"
+		}
+	} else if len(e.Result) == 0 {
+		e.Result = "success"
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditLog != nil {
+		auditLog.write(e)
+	}
+}
+
+// AuditRejectedPut records a PUT request for a control that is rejected before
+// ProcessPutGet validates it, e.g. by the ACL or because the control does not
+// exist. Other requests are ignored.
+func AuditRejectedPut(request lp.CCMessage, ctx RequestContext, err error) {
+	switch request.Name() {
+	case "topology", "controls", "restore", "profile", "renew", "release":
+		return
+	}
+	if method, _ := request.GetControlMethod(); method != "PUT" {
+		return
+	}
+	control := request.Name()
+	if _, entry, lerr := ccprovider.Lookup(control); lerr == nil {
+		control = entry.FullName()
+	}
+	deviceType, _ := request.GetTag("type")
+	var deviceId string
+	if deviceType != "node" {
+		deviceId, _ = request.GetTag("type-id")
+	}
+	value, _ := request.GetControlValue()
+	Audit(AuditEntry{
+		Requester:  ctx.Identity,
+		RequestId:  ctx.RequestId,
+		Control:    control,
+		DeviceType: deviceType,
+		DeviceId:   deviceId,
+		NewValue:   value,
+		Result:     "rejected",
+	}, err)
+}
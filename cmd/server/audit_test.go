@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAuditFile returns the entries of an audit log file
+func readAuditFile(t *testing.T, filename string) []AuditEntry {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid line '%s' in %s: %v", scanner.Text(), filename, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// auditValues returns the new values of the entries in an audit log file
+func auditValues(t *testing.T, filename string) []string {
+	t.Helper()
+	var values []string
+	for _, e := range readAuditFile(t, filename) {
+		values = append(values, e.NewValue)
+	}
+	return values
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	entry := func(value string) AuditEntry {
+		return AuditEntry{
+			Timestamp:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Requester:  "alice",
+			Control:    "sysfeatures/rapl.pkg_limit_1",
+			DeviceType: "socket",
+			DeviceId:   "0",
+			NewValue:   value,
+			Result:     "success",
+		}
+	}
+	data, err := json.Marshal(entry("100001"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Two entries fit into a file
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(filename, 2*int64(len(data)+1), 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer a.Close()
+	for _, value := range []string{"100001", "100002", "100003", "100004", "100005", "100006", "100007"} {
+		a.write(entry(value))
+	}
+
+	tests := []struct {
+		filename string
+		values   []string
+	}{
+		{filename, []string{"100007"}},
+		{filename + ".1", []string{"100005", "100006"}},
+		{filename + ".2", []string{"100003", "100004"}},
+	}
+	for _, tc := range tests {
+		if values := auditValues(t, tc.filename); !slices.Equal(values, tc.values) {
+			t.Errorf("%s: expected %v but got %v", filepath.Base(tc.filename), tc.values, values)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 backups kept")
+	}
+
+	// Without backups, the file is truncated
+	filename = filepath.Join(t.TempDir(), "audit.log")
+	b, err := OpenAuditLog(filename, 2*int64(len(data)+1), 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer b.Close()
+	for _, value := range []string{"100001", "100002", "100003"} {
+		b.write(entry(value))
+	}
+	if values := auditValues(t, filename); !slices.Equal(values, []string{"100003"}) {
+		t.Errorf("expected truncated audit log but got %v", values)
+	}
+	if _, err := os.Stat(filename + ".1"); !os.IsNotExist(err) {
+		t.Errorf("backup created without maxBackups")
+	}
+}
+
+func TestAuditLogFormat(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(filename, 0, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SetAuditLog(a)
+	defer func() { SetAuditLog(nil).Close() }()
+
+	Audit(AuditEntry{
+		Requester:  "alice",
+		RequestId:  "0123abcd",
+		Control:    "sysfeatures/rapl.pkg_limit_1",
+		DeviceType: "socket",
+		DeviceId:   "0",
+		OldValue:   "150000",
+		NewValue:   "120000",
+	}, nil)
+	Audit(AuditEntry{Control: "sysfeatures/rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "1", NewValue: "250000"}, os.ErrInvalid)
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// One JSON object per line
+	var lines []map[string]any
+	for _, text := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		var line map[string]any
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			t.Fatalf("Invalid JSON line '%s': %v", text, err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines but got %d: %s", len(lines), content)
+	}
+
+	tests := []struct {
+		line     int
+		field    string
+		expected any
+	}{
+		{0, "requester", "alice"},
+		{0, "request_id", "0123abcd"},
+		{0, "hostname", cc_node_control_hostname},
+		{0, "control", "sysfeatures/rapl.pkg_limit_1"},
+		{0, "device_type", "socket"},
+		{0, "device_id", "0"},
+		{0, "old_value", "150000"},
+		{0, "new_value", "120000"},
+		{0, "result", "success"},
+		{0, "error", nil},
+		{1, "requester", "anonymous"},
+		{1, "request_id", nil},
+		{1, "result", "failure"},
+		{1, "error", os.ErrInvalid.Error()},
+	}
+	for _, tc := range tests {
+		if value := lines[tc.line][tc.field]; value != tc.expected {
+			t.Errorf("line %d: expected %s '%v' but got '%v'", tc.line, tc.field, tc.expected, value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, lines[0]["timestamp"].(string)); err != nil {
+		t.Errorf("invalid timestamp: %v", err)
+	}
+}
+
+func TestAuditRejectedPuts(t *testing.T) {
+	setupSim(t)
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(filename, 0, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SetAuditLog(a)
+	defer func() { SetAuditLog(nil).Close() }()
+
+	SetACL(ACL{
+		Rules:   []ACLRule{{Identity: "*", Control: "*", Methods: []string{"GET"}}},
+		enabled: true,
+	})
+	ctx := RequestContext{Identity: "alice"}
+	if level, code, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", "120000", "request-id", "0123abcd"), ctx); code != errorPermission {
+		t.Errorf("expected %s but got %s '%s': %s", errorPermission, level, code, msg)
+	}
+	// Denied GET requests are not modifications
+	process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", ""), RequestContext{authErr: ErrPermissionDenied})
+	SetACL(ACL{})
+	if level, code, msg := process(t, newRequest(t, "rapl.pkg_limit_9", "socket", "1", "120000", "request-id", "0123abcd"), ctx); code != errorNoSuchControl {
+		t.Errorf("expected %s but got %s '%s': %s", errorNoSuchControl, level, code, msg)
+	}
+	process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "1", "130000", "request-id", "0123abcd"), ctx)
+
+	entries := readAuditFile(t, filename)
+	expected := []AuditEntry{
+		{Requester: "alice", RequestId: "0123abcd", Control: "sysfeatures/rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "0", NewValue: "120000", Result: "rejected"},
+		{Requester: "alice", RequestId: "0123abcd", Control: "rapl.pkg_limit_9", DeviceType: "socket", DeviceId: "1", NewValue: "120000", Result: "rejected"},
+		{Requester: "alice", RequestId: "0123abcd", Control: "sysfeatures/rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "1", OldValue: "140000", NewValue: "130000", Result: "success"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d audit entries but got %d: %+v", len(expected), len(entries), entries)
+	}
+	for i, e := range entries {
+		if (len(e.Error) > 0) != (expected[i].Result == "rejected") {
+			t.Errorf("entry %d: unexpected error '%s'", i, e.Error)
+		}
+		e.Timestamp, e.Hostname, e.Error = time.Time{}, "", ""
+		if e != expected[i] {
+			t.Errorf("entry %d: expected %+v but got %+v", i, expected[i], e)
+		}
+	}
+}
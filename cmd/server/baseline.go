@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+)
+
+// BaselineEntry is the value of a writable control on a device at startup
+type BaselineEntry struct {
+	Control    string `json:"control"` // Namespaced name <provider>/<category>.<name>
+	DeviceType string `json:"device_type"`
+	DeviceId   string `json:"device_id"`
+	Value      string `json:"value"`
+}
+
+var (
+	baselineMutex sync.Mutex
+	baseline      []BaselineEntry
+)
+
+// CaptureBaseline reads the value of every readable and writable control of all
+// providers on every device of the control's device type
+func CaptureBaseline() {
+	entries := make([]BaselineEntry, 0)
+	for _, c := range ccprovider.List() {
+		if c.ReadOnly || c.WriteOnly {
+			continue
+		}
+		provider, _, err := ccprovider.Lookup(c.FullName())
+		if err != nil {
+			continue
+		}
+		for _, id := range deviceTypeIds(c.DeviceType) {
+			deviceId := fmt.Sprintf("%d", id)
+			if c.DeviceType == "node" {
+				deviceId = ""
+			}
+			value, err := provider.Get(c.Control(), c.DeviceType, deviceId)
+			if err != nil {
+				cclog.ComponentDebug("Baseline", "Cannot read", c.FullName(), "for device", c.DeviceType, deviceId, ":", err.Error())
+				continue
+			}
+			entries = append(entries, BaselineEntry{
+				Control:    c.FullName(),
+				DeviceType: c.DeviceType,
+				DeviceId:   deviceId,
+				Value:      value,
+			})
+		}
+	}
+
+	baselineMutex.Lock()
+	baseline = entries
+	baselineMutex.Unlock()
+	cclog.ComponentDebug("Baseline", "Captured", len(entries), "values")
+	StateChanged()
+}
+
+// RestoreBaseline writes the baseline values back. If control is not empty, only
+// the baseline of this control is restored, if deviceType is not empty, only the
+// baseline of this device. Values equal to the current value are not written.
+// Leases and desired values set by requests are dropped for all restored
+// controls and devices. Every write is recorded in the audit log for requester.
+// If a value to restore is within its cooldown, nothing is restored unless force
+// is set, e.g. on shutdown. It returns the number of restored values.
+func RestoreBaseline(control, deviceType, deviceId, requester string, force bool) (int, error) {
+	if len(control) > 0 {
+		_, entry, err := ccprovider.Lookup(control)
+		if err != nil {
+			return 0, withErrorCode(errorNoSuchControl, err)
+		}
+		control = entry.FullName()
+	}
+
+	baselineMutex.Lock()
+	entries := make([]BaselineEntry, 0)
+	for _, b := range baseline {
+		if len(control) > 0 && b.Control != control {
+			continue
+		}
+		if len(deviceType) > 0 && (b.DeviceType != deviceType || b.DeviceId != deviceId) {
+			continue
+		}
+		entries = append(entries, b)
+	}
+	baselineMutex.Unlock()
+
+	if !force {
+		cooldowns := make([]cooldownWrite, 0)
+		for _, b := range entries {
+			provider, entry, err := ccprovider.Lookup(b.Control)
+			if err != nil {
+				continue
+			}
+			if cur, err := provider.Get(entry.Control(), b.DeviceType, b.DeviceId); err == nil && cur == b.Value {
+				continue
+			}
+			cooldowns = append(cooldowns, cooldownWrite{
+				key:        ControlKey(b.Control, b.DeviceType, b.DeviceId),
+				entry:      entry,
+				deviceType: b.DeviceType,
+				deviceId:   b.DeviceId,
+			})
+		}
+		if err := CheckCooldowns(cooldowns); err != nil {
+			return 0, err
+		}
+	}
+
+	// The baseline supersedes leases and desired values set by requests, like a
+	// PUT request does
+	for _, b := range entries {
+		key := ControlKey(b.Control, b.DeviceType, b.DeviceId)
+		DropLease(key)
+		DropDesiredValue(key)
+	}
+
+	restore := func(b BaselineEntry) (bool, error) {
+		provider, entry, err := ccprovider.Lookup(b.Control)
+		if err != nil {
+			return false, err
+		}
+		cur, err := provider.Get(entry.Control(), b.DeviceType, b.DeviceId)
+		if err == nil && cur == b.Value {
+			return false, nil
+		}
+		cclog.ComponentDebug("Baseline", "Restoring", b.Control, "for device", b.DeviceType, b.DeviceId, "to", b.Value)
+		err = provider.Set(entry.Control(), b.DeviceType, b.DeviceId, b.Value)
+		Audit(AuditEntry{
+			Requester:  requester,
+			Control:    b.Control,
+			DeviceType: b.DeviceType,
+			DeviceId:   b.DeviceId,
+			OldValue:   cur,
+			NewValue:   b.Value,
+		}, err)
+		if err != nil {
+			return false, fmt.Errorf("%s for device %s/%s: %w", b.Control, b.DeviceType, b.DeviceId, err)
+		}
+		RecordWrite(ControlKey(b.Control, b.DeviceType, b.DeviceId), entry, b.DeviceType)
+		return true, nil
+	}
+
+	// Some controls depend on each other (e.g. minimal and maximal frequency), so
+	// failed values are retried once after all other values are restored
+	restored := 0
+	failed := make([]BaselineEntry, 0)
+	for _, b := range entries {
+		changed, err := restore(b)
+		if err != nil {
+			failed = append(failed, b)
+		} else if changed {
+			restored++
+		}
+	}
+	errs := make([]string, 0)
+	for _, b := range failed {
+		changed, err := restore(b)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else if changed {
+			restored++
+		}
+	}
+	if len(errs) > 0 {
+		return restored, fmt.Errorf("Failed to restore %d values: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return restored, nil
+}
+
+// ProcessRestore handles 'restore' control messages. The optional tag 'control'
+// restricts the restore to a single control, a device other than 'node' restricts
+// it to a single device.
+func ProcessRestore(request lp.CCMessage, ctx RequestContext) (lp.CCMessage, error) {
+	result := newControlResult(request)
+	makeReply := func(level, fmtStr string, args ...any) (lp.CCMessage, error) {
+		return makeControlReply(request, level, result, fmt.Sprintf(fmtStr, args...))
+	}
+	makeErrorReply := func(code, fmtStr string, args ...any) (lp.CCMessage, error) {
+		result.Error = code
+		return makeReply("ERROR", fmtStr, args...)
+	}
+
+	if method, _ := request.GetControlMethod(); method != "PUT" {
+		return makeErrorReply(errorInvalidRequest, "Invalid method '%s' for restore, only PUT is supported", method)
+	}
+
+	control, ok := request.GetTag("control")
+	if ok {
+		result.Control = control
+	}
+	deviceType, _ := request.GetTag("type")
+	deviceId, _ := request.GetTag("type-id")
+	if deviceType == "node" {
+		deviceType = ""
+		deviceId = ""
+	}
+
+	if cc_node_control_pretend {
+		return makeReply("INFO", "Pretend: would restore baseline")
+	}
+
+	restored, err := RestoreBaseline(control, deviceType, deviceId, ctx.Identity, false)
+	if err != nil {
+		return makeErrorReply(errorCode(err, errorBackendFailure), "Restored %d values of baseline: %v", restored, err)
+	}
+	return makeReply("INFO", "Restored %d values of baseline", restored)
+}
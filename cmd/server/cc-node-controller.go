@@ -1,48 +1,56 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/ClusterCockpit/cc-node-controller/pkg/sysfeatures"
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+	"github.com/ClusterCockpit/cc-node-controller/pkg/cpufreq"
+	"github.com/ClusterCockpit/cc-node-controller/pkg/powercap"
 
 	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
 	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	"github.com/nats-io/nats.go"
 	// MIT license
 )
 
 var cc_node_control_hostname string = ""
 
-func ProcessPutGet(request lp.CCMessage) (lp.CCMessage, error) {
-	cclog.ComponentDebug("Sysfeatures", "Processing", request.ToLineProtocol(nil))
+// In pretend mode, PUT requests are validated but nothing is written
+var cc_node_control_pretend bool = false
 
+// Read back the value after each PUT request, can be enabled per request by the tag 'verify'
+var cc_node_control_verify atomic.Bool
+
+func ProcessPutGet(request lp.CCMessage, ctx RequestContext) (lp.CCMessage, error) {
+	cclog.ComponentDebug("Control", "Processing", request.ToLineProtocol(nil))
+
+	result := newControlResult(request)
 	makeReply := func(level, fmtStr string, args ...any) (lp.CCMessage, error) {
-		logMsg := fmt.Sprintf(fmtStr, args...)
-		resp, err := lp.NewLog(request.Name(), request.Tags(), request.Meta(), logMsg, time.Now())
-		if err != nil {
-			return nil, fmt.Errorf("Unable to create log message: %w", err)
-		}
-		resp.AddTag("level", level)
-		return resp, nil
+		return makeControlReply(request, level, result, fmt.Sprintf(fmtStr, args...))
 	}
 
-	makeErrorReply := func(fmtStr string, args ...any) (lp.CCMessage, error) {
+	makeErrorReply := func(code, fmtStr string, args ...any) (lp.CCMessage, error) {
+		result.Error = code
 		return makeReply("ERROR", fmtStr, args...)
 	}
 
 	if !request.IsControl() {
-		return makeErrorReply("Received message is not a control message: %v", request)
+		return makeErrorReply(errorInvalidRequest, "Received message is not a control message: %v", request)
 	}
 
 	deviceType, ok := request.GetTag("type")
 	if !ok {
-		return makeErrorReply("No 'type' tag in request: %v", request)
+		return makeErrorReply(errorInvalidRequest, "No 'type' tag in request: %v", request)
 	}
 
 	var deviceId string
@@ -50,75 +58,428 @@ func ProcessPutGet(request lp.CCMessage) (lp.CCMessage, error) {
 		var ok bool
 		deviceId, ok = request.GetTag("type-id")
 		if !ok {
-			return makeErrorReply("No 'type-id' tag in request: %v", request)
+			return makeErrorReply(errorInvalidRequest, "No 'type-id' tag in request: %v", request)
 		}
 	}
+	result.DeviceId = deviceId
+
+	provider, entry, err := ccprovider.Lookup(request.Name())
+	if err != nil {
+		AuditRejectedPut(request, ctx, err)
+		return makeErrorReply(errorNoSuchControl, "%v", err)
+	}
+	knob := entry.Control()
+	result.Control = entry.FullName()
+	result.Unit = entry.Unit
 
-	knob := request.Name()
 	if method, _ := request.GetControlMethod(); method == "PUT" {
-		cclog.ComponentDebug("Sysfeatures", "Creating LIKWID device", deviceType, " ", deviceId)
-		dev, err := sysfeatures.LikwidDeviceCreateByTypeName(deviceType, deviceId)
+		value, _ := request.GetControlValue()
+
+		audit := AuditEntry{
+			Requester:  ctx.Identity,
+			RequestId:  ctx.RequestId,
+			Control:    entry.FullName(),
+			DeviceType: deviceType,
+			DeviceId:   deviceId,
+			NewValue:   value,
+		}
+
+		// Validate the value before touching the hardware, also in pretend mode
+		err = CheckPolicy(entry, deviceType, value)
 		if err != nil {
-			return makeErrorReply("Cannot create LIKWID device %s/%s", deviceType, deviceId)
+			audit.Result = "rejected"
+			Audit(audit, err)
+			return makeErrorReply(errorInvalidValue, "%v", err)
 		}
-		defer sysfeatures.LikwidDeviceDestroy(dev)
 
-		value, _ := request.GetControlValue()
+		var leaseDuration time.Duration
+		if _, ok := request.GetTag("lease"); ok {
+			code := errorInvalidRequest
+			leaseDuration, err = parseLeaseDuration(request)
+			if err == nil && entry.WriteOnly {
+				code = errorWriteOnly
+				err = fmt.Errorf("Cannot lease '%s': control is writeonly, the current value cannot be restored", knob)
+			}
+			if err != nil {
+				audit.Result = "rejected"
+				Audit(audit, err)
+				return makeErrorReply(code, "%v", err)
+			}
+		}
 
-		cclog.ComponentDebug("Sysfeatures", "Set", knob, "for device", deviceType, " ", deviceId, "to", value)
-		err = sysfeatures.SysFeaturesSetByNameAndDevice(knob, dev, value)
-		if err != nil {
-			return makeErrorReply("Failed to set %s=%s for device %s/%s", knob, value, deviceType, deviceId)
+		enforce, hasEnforce := request.GetTag("enforce")
+		if hasEnforce {
+			code := errorInvalidRequest
+			enforce, err = checkDesiredMode(enforce)
+			if err == nil && leaseDuration > 0 {
+				err = fmt.Errorf("Cannot enforce '%s' with lease", knob)
+			} else if err == nil && entry.WriteOnly {
+				code = errorWriteOnly
+				err = fmt.Errorf("Cannot enforce '%s': control is writeonly", knob)
+			}
+			if err != nil {
+				audit.Result = "rejected"
+				Audit(audit, err)
+				return makeErrorReply(code, "%v", err)
+			}
 		}
 
-		return makeReply("INFO", "Set '%s' for device '%s:%s': SUCCESS!", knob, deviceType, deviceId)
-	} else if method == "GET" {
-		cclog.ComponentDebug("Sysfeatures", "Creating LIKWID device", deviceType, " ", deviceId)
-		dev, err := sysfeatures.LikwidDeviceCreateByTypeName(deviceType, deviceId)
+		if cc_node_control_pretend {
+			return ProcessPretendPut(request, provider, entry, deviceType, deviceId, value)
+		}
+
+		if entry.ReadOnly {
+			err = fmt.Errorf("Cannot set '%s' for device '%s:%s': control is readonly", knob, deviceType, deviceId)
+			audit.Result = "rejected"
+			Audit(audit, err)
+			return makeErrorReply(errorReadOnly, "%v", err)
+		}
+
+		key := ControlKey(entry.FullName(), deviceType, deviceId)
+		if ok, next, coalesced := CheckCooldown(key, entry, deviceType, request, ctx); !ok {
+			if coalesced {
+				result.Deferred = next.Format(time.RFC3339)
+				resp, err := makeReply("INFO", "Set '%s' for device '%s:%s' deferred until end of cooldown at %s", knob, deviceType, deviceId, result.Deferred)
+				if err != nil {
+					return nil, err
+				}
+				resp.AddTag("deferred", result.Deferred)
+				return resp, nil
+			}
+			err = fmt.Errorf("Cooldown: '%s' for device '%s:%s' was written recently, next write allowed at %s", knob, deviceType, deviceId, next.Format(time.RFC3339))
+			audit.Result = "rejected"
+			Audit(audit, err)
+			return makeErrorReply(errorCooldown, "%v", err)
+		}
+
+		// The old value is required to revert a lease, otherwise it is only recorded
+		if !entry.WriteOnly {
+			audit.OldValue, err = provider.Get(knob, deviceType, deviceId)
+			if err != nil && leaseDuration > 0 {
+				Audit(audit, err)
+				return makeErrorReply(backendErrorCode(deviceType, deviceId), "Failed to get %s for device %s/%s: %v", knob, deviceType, deviceId, err)
+			}
+		}
+
+		cclog.ComponentDebug(provider.Name(), "Set", knob, "for device", deviceType, " ", deviceId, "to", value, "request-id", ctx.RequestId)
+		err = provider.Set(knob, deviceType, deviceId, value)
+		Audit(audit, err)
 		if err != nil {
-			return makeErrorReply("Cannot create LIKWID device %s/%s", deviceType, deviceId)
+			// An existing lease and desired value stay active, so a leased
+			// value is still reverted
+			return makeErrorReply(backendErrorCode(deviceType, deviceId), "Failed to set %s=%s for device %s/%s: %v", knob, value, deviceType, deviceId, err)
+		}
+		result.Value = value
+		result.Timestamp = time.Now()
+		RecordWrite(key, entry, deviceType)
+
+		if leaseDuration == 0 {
+			// A change without lease supersedes an existing lease
+			DropLease(key)
+		}
+		if !hasEnforce {
+			// A change without enforce supersedes a desired value set by a request
+			DropDesiredValue(key)
 		}
-		defer sysfeatures.LikwidDeviceDestroy(dev)
 
-		cclog.ComponentDebug("Sysfeatures", "Get", knob, "for device", deviceType, " ", deviceId)
-		value, err := sysfeatures.SysFeaturesGetByNameAndDevice(knob, dev)
+		if hasEnforce {
+			AddDesiredValue(key, DesiredValue{
+				Control:    entry.FullName(),
+				DeviceType: deviceType,
+				DeviceId:   deviceId,
+				Value:      value,
+				Mode:       enforce,
+			})
+		}
+
+		var leaseMsg string
+		if leaseDuration > 0 {
+			expires := AddLease(entry.FullName(), deviceType, deviceId, value, audit.OldValue, leaseDuration)
+			leaseMsg = fmt.Sprintf(" Lease expires at %s", expires.Format(time.RFC3339))
+		}
+		msg := fmt.Sprintf("Set '%s' for device '%s:%s': SUCCESS!%s", knob, deviceType, deviceId, leaseMsg)
+
+		verify := cc_node_control_verify.Load()
+		if v, ok := request.GetTag("verify"); ok {
+			verify = v == "true"
+		}
+		if !verify || entry.WriteOnly {
+			return makeReply("INFO", "%s", msg)
+		}
+
+		// The hardware may round or clamp the value, so report the value it accepted
+		effective, err := provider.Get(knob, deviceType, deviceId)
 		if err != nil {
-			return makeErrorReply("Failed to get %s for device %s/%s", knob, deviceType, deviceId)
+			return makeReply("WARN", "%s Failed to verify value: %v", msg, err)
+		}
+		result.Value = effective
+		result.Requested = value
+		level := "INFO"
+		if strings.TrimSpace(effective) != strings.TrimSpace(value) {
+			level = "WARN"
+			msg = fmt.Sprintf("Set '%s' for device '%s:%s': requested '%s' but effective value is '%s'.%s", knob, deviceType, deviceId, value, effective, leaseMsg)
+		}
+		resp, err := makeReply(level, "%s", msg)
+		if err != nil {
+			return nil, err
+		}
+		resp.AddTag("requested", value)
+		resp.AddTag("effective", effective)
+		return resp, nil
+	} else if method == "GET" {
+		if entry.WriteOnly {
+			return makeErrorReply(errorWriteOnly, "Cannot get '%s' for device '%s:%s': control is writeonly", knob, deviceType, deviceId)
+		}
+		cclog.ComponentDebug(provider.Name(), "Get", knob, "for device", deviceType, " ", deviceId, "request-id", ctx.RequestId)
+		value, err := provider.Get(knob, deviceType, deviceId)
+		if err != nil {
+			return makeErrorReply(backendErrorCode(deviceType, deviceId), "Failed to get %s for device %s/%s: %v", knob, deviceType, deviceId, err)
 		}
 
-		cclog.ComponentDebug("Sysfeatures", "Get", knob, "for device", deviceType, " ", deviceId, "returned", value)
+		cclog.ComponentDebug(provider.Name(), "Get", knob, "for device", deviceType, " ", deviceId, "returned", value)
+		result.Value = value
+		result.Timestamp = time.Now()
 		return makeReply("INFO", "%s", value)
 	} else {
-		return makeReply("Invalid method '%s' in control request: %v", method, request)
+		return makeErrorReply(errorInvalidRequest, "Invalid method '%s' in control request: %v", method, request)
 	}
 }
 
+// ProcessPretendPut validates a PUT request like ProcessPutGet does, but instead of
+// writing the value, it replies with the change that would have been made.
+func ProcessPretendPut(request lp.CCMessage, provider ccprovider.ControlProvider, entry ccprovider.ControlEntry, deviceType, deviceId, value string) (lp.CCMessage, error) {
+	result := ControlResult{
+		Control:    entry.FullName(),
+		DeviceType: deviceType,
+		DeviceId:   deviceId,
+		Unit:       entry.Unit,
+	}
+	makeReply := func(level, fmtStr string, args ...any) (lp.CCMessage, error) {
+		return makeControlReply(request, level, result, fmt.Sprintf(fmtStr, args...))
+	}
+
+	makeErrorReply := func(code, fmtStr string, args ...any) (lp.CCMessage, error) {
+		result.Error = code
+		return makeReply("ERROR", fmtStr, args...)
+	}
+
+	knob := entry.Control()
+	if entry.ReadOnly {
+		return makeErrorReply(errorReadOnly, "Pretend: cannot set '%s' for device '%s:%s': control is readonly", knob, deviceType, deviceId)
+	}
+
+	if entry.WriteOnly {
+		// The current value cannot be read, so only check that the device exists
+		if !deviceExists(deviceType, deviceId) {
+			return makeErrorReply(errorNoSuchDevice, "Pretend: cannot set '%s' for device '%s:%s': no such device", knob, deviceType, deviceId)
+		}
+		return makeReply("INFO", "Pretend: would set '%s' for device '%s:%s' to '%s' (writeonly, current value unknown)", knob, deviceType, deviceId, value)
+	}
+
+	cclog.ComponentDebug(provider.Name(), "Pretend: Get", knob, "for device", deviceType, " ", deviceId)
+	old, err := provider.Get(knob, deviceType, deviceId)
+	if err != nil {
+		return makeErrorReply(backendErrorCode(deviceType, deviceId), "Pretend: failed to get %s for device %s/%s: %v", knob, deviceType, deviceId, err)
+	}
+	if old == value {
+		return makeReply("INFO", "Pretend: would not change '%s' for device '%s:%s', already '%s'", knob, deviceType, deviceId, old)
+	}
+	return makeReply("INFO", "Pretend: would set '%s' for device '%s:%s' from '%s' to '%s'", knob, deviceType, deviceId, old, value)
+}
+
 func ReadCli() map[string]string {
 	var m map[string]string
 	cfg := flag.String("config", "./config.json", "Path to configuration file")
 	loglevel := flag.String("loglevel", "warn", "Activate debug output")
 	pretend := flag.Bool("pretend", false, "Do not actually do anything")
+	backend := flag.String("backend", "likwid", "Control backend: 'likwid' for hardware access or 'sim' for the simulated sysfeatures backend")
+	simfile := flag.String("simfile", "./sim.json", "Path to the feature table of the simulated sysfeatures backend")
 	flag.Parse()
 	m = make(map[string]string)
 	m["configfile"] = *cfg
 	m["loglevel"] = *loglevel
 	m["pretend"] = fmt.Sprintf("%v", *pretend)
+	m["backend"] = *backend
+	m["simfile"] = *simfile
 	return m
 }
 
-func LoadNatsConfiguration(filename string) (NatsConfig, error) {
-	natsConfig := NatsConfig{
-		OutstandingMessages: 1000,
+// ProcessMessage checks the permissions of the sender, dispatches a request by
+// its name and returns the reply
+func ProcessMessage(m lp.CCMessage, ctx RequestContext) lp.CCMessage {
+	var r lp.CCMessage
+	var err error
+	// The client sets a request ID to correlate replies and logs with its requests
+	ctx.RequestId, _ = m.GetTag("request-id")
+	cclog.ComponentDebug("LOOP", "processing request-id", ctx.RequestId, m.String())
+	// Controls of hardware threads can be requested for coarser devices like sockets
+	if requests, gather, ok := FanOutRequest(m); ok {
+		replies := make([]lp.CCMessage, len(requests))
+		for i, r := range requests {
+			replies[i] = ProcessMessage(r, ctx)
+		}
+		return gather(replies)
 	}
-	configFile, err := os.Open(filename)
+	if aerr := AuthorizeMessage(ctx, m); aerr != nil {
+		cclog.ComponentWarn("ACL", aerr.Error(), "request-id", ctx.RequestId)
+		AuditRejectedPut(m, ctx, aerr)
+		r, err = makePermissionReply(m, aerr)
+		if err != nil {
+			cclog.Error(err.Error())
+		}
+		return r
+	}
+	switch m.Name() {
+	case "topology":
+		cclog.ComponentDebug("LOOP", "Got topology message")
+		r, err = ProcessTopologyConfig(m)
+		if err != nil {
+			cclog.Error(err.Error())
+		}
+	case "controls":
+		cclog.ComponentDebug("LOOP", "Got controls message")
+		r, err = ProcessControlsConfig(m)
+		if err != nil {
+			cclog.Error(err.Error())
+		}
+	case "restore":
+		cclog.ComponentDebug("LOOP", "Got restore message")
+		r, err = ProcessRestore(m, ctx)
+		if err != nil {
+			cclog.Error(err.Error())
+		}
+	case "profile":
+		cclog.ComponentDebug("LOOP", "Got profile message")
+		r, err = ProcessProfile(m, ctx)
+		if err != nil {
+			cclog.Error(err.Error())
+		}
+	case "renew", "release":
+		cclog.ComponentDebug("LOOP", "Got", m.Name(), "message")
+		r, err = ProcessLease(m, ctx)
+		if err != nil {
+			cclog.Error(err.Error())
+		}
+	default:
+		// In this case, name corresponds to the control, that is to be read/written.
+		// The control is resolved to its provider in ProcessPutGet.
+		r, err = ProcessPutGet(m, ctx)
+		if err != nil {
+			cclog.Error(err.Error())
+		}
+	}
+	return r
+}
+
+// ExpandRequest splits a control request with a device set in the tag 'type-id'
+// (e.g. '*' or '0-15,32-47') into one request per device. Other requests are
+// returned unchanged.
+func ExpandRequest(m lp.CCMessage) ([]lp.CCMessage, error) {
+	switch m.Name() {
+	case "topology", "controls", "restore", "profile", "renew", "release":
+		return []lp.CCMessage{m}, nil
+	}
+	deviceType, _ := m.GetTag("type")
+	deviceId, ok := m.GetTag("type-id")
+	if !ok || deviceType == "node" || !isDeviceSet(deviceId) {
+		return []lp.CCMessage{m}, nil
+	}
+
+	ids, err := expandDeviceIds(deviceType, deviceId)
 	if err != nil {
-		cclog.Error(err.Error())
-		return natsConfig, err
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No devices of type '%s' in the local topology: %w", deviceType, errNoSuchDevice)
+	}
+	out := make([]lp.CCMessage, 0, len(ids))
+	for _, id := range ids {
+		r := lp.FromMessage(m)
+		r.AddTag("type-id", id)
+		out = append(out, r)
 	}
-	defer configFile.Close()
-	jsonParser := json.NewDecoder(configFile)
-	err = jsonParser.Decode(&natsConfig)
-	return natsConfig, err
+	return out, nil
+}
+
+// RespondBatch sends all replies of a request in one multi-line reply. Missing
+// replies (e.g. for non-local lines) are skipped.
+func RespondBatch(msg *nats.Msg, replies []lp.CCMessage) {
+	lines := make([]string, 0, len(replies))
+	for _, r := range replies {
+		if r != nil {
+			r.AddTag("hostname", cc_node_control_hostname)
+			lines = append(lines, r.ToLineProtocol(nil))
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	cclog.ComponentDebug("LOOP", "sending response", strings.Join(lines, "\n"))
+	err := msg.Respond([]byte(strings.Join(lines, "\n")))
+	if err != nil {
+		cclog.ComponentError("LOOP", "Failed to send response:", err.Error())
+	}
+}
+
+// ExclusiveRequest returns whether a request may write several controls, like
+// 'restore' and 'profile'. It is processed exclusively, so it is ordered with the
+// requests for all controls and devices.
+func ExclusiveRequest(m lp.CCMessage) bool {
+	switch m.Name() {
+	case "restore", "profile":
+		return true
+	}
+	return false
+}
+
+// RequestKey returns the key used to distribute a request to the workers. Requests
+// for the same control and device get the same key, so they are strictly ordered.
+func RequestKey(m lp.CCMessage) string {
+	name := m.Name()
+	// Management messages like 'renew' select the control by tag
+	if control, ok := m.GetTag("control"); ok {
+		name = control
+	}
+	if _, entry, err := ccprovider.Lookup(name); err == nil {
+		name = entry.FullName()
+	}
+	deviceType, _ := m.GetTag("type")
+	deviceId, _ := m.GetTag("type-id")
+	return ControlKey(name, deviceType, deviceId)
+}
+
+// RegisterProviders registers all control providers of a backend. Providers failing
+// to initialize are skipped, so that a node without LIKWID can still be controlled
+// through the remaining providers. The 'sim' backend registers only the simulated
+// sysfeatures provider to not touch the hardware at all.
+func RegisterProviders(config Config, backend, simfile string) error {
+	var providers []ccprovider.ControlProvider
+	switch backend {
+	case "likwid":
+		providers = []ccprovider.ControlProvider{
+			&sysfeaturesProvider{},
+			cpufreq.NewCpufreqProvider(config.CpufreqPath),
+			powercap.NewPowercapProvider(config.PowercapPath),
+		}
+	case "sim":
+		providers = []ccprovider.ControlProvider{
+			&simSysfeaturesProvider{
+				filename: simfile,
+			},
+		}
+	default:
+		return fmt.Errorf("Invalid backend '%s'", backend)
+	}
+	for _, p := range providers {
+		err := ccprovider.Register(p)
+		if err != nil {
+			cclog.ComponentWarn("CONFIG", err.Error())
+		}
+	}
+	if len(ccprovider.Providers()) == 0 {
+		return fmt.Errorf("No control provider available")
+	}
+	return nil
 }
 
 func real_main() int {
@@ -132,13 +493,6 @@ func real_main() int {
 	hostname = strings.SplitN(hostname, ".", 2)[0]
 	cc_node_control_hostname = hostname
 
-	err = sysfeatures.SysFeaturesInit()
-	if err != nil {
-		cclog.Errorf("SysFeaturesInit() failed: %v", err)
-		return 1
-	}
-	defer sysfeatures.SysFeaturesClose()
-
 	cli_opts := ReadCli()
 	if len(cli_opts["configfile"]) == 0 {
 		cli_opts["configfile"] = "./config.json"
@@ -146,86 +500,306 @@ func real_main() int {
 
 	cclog.Init(cli_opts["loglevel"], false)
 
-	config, err := LoadNatsConfiguration(cli_opts["configfile"])
+	if cli_opts["pretend"] == "true" {
+		cclog.ComponentWarn("CONFIG", "Running in pretend mode, PUT requests are not executed")
+		cc_node_control_pretend = true
+	}
+
+	config, err := LoadConfiguration(cli_opts["configfile"])
 	if err != nil {
 		cclog.Error(err.Error())
 		return 1
 	}
-	if len(config.RequestSubject) == 0 {
-		cclog.ComponentError("CONFIG", "Failed to request subject for NATS")
+	if len(config.RequestSubjects(hostname)) == 0 {
+		cclog.ComponentError("CONFIG", "No request subject for NATS, set requestSubject, requestSubjectPrefix or broadcastSubject")
+		return 1
+	}
+	policy, err := LoadPolicy(config.PolicyFile)
+	if err != nil {
+		cclog.ComponentError("CONFIG", err.Error())
+		return 1
+	}
+	SetPolicy(policy)
+	acl, err := LoadACL(config.ACLFile)
+	if err != nil {
+		cclog.ComponentError("CONFIG", err.Error())
+		return 1
+	}
+	SetACL(acl)
+	audit, err := OpenAuditLog(config.AuditFile, config.AuditMaxSize, config.AuditMaxBackups)
+	if err != nil {
+		cclog.ComponentError("CONFIG", err.Error())
 		return 1
 	}
-	cclog.ComponentDebug("CONFIG", "Initializing sysfeatures")
-	err = sysfeatures.SysFeaturesInit()
+	SetAuditLog(audit)
+	cc_node_control_verify.Store(config.VerifyWrites)
+	cooldowns, err := ParseCooldowns(config.Cooldowns)
+	if err != nil {
+		cclog.ComponentError("CONFIG", err.Error())
+		return 1
+	}
+	SetCooldowns(cooldowns)
+	rateLimiter.SetRateLimit(config.RateLimit, config.RateBurst)
+	SetProfiles(config.Profiles)
+	defer func() {
+		SetAuditLog(nil).Close()
+	}()
+	cclog.ComponentDebug("CONFIG", "Registering control providers")
+	err = RegisterProviders(config, cli_opts["backend"], cli_opts["simfile"])
 	if err != nil {
 		cclog.Error(err.Error())
 		return 1
 	}
-	defer sysfeatures.SysFeaturesClose()
+	defer ccprovider.Close()
+	if err := ValidateProfiles(config.Profiles); err != nil {
+		cclog.ComponentError("CONFIG", err.Error())
+		return 1
+	}
 
 	cclog.ComponentDebug("CONFIG", "Connecting NATS")
-	conn, err := ConnectNats(config)
+	conn, err := ConnectNats(config.NatsConfig, hostname)
 	if err != nil {
 		cclog.Error(err.Error())
 		return 1
 	}
-	defer DisconnectNats(conn)
+	defer func() {
+		SetAuditNats(nil, "")
+		SetEventNats(nil, "")
+		DisconnectNats(conn)
+	}()
+	SetAuditNats(conn.conn, config.AuditSubject)
+	SetEventNats(conn.conn, config.EventSubject)
+
+	// Deferred before the worker pool, so the state is written after all requests are processed
+	stopStateSaver, interval, err := startState(config)
+	if err != nil {
+		cclog.ComponentError("CONFIG", err.Error())
+		return 1
+	}
+	defer stopStateSaver()
+
+	// Deferred after the worker pool, so the baseline is restored after all requests are processed
+	restoreOnExit := false
+	defer func() {
+		if restoreOnExit {
+			cclog.ComponentInfo("CONFIG", "Restoring baseline")
+			if _, err := RestoreBaseline("", "", "", requesterShutdown, true); err != nil {
+				cclog.ComponentError("CONFIG", err.Error())
+			}
+		}
+	}()
+
+	// Deferred after DisconnectNats, so queued requests are still answered on shutdown
+	pool := NewWorkerPool(config.Workers, config.OutstandingMessages)
+	SetBackgroundPool(pool)
+	var inflight sync.WaitGroup
+	defer func() {
+		pool.Close()
+		inflight.Wait()
+	}()
+
+	reconciler := StartReconciler(interval)
+	defer reconciler.Stop()
 
 	cclog.ComponentDebug("CONFIG", "Configuring signals")
 	shutdownSignal := make(chan os.Signal, 1)
 	signal.Notify(shutdownSignal, os.Interrupt)
 	signal.Notify(shutdownSignal, syscall.SIGTERM)
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+
+	handleRequest := func(msg *nats.Msg) {
+		data, err := lp.FromBytes(msg.Data)
+		if err != nil {
+			cclog.ComponentError("LOOP", "Failed to parse request:", err.Error())
+			return
+		}
+		// All lines of a request are processed and the replies are sent
+		// back in one multi-line reply in request order. Lines with a device
+		// set get one reply per device.
+		ctx := NewRequestContext(msg.Header, msg.Data, hostname)
+		replies := make([][]lp.CCMessage, len(data))
+		var batch sync.WaitGroup
+		var gathers []func()
+		submit := func(r lp.CCMessage, reply *lp.CCMessage) {
+			cclog.ComponentDebug("LOOP", "queueing", r.String())
+			batch.Add(1)
+			job := func() {
+				defer batch.Done()
+				*reply = ProcessMessage(r, ctx)
+			}
+			var ok bool
+			if ExclusiveRequest(r) {
+				ok = pool.SubmitExclusive(job)
+			} else {
+				ok = pool.Submit(RequestKey(r), job)
+			}
+			if !ok {
+				batch.Done()
+			}
+		}
+		for i, m := range data {
+			if h, ok := m.GetTag("hostname"); ok && h != hostname {
+				cclog.ComponentDebugf("LOOP", "Non-local command (our hostname: %s, directed at: %s), skipping...", hostname, h)
+				continue
+			}
+			if requester := RateLimitKey(ctx.Identity, msg.Reply); !rateLimiter.Allow(requester) {
+				id, _ := m.GetTag("request-id")
+				err := fmt.Errorf("Rate limit exceeded for requester '%s' (request-id %s)", requester, id)
+				cclog.ComponentWarn("LOOP", err.Error())
+				r, _ := makeErrorCodeReply(m, errorRateLimit, err)
+				replies[i] = []lp.CCMessage{r}
+				continue
+			}
+			requests, err := ExpandRequest(m)
+			if err != nil {
+				code := errorInvalidRequest
+				if errors.Is(err, errNoSuchDevice) {
+					code = errorNoSuchDevice
+				}
+				r, _ := makeErrorCodeReply(m, code, err)
+				replies[i] = []lp.CCMessage{r}
+				continue
+			}
+			replies[i] = make([]lp.CCMessage, len(requests))
+			for j, r := range requests {
+				// Requests fanned out to hardware threads are queued per hardware
+				// thread, so they are ordered with requests for the single hardware threads
+				subRequests, gather, ok := FanOutRequest(r)
+				if !ok {
+					submit(r, &replies[i][j])
+					continue
+				}
+				subReplies := make([]lp.CCMessage, len(subRequests))
+				for k, sub := range subRequests {
+					submit(sub, &subReplies[k])
+				}
+				gathers = append(gathers, func() {
+					replies[i][j] = gather(subReplies)
+				})
+			}
+		}
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			batch.Wait()
+			for _, gather := range gathers {
+				gather()
+			}
+			RespondBatch(msg, slices.Concat(replies...))
+		}()
+	}
 
 	cclog.ComponentDebug("CONFIG", "Starting Loop")
 global_for:
 	for {
 		select {
-		case <-shutdownSignal:
+		case sig := <-shutdownSignal:
 			cclog.ComponentDebug("LOOP", "got interrupt, exiting...")
+			restoreOnExit = sig == syscall.SIGTERM && config.RestoreOnShutdown && !cc_node_control_pretend
 			break global_for
-		case msg := <-conn.ch:
-			data, err := lp.FromBytes(msg.Data)
-			if err == nil {
-				for _, m := range data {
-					var r lp.CCMessage = nil
-					select {
-					case <-shutdownSignal:
-						cclog.ComponentDebug("LOOP", "got interrupt, exiting...")
-						break global_for
-					default:
-						if h, ok := m.GetTag("hostname"); ok && h != hostname {
-							cclog.ComponentDebugf("LOOP", "Non-local command (our hostname: %s, directed at: %s), skipping...", hostname, h)
-							continue
-						}
-						cclog.ComponentDebug("LOOP", "processing", m.String())
-						switch m.Name() {
-						case "topology":
-							cclog.ComponentDebug("LOOP", "Got topology message")
-							r, err = ProcessTopologyConfig(m)
-							if err != nil {
-								cclog.Error(err.Error())
-							}
-						case "controls":
-							cclog.ComponentDebug("LOOP", "Got controls message")
-							r, err = ProcessControlsConfig(m)
-							if err != nil {
-								cclog.Error(err.Error())
-							}
-						default:
-							// In this case, name corresponds to the control, that is to be read/written
-							r, err = ProcessPutGet(m)
-							if err != nil {
-								cclog.Error(err.Error())
-							}
-						}
-						if r != nil {
-							r.AddTag("hostname", cc_node_control_hostname)
-							cclog.ComponentDebug("LOOP", "sending response", r.ToLineProtocol(nil))
-							msg.Respond([]byte(r.ToLineProtocol(nil)))
-						}
-					}
+		case <-reloadSignal:
+			cclog.ComponentInfo("CONFIG", "got hangup, reloading configuration", cli_opts["configfile"])
+			newConfig, err := LoadConfiguration(cli_opts["configfile"])
+			if err != nil {
+				cclog.ComponentError("CONFIG", "Failed to reload configuration, keeping old configuration:", err.Error())
+				continue
+			}
+			if len(newConfig.RequestSubjects(hostname)) == 0 {
+				cclog.ComponentError("CONFIG", "No request subject for NATS in new configuration, keeping old configuration")
+				continue
+			}
+			newPolicy, err := LoadPolicy(newConfig.PolicyFile)
+			if err != nil {
+				cclog.ComponentError("CONFIG", "Failed to load policy, keeping old configuration:", err.Error())
+				continue
+			}
+			newACL, err := LoadACL(newConfig.ACLFile)
+			if err != nil {
+				cclog.ComponentError("CONFIG", "Failed to load ACL, keeping old configuration:", err.Error())
+				continue
+			}
+			if err := ValidateProfiles(newConfig.Profiles); err != nil {
+				cclog.ComponentError("CONFIG", "Invalid profiles, keeping old configuration:", err.Error())
+				continue
+			}
+			newDesired, err := ExpandDesiredState(newConfig.DesiredState)
+			if err != nil {
+				cclog.ComponentError("CONFIG", "Failed to load desired state, keeping old configuration:", err.Error())
+				continue
+			}
+			newInterval, err := time.ParseDuration(newConfig.ReconcileInterval)
+			if err != nil {
+				cclog.ComponentError("CONFIG", "Invalid reconcileInterval, keeping old configuration:", err.Error())
+				continue
+			}
+			newCooldowns, err := ParseCooldowns(newConfig.Cooldowns)
+			if err != nil {
+				cclog.ComponentError("CONFIG", "Invalid cooldowns, keeping old configuration:", err.Error())
+				continue
+			}
+			// The providers keep running, so their options require a restart
+			if changed := newConfig.KeepRestartOptions(config); len(changed) > 0 {
+				cclog.ComponentWarn("CONFIG", "Ignoring changed", strings.Join(changed, ", "), "until restart")
+			}
+			var newAudit *AuditLog
+			if newConfig.AuditFile != config.AuditFile || newConfig.AuditMaxSize != config.AuditMaxSize || newConfig.AuditMaxBackups != config.AuditMaxBackups {
+				newAudit, err = OpenAuditLog(newConfig.AuditFile, newConfig.AuditMaxSize, newConfig.AuditMaxBackups)
+				if err != nil {
+					cclog.ComponentError("CONFIG", "Failed to open audit log, keeping old configuration:", err.Error())
+					continue
 				}
 			}
+
+			if !newConfig.NatsConfig.ConnectionEquals(config.NatsConfig) {
+				cclog.ComponentDebug("CONFIG", "NATS configuration changed, reconnecting")
+				newConn, err := ConnectNats(newConfig.NatsConfig, hostname)
+				if err != nil {
+					cclog.ComponentError("CONFIG", "Failed to connect with new configuration, keeping old configuration:", err.Error())
+					continue
+				}
+				// Stop receiving on the old connection, handle the remaining requests
+				// and wait for their replies before closing it
+				oldConn := conn
+				conn = newConn
+				UnsubscribeNats(oldConn)
+				for len(oldConn.ch) > 0 {
+					handleRequest(<-oldConn.ch)
+				}
+				inflight.Wait()
+				SetAuditNats(conn.conn, newConfig.AuditSubject)
+				SetEventNats(conn.conn, newConfig.EventSubject)
+				DisconnectNats(oldConn)
+			}
+
+			if newConfig.Workers != config.Workers || newConfig.OutstandingMessages != config.OutstandingMessages {
+				cclog.ComponentDebug("CONFIG", "Worker pool configuration changed, restarting worker pool")
+				pool = ReplaceWorkerPool(pool, newConfig.Workers, newConfig.OutstandingMessages)
+			}
+
+			SetPolicy(newPolicy)
+			SetACL(newACL)
+			SetProfiles(newConfig.Profiles)
+			cc_node_control_verify.Store(newConfig.VerifyWrites)
+			SetCooldowns(newCooldowns)
+			if newConfig.RateLimit != config.RateLimit || newConfig.RateBurst != config.RateBurst {
+				rateLimiter.SetRateLimit(newConfig.RateLimit, newConfig.RateBurst)
+			}
+			if newAudit != nil {
+				SetAuditLog(newAudit).Close()
+			}
+			SetAuditNats(conn.conn, newConfig.AuditSubject)
+			SetEventNats(conn.conn, newConfig.EventSubject)
+			SetDesiredState(newDesired)
+			if newConfig.StateFile != config.StateFile {
+				SetStateFile(newConfig.StateFile)
+				StateChanged()
+			}
+			reconciler.SetInterval(newInterval)
+			config = newConfig
+			cclog.ComponentInfo("CONFIG", "Configuration reloaded")
+		case msg := <-conn.ch:
+			handleRequest(msg)
 		}
 	}
 
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+	ccidentity "github.com/ClusterCockpit/cc-node-controller/pkg/ccIdentity"
+
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+)
+
+// The simulation file in the repository root: 2 sockets with 2 cores each and
+// 2 hardware threads per core
+const simFile = "../../sim.json"
+
+// setupSim registers the simulated backend with the initial values of the
+// simulation file. The simulated topology replaces the local one. The global
+// state of the server is reset after the test.
+func setupSim(t *testing.T) {
+	t.Helper()
+	setupSimFile(t, simFile)
+}
+
+// setupSimFile registers the simulated backend with another simulation file
+func setupSimFile(t *testing.T, filename string) {
+	t.Helper()
+	if err := RegisterProviders(Config{}, "sim", filename); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() {
+		resetServerState()
+		ccprovider.Close()
+	})
+}
+
+// resetServerState drops leases, desired values, cooldowns and all other state
+// kept between requests
+func resetServerState() {
+	leasesMutex.Lock()
+	for _, l := range leases {
+		if l.timer != nil {
+			l.timer.Stop()
+		}
+	}
+	leases = make(map[string]*Lease)
+	leasesMutex.Unlock()
+
+	desiredLock.Lock()
+	desiredState = make(map[string]DesiredValue)
+	driftReported = make(map[string]string)
+	desiredLock.Unlock()
+
+	cooldownLock.Lock()
+	for _, p := range pendingWrites {
+		p.timer.Stop()
+	}
+	cooldownRules = nil
+	lastWrite = make(map[string]time.Time)
+	pendingWrites = make(map[string]pendingWrite)
+	writeGen = make(map[string]uint64)
+	cooldownLock.Unlock()
+
+	baselineMutex.Lock()
+	baseline = nil
+	baselineMutex.Unlock()
+
+	profilesLock.Lock()
+	profiles = nil
+	appliedProfile = nil
+	profilesLock.Unlock()
+
+	SetPolicy(Policy{})
+	SetACL(ACL{})
+	seenTokens = ccidentity.NewReplayCache()
+	SetStateFile("")
+	rateLimiter.SetRateLimit(0, 0)
+	cc_node_control_pretend = false
+	cc_node_control_verify.Store(false)
+}
+
+// newRequest creates a control request. Without value, it is a GET request.
+// tags are pairs of additional tag names and values.
+func newRequest(t *testing.T, control, deviceType, deviceId, value string, tags ...string) lp.CCMessage {
+	t.Helper()
+	m := map[string]string{
+		"hostname": "simnode",
+		"method":   "GET",
+		"type":     deviceType,
+		"type-id":  deviceId,
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		m[tags[i]] = tags[i+1]
+	}
+	var r lp.CCMessage
+	var err error
+	if len(value) > 0 {
+		m["method"] = "PUT"
+		r, err = lp.NewPutControl(control, m, nil, value, time.Now())
+	} else {
+		r, err = lp.NewGetControl(control, m, nil, time.Now())
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return r
+}
+
+// process processes a request like a single line of a NATS request and returns
+// level, error code and value of the reply
+func process(t *testing.T, request lp.CCMessage, ctx RequestContext) (level, code, value string) {
+	t.Helper()
+	requests, err := ExpandRequest(request)
+	if err != nil {
+		t.Fatalf("Failed to expand request: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Request expanded to %d requests", len(requests))
+	}
+	r := ProcessMessage(requests[0], ctx)
+	if r == nil {
+		t.Fatal("No reply")
+	}
+	level, _ = r.GetTag("level")
+	code, _ = r.GetTag("error")
+	value, _ = r.GetLogValue()
+	return level, code, value
+}
+
+func TestProcessPutGet(t *testing.T) {
+	setupSim(t)
+	ctx := RequestContext{}
+
+	tests := []struct {
+		name    string
+		request lp.CCMessage
+		level   string
+		code    string
+		value   string
+	}{
+		{"get", newRequest(t, "cpu_freq.max_cpu_freq", "hwthread", "7", ""), "INFO", "", "3600000"},
+		{"get namespaced", newRequest(t, "sysfeatures/rapl.pkg_limit_1", "socket", "1", ""), "INFO", "", "140000"},
+		{"put", newRequest(t, "rapl.pkg_limit_1", "socket", "0", "120000"), "INFO", "", ""},
+		{"get after put", newRequest(t, "rapl.pkg_limit_1", "socket", "0", ""), "INFO", "", "120000"},
+		{"unknown control", newRequest(t, "rapl.pkg_limit_9", "socket", "0", ""), "ERROR", errorNoSuchControl, ""},
+		{"unknown device", newRequest(t, "rapl.pkg_limit_1", "socket", "2", ""), "ERROR", errorNoSuchDevice, ""},
+		{"readonly", newRequest(t, "rapl.pkg_energy", "socket", "0", "0"), "ERROR", errorReadOnly, ""},
+		{"writeonly", newRequest(t, "prefetch.hwpf_reset", "node", "0", ""), "ERROR", errorWriteOnly, ""},
+		{"invalid lease", newRequest(t, "rapl.pkg_limit_1", "socket", "0", "110000", "lease", "soon"), "ERROR", errorInvalidRequest, ""},
+	}
+	for _, tc := range tests {
+		level, code, value := process(t, tc.request, ctx)
+		if level != tc.level || code != tc.code {
+			t.Errorf("%s: expected level %s and code '%s' but got %s and '%s': %s", tc.name, tc.level, tc.code, level, code, value)
+		}
+		if len(tc.value) > 0 && value != tc.value {
+			t.Errorf("%s: expected value '%s' but got '%s'", tc.name, tc.value, value)
+		}
+	}
+}
+
+func TestProcessPretend(t *testing.T) {
+	setupSim(t)
+	cc_node_control_pretend = true
+
+	level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", "120000"), RequestContext{})
+	if level != "INFO" {
+		t.Errorf("pretend PUT failed: %s", msg)
+	}
+	cc_node_control_pretend = false
+	if _, _, value := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", ""), RequestContext{}); value != "150000" {
+		t.Errorf("pretend PUT changed the value to '%s'", value)
+	}
+}
+
+func TestProcessVerify(t *testing.T) {
+	setupSim(t)
+
+	// The simulated max_cpu_freq is clamped to 800000..3600000
+	tests := []struct {
+		name      string
+		verifyAll bool
+		value     string
+		tags      []string
+		level     string
+		effective string
+	}{
+		{"no verify", false, "4000000", nil, "INFO", ""},
+		{"verify", false, "2000000", []string{"verify", "true"}, "INFO", "2000000"},
+		{"verify clamped", false, "4000000", []string{"verify", "true"}, "WARN", "3600000"},
+		{"verify all", true, "500000", nil, "WARN", "800000"},
+		{"verify all disabled", true, "500000", []string{"verify", "false"}, "INFO", ""},
+	}
+	for _, tc := range tests {
+		cc_node_control_verify.Store(tc.verifyAll)
+		r := ProcessMessage(newRequest(t, "cpu_freq.max_cpu_freq", "hwthread", "0", tc.value, tc.tags...), RequestContext{})
+		if r == nil {
+			t.Fatalf("%s: no reply", tc.name)
+		}
+		level, _ := r.GetTag("level")
+		effective, _ := r.GetTag("effective")
+		requested, hasRequested := r.GetTag("requested")
+		if level != tc.level || effective != tc.effective {
+			t.Errorf("%s: expected %s with effective value '%s' but got %s with '%s'", tc.name, tc.level, tc.effective, level, effective)
+		}
+		if len(tc.effective) > 0 && requested != tc.value || len(tc.effective) == 0 && hasRequested {
+			t.Errorf("%s: unexpected requested value '%s'", tc.name, requested)
+		}
+	}
+
+	cc_node_control_verify.Store(false)
+	level, _, value := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "hwthread", "1", "4000000", "verify", "true", "format", "json"), RequestContext{})
+	var result ControlResult
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		t.Fatalf("Failed to decode structured reply '%s': %v", value, err)
+	}
+	if level != "WARN" || result.Requested != "4000000" || result.Value != "3600000" {
+		t.Errorf("unexpected verified result %+v", result)
+	}
+}
+
+func TestProcessStructuredReply(t *testing.T) {
+	setupSim(t)
+
+	_, _, value := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "1", "", "format", "json"), RequestContext{})
+	var result ControlResult
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		t.Fatalf("Failed to decode structured reply '%s': %v", value, err)
+	}
+	if result.Control != "sysfeatures/rapl.pkg_limit_1" || result.DeviceId != "1" || result.Value != "140000" {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	_, _, value = process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "5", "", "format", "json"), RequestContext{})
+	result = ControlResult{}
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		t.Fatalf("Failed to decode structured reply '%s': %v", value, err)
+	}
+	if result.Error != errorNoSuchDevice || len(result.Message) == 0 {
+		t.Errorf("unexpected error result %+v", result)
+	}
+
+	// Cooldown errors carry the control like all other errors
+	rules, err := ParseCooldowns([]CooldownRule{{Control: "rapl.pkg_limit_1", Interval: "1h"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SetCooldowns(rules)
+	for i, expected := range []string{"", errorCooldown} {
+		_, _, value = process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", "120000", "format", "json"), RequestContext{})
+		result = ControlResult{}
+		if err := json.Unmarshal([]byte(value), &result); err != nil {
+			t.Fatalf("Failed to decode structured reply '%s': %v", value, err)
+		}
+		if result.Error != expected || result.Control != "sysfeatures/rapl.pkg_limit_1" || result.DeviceId != "0" {
+			t.Errorf("write %d: unexpected result %+v", i, result)
+		}
+	}
+}
+
+func TestExpandRequest(t *testing.T) {
+	setupSim(t)
+
+	tests := []struct {
+		deviceType string
+		deviceId   string
+		expected   int
+	}{
+		{"hwthread", "*", 8},
+		{"hwthread", "0-3,6", 5},
+		{"socket", "*", 2},
+		{"core", "1", 1},
+		{"node", "*", 1},
+	}
+	for _, tc := range tests {
+		requests, err := ExpandRequest(newRequest(t, "cpu_freq.max_cpu_freq", tc.deviceType, tc.deviceId, ""))
+		if err != nil {
+			t.Errorf("%s:%s: %v", tc.deviceType, tc.deviceId, err)
+			continue
+		}
+		if len(requests) != tc.expected {
+			t.Errorf("%s:%s: expected %d requests but got %d", tc.deviceType, tc.deviceId, tc.expected, len(requests))
+		}
+	}
+	if _, err := ExpandRequest(newRequest(t, "cpu_freq.max_cpu_freq", "hwthread", "6-9", "")); err == nil {
+		t.Errorf("device set with unknown hwthreads accepted")
+	}
+}
+
+func TestProcessFanOut(t *testing.T) {
+	setupSim(t)
+	ctx := RequestContext{}
+
+	if level, _, msg := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "socket", "1", "2000000"), ctx); level != "INFO" {
+		t.Fatalf("fan-out PUT failed: %s", msg)
+	}
+	for hwthread, expected := range []string{"3600000", "3600000", "3600000", "3600000", "2000000", "2000000", "2000000", "2000000"} {
+		_, _, value := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "hwthread", string(rune('0'+hwthread)), ""), ctx)
+		if value != expected {
+			t.Errorf("hwthread %d: expected '%s' but got '%s'", hwthread, expected, value)
+		}
+	}
+	if _, _, value := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "core", "2", ""), ctx); value != "2000000" {
+		t.Errorf("expected uniform value of core 2 but got '%s'", value)
+	}
+	if _, _, value := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "node", "0", ""), ctx); value != "min 2000000, max 3600000" {
+		t.Errorf("unexpected aggregate of node: '%s'", value)
+	}
+}
+
+func TestManagementReplies(t *testing.T) {
+	setupSim(t)
+	SetProfiles(map[string][]ProfileEntry{
+		"low":      {{Control: "rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "*", Value: "100000"}},
+		"readonly": {{Control: "rapl.pkg_energy", DeviceType: "socket", DeviceId: "0", Value: "0"}},
+		"unknown":  {{Control: "rapl.pkg_limit_9", DeviceType: "socket", DeviceId: "0", Value: "0"}},
+	})
+
+	tests := []struct {
+		name    string
+		request lp.CCMessage
+		level   string
+		code    string
+	}{
+		{"renew without lease", newRequest(t, "renew", "socket", "0", "0", "control", "rapl.pkg_limit_1", "lease", "1h"), "ERROR", errorNoSuchLease},
+		{"renew unknown control", newRequest(t, "renew", "socket", "0", "0", "control", "rapl.pkg_limit_9", "lease", "1h"), "ERROR", errorNoSuchControl},
+		{"renew invalid duration", newRequest(t, "renew", "socket", "0", "0", "control", "rapl.pkg_limit_1", "lease", "long"), "ERROR", errorInvalidRequest},
+		{"release without lease", newRequest(t, "release", "socket", "0", "0", "control", "rapl.pkg_limit_1"), "ERROR", errorNoSuchLease},
+		{"release without control", newRequest(t, "release", "socket", "0", "0"), "ERROR", errorInvalidRequest},
+		{"restore GET", newRequest(t, "restore", "node", "0", ""), "ERROR", errorInvalidRequest},
+		{"restore unknown control", newRequest(t, "restore", "node", "0", "0", "control", "rapl.pkg_limit_9"), "ERROR", errorNoSuchControl},
+		{"restore", newRequest(t, "restore", "node", "0", "0"), "INFO", ""},
+		{"profile", newRequest(t, "profile", "node", "0", "low"), "INFO", ""},
+		{"unknown profile", newRequest(t, "profile", "node", "0", "high"), "ERROR", errorNoSuchProfile},
+		{"profile with readonly control", newRequest(t, "profile", "node", "0", "readonly"), "ERROR", errorReadOnly},
+		{"profile with unknown control", newRequest(t, "profile", "node", "0", "unknown"), "ERROR", errorNoSuchControl},
+	}
+	for _, tc := range tests {
+		level, code, msg := process(t, tc.request, RequestContext{})
+		if level != tc.level || code != tc.code {
+			t.Errorf("%s: expected level %s and code '%s' but got %s and '%s': %s", tc.name, tc.level, tc.code, level, code, msg)
+		}
+	}
+
+	_, _, value := process(t, newRequest(t, "release", "socket", "1", "0", "control", "rapl.pkg_limit_1", "format", "json"), RequestContext{})
+	var result ControlResult
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		t.Fatalf("Failed to decode structured reply '%s': %v", value, err)
+	}
+	if result.Error != errorNoSuchLease || result.Control != "sysfeatures/rapl.pkg_limit_1" || result.DeviceId != "1" {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+)
+
+// Config is the configuration of cc-node-controller. The NATS options are
+// embedded to keep the configuration file flat.
+type Config struct {
+	NatsConfig
+	CpufreqPath  string `json:"cpufreqPath,omitempty"`  // Base path of the cpufreq interface, default /sys/devices/system/cpu
+	PowercapPath string `json:"powercapPath,omitempty"` // Base path of the powercap interface, default /sys/class/powercap
+	// Restore the baseline captured at startup when receiving SIGTERM
+	RestoreOnShutdown bool `json:"restoreOnShutdown,omitempty"`
+	// Read back the value after each PUT request
+	VerifyWrites bool `json:"verifyWrites,omitempty"`
+	// Named profiles, applied with a 'profile' message
+	Profiles map[string][]ProfileEntry `json:"profiles,omitempty"`
+	// Desired values, checked every ReconcileInterval (e.g. '60s', '0' to disable)
+	DesiredState      []DesiredStateEntry `json:"desiredState,omitempty"`
+	ReconcileInterval string              `json:"reconcileInterval,omitempty"`
+	// NATS subject to publish events like drift from the desired state
+	EventSubject string `json:"eventSubject,omitempty"`
+	// File to persist baseline, leases, desired values and the applied profile across restarts
+	StateFile string `json:"stateFile,omitempty"`
+	// Minimal intervals between writes to the same control and device
+	Cooldowns []CooldownRule `json:"cooldowns,omitempty"`
+	// Requests per second and burst size per requester, 0 for unlimited
+	RateLimit float64 `json:"rateLimit,omitempty"`
+	RateBurst int     `json:"rateBurst,omitempty"`
+	// Policy file with the allowed values of controls
+	PolicyFile string `json:"policyFile,omitempty"`
+	// ACL file with the permissions of identities
+	ACLFile string `json:"aclFile,omitempty"`
+	// Audit log of all control modifications as JSON lines
+	AuditFile       string `json:"auditFile,omitempty"`
+	AuditMaxSize    int64  `json:"auditMaxSize,omitempty"`    // Size in bytes at which the audit log is rotated, default 10 MiB
+	AuditMaxBackups int    `json:"auditMaxBackups,omitempty"` // Number of rotated audit logs to keep, default 5
+	AuditSubject    string `json:"auditSubject,omitempty"`    // NATS subject to publish audit entries
+}
+
+// KeepRestartOptions replaces the options that are only applied on startup, like
+// the paths of the providers, with those of the running configuration. It returns
+// the names of the options that differed.
+func (c *Config) KeepRestartOptions(running Config) []string {
+	changed := make([]string, 0)
+	if c.CpufreqPath != running.CpufreqPath {
+		changed = append(changed, "cpufreqPath")
+		c.CpufreqPath = running.CpufreqPath
+	}
+	if c.PowercapPath != running.PowercapPath {
+		changed = append(changed, "powercapPath")
+		c.PowercapPath = running.PowercapPath
+	}
+	return changed
+}
+
+func LoadConfiguration(filename string) (Config, error) {
+	config := Config{
+		NatsConfig: NatsConfig{
+			OutstandingMessages: 1000,
+			Workers:             4,
+		},
+		AuditMaxSize:      10 * 1024 * 1024,
+		AuditMaxBackups:   5,
+		ReconcileInterval: "60s",
+	}
+	configFile, err := os.Open(filename)
+	if err != nil {
+		cclog.Error(err.Error())
+		return config, err
+	}
+	defer configFile.Close()
+	jsonParser := json.NewDecoder(configFile)
+	err = jsonParser.Decode(&config)
+	return config, err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestKeepRestartOptions(t *testing.T) {
+	running := Config{CpufreqPath: "/sys/devices/system/cpu", PowercapPath: "/sys/class/powercap"}
+
+	tests := []struct {
+		name     string
+		config   Config
+		expected []string
+	}{
+		{"unchanged", Config{CpufreqPath: "/sys/devices/system/cpu", PowercapPath: "/sys/class/powercap", VerifyWrites: true}, []string{}},
+		{"cpufreq", Config{CpufreqPath: "/tmp/cpu", PowercapPath: "/sys/class/powercap", VerifyWrites: true}, []string{"cpufreqPath"}},
+		{"both", Config{VerifyWrites: true}, []string{"cpufreqPath", "powercapPath"}},
+	}
+	for _, tc := range tests {
+		changed := tc.config.KeepRestartOptions(running)
+		if !slices.Equal(changed, tc.expected) {
+			t.Errorf("%s: expected changed %v but got %v", tc.name, tc.expected, changed)
+		}
+		if tc.config.CpufreqPath != running.CpufreqPath || tc.config.PowercapPath != running.PowercapPath {
+			t.Errorf("%s: restart options not kept: %+v", tc.name, tc.config)
+		}
+		if !tc.config.VerifyWrites {
+			t.Errorf("%s: other options changed", tc.name)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+	"github.com/nats-io/nats.go"
+)
+
+// Modes of desired state entries
+const (
+	desiredModeReport  = "report"  // Drift is reported as event
+	desiredModeCorrect = "correct" // Drift is reported and corrected
+)
+
+const requesterReconcile = "reconcile"
+
+// DesiredStateEntry is the configuration of a desired value. DeviceId '*' applies
+// the value to all devices of the type.
+type DesiredStateEntry struct {
+	Control    string `json:"control"`
+	DeviceType string `json:"type"`
+	DeviceId   string `json:"type-id"`
+	Value      string `json:"value"`
+	Mode       string `json:"mode"` // report or correct, default report
+}
+
+// DesiredValue is the desired value of a control on a single device
+type DesiredValue struct {
+	Control    string `json:"control"` // Namespaced name <provider>/<category>.<name>
+	DeviceType string `json:"device_type"`
+	DeviceId   string `json:"device_id"`
+	Value      string `json:"value"`
+	Mode       string `json:"mode"`
+	// Set by a PUT request with tag 'enforce' instead of the configuration
+	Runtime bool `json:"runtime"`
+}
+
+var (
+	desiredLock  sync.Mutex
+	desiredState map[string]DesiredValue = make(map[string]DesiredValue)
+	// Last reported drift in mode 'report', to report each drift only once
+	driftReported map[string]string = make(map[string]string)
+
+	eventLock    sync.Mutex
+	eventConn    *nats.Conn
+	eventSubject string
+)
+
+func checkDesiredMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return desiredModeReport, nil
+	case desiredModeReport, desiredModeCorrect:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Invalid desired state mode '%s', use '%s' or '%s'", mode, desiredModeReport, desiredModeCorrect)
+}
+
+// ExpandDesiredState resolves the controls of the configured desired state and
+// expands '*' to all devices
+func ExpandDesiredState(entries []DesiredStateEntry) (map[string]DesiredValue, error) {
+	out := make(map[string]DesiredValue)
+	for _, e := range entries {
+		_, entry, err := ccprovider.Lookup(e.Control)
+		if err != nil {
+			return nil, fmt.Errorf("Desired state: %w", err)
+		}
+		if entry.ReadOnly || entry.WriteOnly {
+			return nil, fmt.Errorf("Desired state: '%s' must be readable and writable", e.Control)
+		}
+		mode, err := checkDesiredMode(e.Mode)
+		if err != nil {
+			return nil, fmt.Errorf("Desired state for '%s': %w", e.Control, err)
+		}
+		if len(e.DeviceType) == 0 || (e.DeviceType != "node" && len(e.DeviceId) == 0) {
+			return nil, fmt.Errorf("Desired state: '%s' requires type and type-id", e.Control)
+		}
+		ids, err := expandDeviceIds(e.DeviceType, e.DeviceId)
+		if err != nil {
+			return nil, fmt.Errorf("Desired state for '%s': %w", e.Control, err)
+		}
+		for _, id := range ids {
+			out[ControlKey(entry.FullName(), e.DeviceType, id)] = DesiredValue{
+				Control:    entry.FullName(),
+				DeviceType: e.DeviceType,
+				DeviceId:   id,
+				Value:      e.Value,
+				Mode:       mode,
+			}
+		}
+	}
+	return out, nil
+}
+
+// SetDesiredState replaces the configured desired state. Desired values set by
+// requests are kept unless the configuration contains the same control and device.
+func SetDesiredState(state map[string]DesiredValue) {
+	desiredLock.Lock()
+	defer desiredLock.Unlock()
+	for key, d := range desiredState {
+		if _, ok := state[key]; !ok && d.Runtime {
+			state[key] = d
+		}
+	}
+	desiredState = state
+}
+
+// AddDesiredValue sets the desired value of a control on a device at runtime
+func AddDesiredValue(key string, d DesiredValue) {
+	desiredLock.Lock()
+	defer desiredLock.Unlock()
+	d.Runtime = true
+	desiredState[key] = d
+	StateChanged()
+}
+
+// DropDesiredValue removes a desired value set at runtime. Configured desired
+// values are kept.
+func DropDesiredValue(key string) {
+	desiredLock.Lock()
+	defer desiredLock.Unlock()
+	if d, ok := desiredState[key]; ok && d.Runtime {
+		delete(desiredState, key)
+		StateChanged()
+	}
+}
+
+// SetEventNats sets the NATS connection and subject to publish events. An empty
+// subject disables publishing.
+func SetEventNats(conn *nats.Conn, subject string) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	eventConn = conn
+	eventSubject = subject
+}
+
+// publishEvent sends an event on the event subject
+func publishEvent(ev lp.CCMessage) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if eventConn == nil || len(eventSubject) == 0 {
+		return
+	}
+	ev.AddTag("hostname", cc_node_control_hostname)
+	if err := eventConn.Publish(eventSubject, []byte(ev.ToLineProtocol(nil))); err != nil {
+		cclog.ComponentError("Reconcile", "Failed to publish event:", err.Error())
+	}
+}
+
+// Reconcile checks all desired values. The checks are queued in the worker pool,
+// so they are ordered with requests for the same control and device.
+func Reconcile() {
+	desiredLock.Lock()
+	keys := make([]string, 0, len(desiredState))
+	for key := range desiredState {
+		keys = append(keys, key)
+	}
+	desiredLock.Unlock()
+
+	cclog.ComponentDebug("Reconcile", "Checking", len(keys), "desired values")
+	for _, key := range keys {
+		SubmitBackground(key, func() { reconcileValue(key) })
+	}
+}
+
+// reconcileValue compares the current value of a control on a device with the
+// desired value. Drift is reported as event and corrected in mode 'correct'. In
+// mode 'report', the same drift is only reported once. Controls with an active
+// lease are skipped. It returns whether drift was reported.
+func reconcileValue(key string) bool {
+	desiredLock.Lock()
+	d, ok := desiredState[key]
+	desiredLock.Unlock()
+	if !ok || HasLease(key) {
+		return false
+	}
+
+	provider, entry, err := ccprovider.Lookup(d.Control)
+	if err != nil {
+		cclog.ComponentError("Reconcile", err.Error())
+		return false
+	}
+	current, err := provider.Get(entry.Control(), d.DeviceType, d.DeviceId)
+	if err != nil {
+		cclog.ComponentError("Reconcile", "Failed to get", d.Control, "for device", d.DeviceType, d.DeviceId, ":", err.Error())
+		return false
+	}
+	desiredLock.Lock()
+	if strings.TrimSpace(current) == strings.TrimSpace(d.Value) {
+		delete(driftReported, key)
+		desiredLock.Unlock()
+		return false
+	}
+	if d.Mode == desiredModeReport {
+		if reported, ok := driftReported[key]; ok && reported == current {
+			desiredLock.Unlock()
+			return false
+		}
+		driftReported[key] = current
+	}
+	desiredLock.Unlock()
+
+	result := "reported"
+	level := "WARN"
+	if d.Mode == desiredModeCorrect {
+		if cc_node_control_pretend {
+			result = "not corrected (pretend)"
+		} else {
+			err = provider.Set(entry.Control(), d.DeviceType, d.DeviceId, d.Value)
+			Audit(AuditEntry{
+				Requester:  requesterReconcile,
+				Control:    d.Control,
+				DeviceType: d.DeviceType,
+				DeviceId:   d.DeviceId,
+				OldValue:   current,
+				NewValue:   d.Value,
+			}, err)
+			if err != nil {
+				result = fmt.Sprintf("correction failed: %v", err)
+				level = "ERROR"
+			} else {
+				// Corrections are not subject to cooldowns, but later requests are
+				RecordWrite(key, entry, d.DeviceType)
+				result = "corrected"
+			}
+		}
+	}
+	msg := fmt.Sprintf("Drift of '%s' on device '%s:%s': desired '%s', actual '%s', %s", entry.Control(), d.DeviceType, d.DeviceId, d.Value, current, result)
+	cclog.ComponentWarn("Reconcile", msg)
+
+	ev, err := lp.NewEvent("drift", map[string]string{
+		"control": d.Control,
+		"type":    d.DeviceType,
+		"type-id": d.DeviceId,
+		"mode":    d.Mode,
+		"level":   level,
+	}, nil, msg, time.Now())
+	if err != nil {
+		cclog.ComponentError("Reconcile", "Unable to create event:", err.Error())
+		return true
+	}
+	publishEvent(ev)
+	return true
+}
+
+// Reconciler runs Reconcile periodically
+type Reconciler struct {
+	interval chan time.Duration
+	done     chan struct{}
+}
+
+// StartReconciler starts checking the desired state every interval. The first
+// check is done immediately. An interval of 0 disables the periodic checks.
+func StartReconciler(interval time.Duration) *Reconciler {
+	r := &Reconciler{
+		interval: make(chan time.Duration),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(time.Hour)
+		ticker.Stop()
+		defer ticker.Stop()
+		for {
+			if interval > 0 {
+				Reconcile()
+				ticker.Reset(interval)
+			}
+			select {
+			case <-ticker.C:
+			case i, ok := <-r.interval:
+				if !ok {
+					return
+				}
+				ticker.Stop()
+				interval = i
+			}
+		}
+	}()
+	return r
+}
+
+// SetInterval changes the interval and checks the desired state immediately
+func (r *Reconciler) SetInterval(interval time.Duration) {
+	r.interval <- interval
+}
+
+// Stop stops the periodic checks
+func (r *Reconciler) Stop() {
+	close(r.interval)
+	<-r.done
+}
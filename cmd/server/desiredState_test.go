@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setDesired configures the desired value of rapl.pkg_limit_1 on socket 0
+func setDesired(t *testing.T, value, mode string) string {
+	t.Helper()
+	state, err := ExpandDesiredState([]DesiredStateEntry{{Control: "rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "0", Value: value, Mode: mode}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SetDesiredState(state)
+	return ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "0")
+}
+
+// setPkgLimit writes rapl.pkg_limit_1 on socket 0
+func setPkgLimit(t *testing.T, value string) {
+	t.Helper()
+	if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", value), RequestContext{}); level != "INFO" {
+		t.Fatalf("Failed to set rapl.pkg_limit_1 to %s: %s", value, msg)
+	}
+}
+
+// pkgLimit returns rapl.pkg_limit_1 on socket 0
+func pkgLimit(t *testing.T) string {
+	t.Helper()
+	_, _, value := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", ""), RequestContext{})
+	return value
+}
+
+func TestReconcileReport(t *testing.T) {
+	setupSim(t)
+	key := setDesired(t, "120000", desiredModeReport)
+
+	// Each drift is reported once, until the value changes
+	tests := []struct {
+		name     string
+		value    string
+		reported bool
+	}{
+		{"drift", "", true},
+		{"same drift", "", false},
+		{"other drift", "130000", true},
+		{"same other drift", "", false},
+		{"no drift", "120000", false},
+		{"drift again", "130000", true},
+	}
+	for _, tc := range tests {
+		if len(tc.value) > 0 {
+			setPkgLimit(t, tc.value)
+		}
+		if reported := reconcileValue(key); reported != tc.reported {
+			t.Errorf("%s: expected reported %v but got %v", tc.name, tc.reported, reported)
+		}
+	}
+	if value := pkgLimit(t); value != "130000" {
+		t.Errorf("drift corrected in mode report: %s", value)
+	}
+}
+
+func TestReconcileCorrect(t *testing.T) {
+	setupSim(t)
+	key := setDesired(t, "120000", desiredModeCorrect)
+
+	cc_node_control_pretend = true
+	if !reconcileValue(key) {
+		t.Errorf("drift not reported in pretend mode")
+	}
+	if value := pkgLimit(t); value != "150000" {
+		t.Errorf("drift corrected in pretend mode: %s", value)
+	}
+	cc_node_control_pretend = false
+
+	// Corrections are reported each time
+	for i := 0; i < 2; i++ {
+		if !reconcileValue(key) {
+			t.Errorf("drift %d not reported", i)
+		}
+		if value := pkgLimit(t); value != "120000" {
+			t.Errorf("drift %d not corrected: %s", i, value)
+		}
+		setPkgLimit(t, "150000")
+	}
+}
+
+func TestReconcileLeased(t *testing.T) {
+	setupSim(t)
+	key := setDesired(t, "120000", desiredModeCorrect)
+
+	if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", "130000", "lease", "1h"), RequestContext{}); level != "INFO" {
+		t.Fatalf("Failed to lease rapl.pkg_limit_1: %s", msg)
+	}
+	if reconcileValue(key) {
+		t.Errorf("drift of leased control reported")
+	}
+	if value := pkgLimit(t); value != "130000" {
+		t.Errorf("leased value corrected: %s", value)
+	}
+
+	if level, _, msg := process(t, newRequest(t, "release", "socket", "0", "0", "control", "rapl.pkg_limit_1"), RequestContext{}); level != "INFO" {
+		t.Fatalf("Failed to release lease: %s", msg)
+	}
+	if !reconcileValue(key) {
+		t.Errorf("drift not reported after release")
+	}
+	if value := pkgLimit(t); value != "120000" {
+		t.Errorf("drift not corrected after release: %s", value)
+	}
+}
+
+func TestReconcilerSetInterval(t *testing.T) {
+	setupSim(t)
+	setDesired(t, "120000", desiredModeCorrect)
+
+	// Stop waits for a running check
+	r := StartReconciler(0)
+	r.Stop()
+	if value := pkgLimit(t); value != "150000" {
+		t.Errorf("checked with interval 0: %s", value)
+	}
+
+	r = StartReconciler(0)
+	r.SetInterval(time.Hour)
+	r.Stop()
+	if value := pkgLimit(t); value != "120000" {
+		t.Errorf("not checked after SetInterval: %s", value)
+	}
+
+	setPkgLimit(t, "150000")
+	r = StartReconciler(time.Hour)
+	r.SetInterval(0)
+	r.Stop()
+	if value := pkgLimit(t); value != "120000" {
+		t.Errorf("not checked on start: %s", value)
+	}
+	setPkgLimit(t, "150000")
+	r = StartReconciler(0)
+	r.SetInterval(0)
+	r.Stop()
+	if value := pkgLimit(t); value != "150000" {
+		t.Errorf("checked after SetInterval(0): %s", value)
+	}
+}
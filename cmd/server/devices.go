@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	topo "github.com/ClusterCockpit/cc-node-controller/pkg/ccTopology"
+)
+
+// errNoSuchDevice is returned if a device set contains a device that is not part
+// of the local topology
+var errNoSuchDevice = errors.New("no such device")
+
+// deviceTypeIds returns the IDs of all devices of a LIKWID device type using the
+// local topology. LIKWID calls NUMA domains 'numa', ccTopology 'memoryDomain'.
+func deviceTypeIds(deviceType string) []int {
+	switch deviceType {
+	case "numa":
+		return topo.GetTypeList("memoryDomain")
+	default:
+		return topo.GetTypeList(deviceType)
+	}
+}
+
+// deviceExists checks whether a device is part of the local topology
+func deviceExists(deviceType, deviceId string) bool {
+	if deviceType == "node" && len(deviceId) == 0 {
+		return true
+	}
+	id, err := strconv.Atoi(deviceId)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(deviceTypeIds(deviceType), id)
+}
+
+// isDeviceSet checks whether a type-id selects several devices: '*' for all
+// devices of the type or a list like '0-15,32-47'
+func isDeviceSet(deviceId string) bool {
+	return deviceId == "*" || strings.ContainsAny(deviceId, ",-")
+}
+
+// expandDeviceIds returns the IDs of the devices selected by a type-id. Device
+// sets are expanded against the local topology, single IDs are returned as they
+// are. For device type 'node', the ID is always empty.
+func expandDeviceIds(deviceType, deviceId string) ([]string, error) {
+	if deviceType == "node" {
+		return []string{""}, nil
+	}
+	if !isDeviceSet(deviceId) {
+		return []string{deviceId}, nil
+	}
+
+	all := deviceTypeIds(deviceType)
+	ids := all
+	if deviceId != "*" {
+		list, err := topo.ParseList(deviceId)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid type-id '%s': %w", deviceId, err)
+		}
+		slices.Sort(list)
+		ids = slices.Compact(list)
+		for _, id := range ids {
+			if !slices.Contains(all, id) {
+				return nil, fmt.Errorf("Device '%s:%d' of type-id '%s': %w", deviceType, id, deviceId, errNoSuchDevice)
+			}
+		}
+	}
+
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, strconv.Itoa(id))
+	}
+	return out, nil
+}
+
+// errAmbiguousCore is returned for a core ID that exists on several sockets
+var errAmbiguousCore = errors.New("core ID exists on several sockets")
+
+// deviceHwthreads returns the hardware threads of a device of a coarser device
+// type than 'hwthread'. ok is false for device types that do not contain hardware
+// threads. Core IDs are local to their socket, so a core ID that exists on several
+// sockets does not select a single core and returns errAmbiguousCore.
+func deviceHwthreads(deviceType, deviceId string) (hwthreads []int, ok bool, err error) {
+	if deviceType == "node" {
+		return topo.HwthreadList(), true, nil
+	}
+	var lookup func(int) []int
+	switch deviceType {
+	case "socket":
+		lookup = topo.GetSocketHwthreads
+	case "numa", "memoryDomain":
+		lookup = topo.GetNumaDomainHwthreads
+	case "die":
+		lookup = topo.GetDieHwthreads
+	case "core":
+		lookup = topo.GetCoreHwthreads
+	default:
+		return nil, false, nil
+	}
+	if !deviceExists(deviceType, deviceId) {
+		return []int{}, true, nil
+	}
+	id, _ := strconv.Atoi(deviceId)
+	hwthreads = lookup(id)
+	if deviceType == "core" {
+		sockets := make([]int, 0, len(hwthreads))
+		for _, h := range hwthreads {
+			sockets = append(sockets, topo.GetHwthreadSocket(h))
+		}
+		slices.Sort(sockets)
+		if len(slices.Compact(sockets)) > 1 {
+			return nil, true, fmt.Errorf("Device 'core:%s': %w", deviceId, errAmbiguousCore)
+		}
+	}
+	return hwthreads, true, nil
+}
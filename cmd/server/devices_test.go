@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIsDeviceSet(t *testing.T) {
+	tests := []struct {
+		deviceId string
+		set      bool
+	}{
+		{"0", false},
+		{"15", false},
+		{"", false},
+		{"*", true},
+		{"0-3", true},
+		{"0,2", true},
+		{"0-1,4-5", true},
+	}
+	for _, tc := range tests {
+		if set := isDeviceSet(tc.deviceId); set != tc.set {
+			t.Errorf("'%s': expected %v but got %v", tc.deviceId, tc.set, set)
+		}
+	}
+}
+
+func TestExpandDeviceIds(t *testing.T) {
+	setupSim(t)
+
+	tests := []struct {
+		deviceType string
+		deviceId   string
+		expected   []string
+		err        bool
+	}{
+		{"hwthread", "3", []string{"3"}, false},
+		{"hwthread", "42", []string{"42"}, false},
+		{"hwthread", "*", []string{"0", "1", "2", "3", "4", "5", "6", "7"}, false},
+		{"hwthread", "1-3,6", []string{"1", "2", "3", "6"}, false},
+		{"hwthread", "5,1-2,2", []string{"1", "2", "5"}, false},
+		{"core", "*", []string{"0", "1", "2", "3"}, false},
+		{"socket", "0-1", []string{"0", "1"}, false},
+		{"node", "*", []string{""}, false},
+		{"node", "0", []string{""}, false},
+		{"socket", "0-2", nil, true},
+		{"hwthread", "3-x", nil, true},
+	}
+	for _, tc := range tests {
+		ids, err := expandDeviceIds(tc.deviceType, tc.deviceId)
+		if (err != nil) != tc.err {
+			t.Errorf("%s '%s': expected error %v but got %v", tc.deviceType, tc.deviceId, tc.err, err)
+			continue
+		}
+		if !slices.Equal(ids, tc.expected) {
+			t.Errorf("%s '%s': expected %v but got %v", tc.deviceType, tc.deviceId, tc.expected, ids)
+		}
+	}
+
+	if _, err := expandDeviceIds("socket", "1-2"); !errors.Is(err, errNoSuchDevice) {
+		t.Errorf("expected errNoSuchDevice for unknown socket but got %v", err)
+	}
+}
+
+func TestDeviceHwthreads(t *testing.T) {
+	setupSim(t)
+
+	tests := []struct {
+		deviceType string
+		deviceId   string
+		hwthreads  []int
+		ok         bool
+	}{
+		{"node", "", []int{0, 1, 2, 3, 4, 5, 6, 7}, true},
+		{"socket", "1", []int{4, 5, 6, 7}, true},
+		{"core", "1", []int{2, 3}, true},
+		{"die", "0", []int{0, 1, 2, 3}, true},
+		{"numa", "1", []int{4, 5, 6, 7}, true},
+		{"socket", "2", []int{}, true},
+		{"core", "x", []int{}, true},
+		{"hwthread", "1", nil, false},
+		{"gpu", "0", nil, false},
+	}
+	for _, tc := range tests {
+		hwthreads, ok, err := deviceHwthreads(tc.deviceType, tc.deviceId)
+		if err != nil {
+			t.Errorf("%s '%s': %v", tc.deviceType, tc.deviceId, err)
+			continue
+		}
+		if ok != tc.ok {
+			t.Errorf("%s '%s': expected ok %v but got %v", tc.deviceType, tc.deviceId, tc.ok, ok)
+			continue
+		}
+		slices.Sort(hwthreads)
+		if !slices.Equal(hwthreads, tc.hwthreads) {
+			t.Errorf("%s '%s': expected %v but got %v", tc.deviceType, tc.deviceId, tc.hwthreads, hwthreads)
+		}
+	}
+}
+
+// Two sockets with socket local core IDs like sysfs reports them
+const repeatedCoresSim = `{
+    "topology": [
+        {"cpu_id": 0, "core_id": 0, "socket_id": 0, "die_id": 0, "numa_id": 0},
+        {"cpu_id": 1, "core_id": 1, "socket_id": 0, "die_id": 0, "numa_id": 0},
+        {"cpu_id": 2, "core_id": 0, "socket_id": 1, "die_id": 1, "numa_id": 1},
+        {"cpu_id": 3, "core_id": 1, "socket_id": 1, "die_id": 1, "numa_id": 1},
+        {"cpu_id": 4, "core_id": 2, "socket_id": 1, "die_id": 1, "numa_id": 1}
+    ],
+    "features": [
+        {"category": "cpu_freq", "name": "max_cpu_freq", "type": "hwthread", "value": "3600000"}
+    ]
+}`
+
+func TestRepeatedCoreIds(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sim.json")
+	if err := os.WriteFile(filename, []byte(repeatedCoresSim), 0o600); err != nil {
+		t.Fatal(err.Error())
+	}
+	setupSimFile(t, filename)
+
+	tests := []struct {
+		deviceId  string
+		hwthreads []int
+		ambiguous bool
+	}{
+		{"0", nil, true},
+		{"1", nil, true},
+		{"2", []int{4}, false},
+		{"3", []int{}, false},
+	}
+	for _, tc := range tests {
+		hwthreads, _, err := deviceHwthreads("core", tc.deviceId)
+		if errors.Is(err, errAmbiguousCore) != tc.ambiguous {
+			t.Errorf("core %s: expected ambiguous %v but got error %v", tc.deviceId, tc.ambiguous, err)
+		}
+		if !slices.Equal(hwthreads, tc.hwthreads) {
+			t.Errorf("core %s: expected %v but got %v", tc.deviceId, tc.hwthreads, hwthreads)
+		}
+	}
+
+	level, code, msg := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "core", "0", "2000000"), RequestContext{})
+	if level != "ERROR" || code != errorInvalidRequest {
+		t.Errorf("expected %s for ambiguous core but got %s '%s': %s", errorInvalidRequest, level, code, msg)
+	}
+	for _, hwthread := range []string{"0", "2"} {
+		if _, _, value := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "hwthread", hwthread, ""), RequestContext{}); value != "3600000" {
+			t.Errorf("hwthread %s changed by request for ambiguous core: %s", hwthread, value)
+		}
+	}
+}
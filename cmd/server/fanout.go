@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+)
+
+// FanOutRequest splits a request for a control of device type 'hwthread' on a
+// device of a coarser device type (e.g. 'socket') into one request per hardware
+// thread of the device. Each of the requests is processed like a request of its
+// own, so ACL, policy, cooldowns, leases and the audit log apply per hardware
+// thread. gather combines their replies, in the order of the requests, to the
+// reply of the original request: GET requests get an aggregate of the values,
+// PUT requests a summary of the writes. A PUT request with lease creates a lease
+// per hardware thread, so 'renew' and 'release' requests are fanned out the same
+// way. ok is false if the request is not fanned out.
+func FanOutRequest(request lp.CCMessage) (requests []lp.CCMessage, gather func([]lp.CCMessage) lp.CCMessage, ok bool) {
+	if !request.IsControl() {
+		return nil, nil, false
+	}
+	deviceType, _ := request.GetTag("type")
+	deviceId, _ := request.GetTag("type-id")
+	if deviceType == "hwthread" {
+		return nil, nil, false
+	}
+	name := request.Name()
+	switch name {
+	case "renew", "release":
+		name, _ = request.GetTag("control")
+	}
+	_, entry, err := ccprovider.Lookup(name)
+	if err != nil || entry.DeviceType != "hwthread" {
+		return nil, nil, false
+	}
+	hwthreads, ok, err := deviceHwthreads(deviceType, deviceId)
+	if !ok {
+		return nil, nil, false
+	}
+	if err != nil {
+		gather = func([]lp.CCMessage) lp.CCMessage {
+			result := newControlResult(request)
+			result.Control = entry.FullName()
+			result.Unit = entry.Unit
+			result.Error = errorInvalidRequest
+			r, err := makeControlReply(request, "ERROR", result, fmt.Sprintf("Cannot apply '%s' to device '%s:%s': %v", entry.Control(), deviceType, deviceId, err))
+			if err != nil {
+				cclog.Error(err.Error())
+			}
+			return r
+		}
+		return []lp.CCMessage{}, gather, true
+	}
+
+	requests = make([]lp.CCMessage, 0, len(hwthreads))
+	for _, hwthread := range hwthreads {
+		sub := lp.FromMessage(request)
+		sub.AddTag("type", "hwthread")
+		sub.AddTag("type-id", strconv.Itoa(hwthread))
+		sub.RemoveTag("format")
+		requests = append(requests, sub)
+	}
+	gather = func(replies []lp.CCMessage) lp.CCMessage {
+		r, err := gatherFanOut(request, entry, replies)
+		if err != nil {
+			cclog.Error(err.Error())
+		}
+		return r
+	}
+	return requests, gather, true
+}
+
+// gatherFanOut creates the reply of a fanned out request from the replies of the
+// requests for the single hardware threads
+func gatherFanOut(request lp.CCMessage, entry ccprovider.ControlEntry, replies []lp.CCMessage) (lp.CCMessage, error) {
+	deviceType, _ := request.GetTag("type")
+	deviceId, _ := request.GetTag("type-id")
+	method, _ := request.GetControlMethod()
+	knob := entry.Control()
+
+	result := newControlResult(request)
+	result.Control = entry.FullName()
+	result.Unit = entry.Unit
+	result.Devices = len(replies)
+	makeReply := func(level, fmtStr string, args ...any) (lp.CCMessage, error) {
+		return makeControlReply(request, level, result, fmt.Sprintf(fmtStr, args...))
+	}
+
+	if len(replies) == 0 {
+		result.Error = errorNoSuchDevice
+		return makeReply("ERROR", "Cannot apply '%s' to device '%s:%s': no hwthreads in the local topology", knob, deviceType, deviceId)
+	}
+
+	values := make([]string, 0, len(replies))
+	var failed, warned, deferred int
+	var firstError, firstWarning lp.CCMessage
+	var deferredUntil string
+	for _, r := range replies {
+		if r == nil {
+			// The job was dropped, e.g. on shutdown
+			failed++
+			continue
+		}
+		switch level, _ := r.GetTag("level"); level {
+		case "ERROR":
+			failed++
+			if firstError == nil {
+				firstError = r
+			}
+		case "WARN":
+			warned++
+			if firstWarning == nil {
+				firstWarning = r
+			}
+		}
+		if until, ok := r.GetTag("deferred"); ok {
+			deferred++
+			deferredUntil = max(deferredUntil, until)
+		}
+		value, _ := r.GetLogValue()
+		values = append(values, strings.TrimSpace(value))
+	}
+
+	verb := "set"
+	if method == "GET" {
+		verb = "get"
+	}
+	lease := request.Name() == "renew" || request.Name() == "release"
+	if lease {
+		verb = request.Name() + " lease for"
+	}
+	if failed > 0 {
+		msg := "request dropped"
+		result.Error = errorBackendFailure
+		if firstError != nil {
+			result.Error, _ = firstError.GetTag("error")
+			msg, _ = firstError.GetLogValue()
+		}
+		return makeReply("ERROR", "Failed to %s '%s' on %d of %d hwthreads of device '%s:%s': %s", verb, knob, failed, len(replies), deviceType, deviceId, msg)
+	}
+
+	if lease {
+		if cc_node_control_pretend {
+			return makeReply("INFO", "Pretend: would %s '%s' on %d hwthreads of device '%s:%s'", verb, knob, len(replies), deviceType, deviceId)
+		}
+		done := "Renewed"
+		if request.Name() == "release" {
+			done = "Released"
+		}
+		return makeReply("INFO", "%s lease for '%s' on %d hwthreads of device '%s:%s'", done, knob, len(replies), deviceType, deviceId)
+	}
+
+	if method != "GET" {
+		value, _ := request.GetControlValue()
+		result.Value = value
+		if warned > 0 {
+			msg, _ := firstWarning.GetLogValue()
+			return makeReply("WARN", "Set '%s' on %d hwthreads of device '%s:%s', %d with warnings: %s", knob, len(replies), deviceType, deviceId, warned, msg)
+		}
+		if cc_node_control_pretend {
+			return makeReply("INFO", "Pretend: would set '%s' on %d hwthreads of device '%s:%s' to '%s'", knob, len(replies), deviceType, deviceId, value)
+		}
+		if deferred > 0 {
+			result.Deferred = deferredUntil
+			resp, err := makeReply("INFO", "Set '%s' on %d of %d hwthreads of device '%s:%s', %d deferred until end of cooldown at %s", knob, len(replies)-deferred, len(replies), deviceType, deviceId, deferred, deferredUntil)
+			if err != nil {
+				return nil, err
+			}
+			resp.AddTag("deferred", deferredUntil)
+			return resp, nil
+		}
+		return makeReply("INFO", "Set '%s' on %d hwthreads of device '%s:%s': SUCCESS!", knob, len(replies), deviceType, deviceId)
+	}
+
+	uniform, minValue, maxValue := aggregateValues(values)
+	result.Uniform = &uniform
+	result.Min = minValue
+	result.Max = maxValue
+	var msg string
+	if uniform {
+		result.Value = values[0]
+		msg = values[0]
+	} else if len(minValue) > 0 {
+		msg = fmt.Sprintf("min %s, max %s", minValue, maxValue)
+	} else {
+		distinct := slices.Compact(slices.Sorted(slices.Values(values)))
+		msg = strings.Join(distinct, ", ")
+	}
+	resp, err := makeReply("INFO", "%s", msg)
+	if err != nil {
+		return nil, err
+	}
+	resp.AddTag("uniform", strconv.FormatBool(uniform))
+	if len(minValue) > 0 {
+		resp.AddTag("min", minValue)
+		resp.AddTag("max", maxValue)
+	}
+	return resp, nil
+}
+
+// aggregateValues returns whether all values are equal and, if all values are
+// numeric, the minimal and maximal value
+func aggregateValues(values []string) (uniform bool, minValue, maxValue string) {
+	uniform = true
+	numeric := true
+	var lo, hi float64
+	for i, v := range values {
+		if v != values[0] {
+			uniform = false
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			numeric = false
+			continue
+		}
+		if i == 0 || f < lo {
+			lo, minValue = f, v
+		}
+		if i == 0 || f > hi {
+			hi, maxValue = f, v
+		}
+	}
+	if !numeric {
+		return uniform, "", ""
+	}
+	return uniform, minValue, maxValue
+}
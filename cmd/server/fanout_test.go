@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAggregateValues(t *testing.T) {
+	tests := []struct {
+		values  []string
+		uniform bool
+		min     string
+		max     string
+	}{
+		{[]string{"2000000"}, true, "2000000", "2000000"},
+		{[]string{"2000000", "2000000"}, true, "2000000", "2000000"},
+		{[]string{"2000000", "3600000", "800000"}, false, "800000", "3600000"},
+		{[]string{"1.5", "-2", "10"}, false, "-2", "10"},
+		{[]string{"performance", "performance"}, true, "", ""},
+		{[]string{"performance", "powersave"}, false, "", ""},
+		{[]string{"100", "powersave"}, false, "", ""},
+	}
+	for _, tc := range tests {
+		uniform, minValue, maxValue := aggregateValues(tc.values)
+		if uniform != tc.uniform || minValue != tc.min || maxValue != tc.max {
+			t.Errorf("%v: expected (%v, '%s', '%s') but got (%v, '%s', '%s')", tc.values, tc.uniform, tc.min, tc.max, uniform, minValue, maxValue)
+		}
+	}
+}
+
+func TestFanOutRequest(t *testing.T) {
+	setupSim(t)
+
+	tests := []struct {
+		name       string
+		control    string
+		deviceType string
+		deviceId   string
+		fanOut     bool
+		hwthreads  []string
+	}{
+		{"socket", "cpu_freq.max_cpu_freq", "socket", "1", true, []string{"4", "5", "6", "7"}},
+		{"core", "cpu_freq.governor", "core", "1", true, []string{"2", "3"}},
+		{"node", "cpu_freq.max_cpu_freq", "node", "0", true, []string{"0", "1", "2", "3", "4", "5", "6", "7"}},
+		{"unknown socket", "cpu_freq.max_cpu_freq", "socket", "2", true, []string{}},
+		{"hwthread", "cpu_freq.max_cpu_freq", "hwthread", "1", false, nil},
+		{"socket control", "rapl.pkg_limit_1", "socket", "0", false, nil},
+		{"unknown control", "cpu_freq.nothing", "socket", "0", false, nil},
+	}
+	for _, tc := range tests {
+		requests, _, ok := FanOutRequest(newRequest(t, tc.control, tc.deviceType, tc.deviceId, "", "format", "json"))
+		if ok != tc.fanOut {
+			t.Errorf("%s: expected fan-out %v but got %v", tc.name, tc.fanOut, ok)
+			continue
+		}
+		if len(requests) != len(tc.hwthreads) {
+			t.Errorf("%s: expected %d requests but got %d", tc.name, len(tc.hwthreads), len(requests))
+			continue
+		}
+		for i, r := range requests {
+			deviceType, _ := r.GetTag("type")
+			deviceId, _ := r.GetTag("type-id")
+			if deviceType != "hwthread" || deviceId != tc.hwthreads[i] {
+				t.Errorf("%s: expected hwthread %s but got %s %s", tc.name, tc.hwthreads[i], deviceType, deviceId)
+			}
+			if _, ok := r.GetTag("format"); ok {
+				t.Errorf("%s: format not removed from request for hwthread %s", tc.name, deviceId)
+			}
+		}
+	}
+
+	level, code, _ := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "socket", "2", ""), RequestContext{})
+	if level != "ERROR" || code != errorNoSuchDevice {
+		t.Errorf("expected %s for unknown socket but got %s '%s'", errorNoSuchDevice, level, code)
+	}
+}
+
+func TestFanOutACL(t *testing.T) {
+	setupSim(t)
+	request := newRequest(t, "cpu_freq.max_cpu_freq", "socket", "0", "2000000")
+
+	tests := []struct {
+		name       string
+		deviceType string
+		level      string
+		code       string
+	}{
+		{"hwthread rule", "hwthread", "INFO", ""},
+		{"socket rule", "socket", "ERROR", errorPermission},
+	}
+	for _, tc := range tests {
+		SetACL(ACL{
+			Rules:   []ACLRule{{Identity: "*", Control: "cpu_freq.*", DeviceType: tc.deviceType, Methods: []string{"PUT"}}},
+			enabled: true,
+		})
+		level, code, msg := process(t, request, RequestContext{})
+		if level != tc.level || code != tc.code {
+			t.Errorf("%s: expected %s '%s' but got %s '%s': %s", tc.name, tc.level, tc.code, level, code, msg)
+		}
+	}
+}
+
+func TestFanOutDeferred(t *testing.T) {
+	setupSim(t)
+	rules, err := ParseCooldowns([]CooldownRule{{Control: "cpu_freq.max_cpu_freq", Interval: "1h", Mode: "coalesce"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SetCooldowns(rules)
+
+	if level, _, msg := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "hwthread", "5", "3000000"), RequestContext{}); level != "INFO" {
+		t.Fatalf("PUT failed: %s", msg)
+	}
+	r := ProcessMessage(newRequest(t, "cpu_freq.max_cpu_freq", "socket", "1", "2000000"), RequestContext{})
+	level, _ := r.GetTag("level")
+	msg, _ := r.GetLogValue()
+	if _, ok := r.GetTag("deferred"); !ok || level != "INFO" {
+		t.Errorf("deferred write not reported: %s %s", level, msg)
+	}
+	if !strings.Contains(msg, "3 of 4 hwthreads") || !strings.Contains(msg, "1 deferred") {
+		t.Errorf("unexpected summary: %s", msg)
+	}
+}
+
+func TestFanOutLease(t *testing.T) {
+	setupSim(t)
+	ctx := RequestContext{}
+	if level, _, msg := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "socket", "1", "2000000", "lease", "1h"), ctx); level != "INFO" {
+		t.Fatalf("PUT with lease failed: %s", msg)
+	}
+	keys := make([]string, 0, 4)
+	for _, hwthread := range []string{"4", "5", "6", "7"} {
+		keys = append(keys, ControlKey("sysfeatures/cpu_freq.max_cpu_freq", "hwthread", hwthread))
+	}
+
+	tests := []struct {
+		name     string
+		request  string
+		deviceId string
+		level    string
+		code     string
+		leases   bool
+	}{
+		{"renew", "renew", "1", "INFO", "", true},
+		{"renew other socket", "renew", "0", "ERROR", errorNoSuchLease, true},
+		{"release", "release", "1", "INFO", "", false},
+		{"release again", "release", "1", "ERROR", errorNoSuchLease, false},
+	}
+	for _, tc := range tests {
+		level, code, msg := process(t, newRequest(t, tc.request, "socket", tc.deviceId, "0", "control", "cpu_freq.max_cpu_freq", "lease", "2h"), ctx)
+		if level != tc.level || code != tc.code {
+			t.Errorf("%s: expected %s '%s' but got %s '%s': %s", tc.name, tc.level, tc.code, level, code, msg)
+		}
+		for _, key := range keys {
+			if HasLease(key) != tc.leases {
+				t.Errorf("%s: expected lease of %s %v", tc.name, key, tc.leases)
+			}
+		}
+	}
+	if _, _, value := process(t, newRequest(t, "cpu_freq.max_cpu_freq", "socket", "1", ""), ctx); value != "3600000" {
+		t.Errorf("expected released value '3600000' but got '%s'", value)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+)
+
+// Lease is a temporary change of a control. When the lease expires, the control
+// is set back to the value it had before the lease.
+type Lease struct {
+	Control    string    `json:"control"` // Namespaced name <provider>/<category>.<name>
+	DeviceType string    `json:"device_type"`
+	DeviceId   string    `json:"device_id"`
+	Value      string    `json:"value"`    // Leased value
+	Previous   string    `json:"previous"` // Value before the lease
+	Expires    time.Time `json:"expires"`
+	timer      *time.Timer
+}
+
+var (
+	leasesMutex sync.Mutex
+	leases      map[string]*Lease = make(map[string]*Lease)
+)
+
+// ControlKey returns the key of a control on a device. It is used for leases
+// and to distribute requests to workers.
+func ControlKey(control, deviceType, deviceId string) string {
+	if deviceType == "node" {
+		deviceId = ""
+	}
+	return fmt.Sprintf("%s@%s-%s", control, deviceType, deviceId)
+}
+
+// AddLease registers a lease for a control on a device. If there is already a
+// lease for it, the value before the first lease is kept and only value and
+// expiry are updated.
+func AddLease(control, deviceType, deviceId, value, previous string, duration time.Duration) time.Time {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+
+	key := ControlKey(control, deviceType, deviceId)
+	l, ok := leases[key]
+	if ok {
+		l.timer.Stop()
+		l.Value = value
+	} else {
+		l = &Lease{
+			Control:    control,
+			DeviceType: deviceType,
+			DeviceId:   deviceId,
+			Value:      value,
+			Previous:   previous,
+		}
+		leases[key] = l
+	}
+	l.Expires = time.Now().Add(duration)
+	l.timer = time.AfterFunc(duration, func() { expireLease(key) })
+	cclog.ComponentDebug("Lease", "Lease for", key, "expires at", l.Expires.Format(time.RFC3339))
+	StateChanged()
+	return l.Expires
+}
+
+// RenewLease extends an existing lease to expire after duration from now
+func RenewLease(key string, duration time.Duration) (time.Time, error) {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+
+	l, ok := leases[key]
+	if !ok {
+		return time.Time{}, withErrorCode(errorNoSuchLease, fmt.Errorf("No lease for %s", key))
+	}
+	l.timer.Stop()
+	l.Expires = time.Now().Add(duration)
+	l.timer = time.AfterFunc(duration, func() { expireLease(key) })
+	cclog.ComponentDebug("Lease", "Lease for", key, "renewed, expires at", l.Expires.Format(time.RFC3339))
+	StateChanged()
+	return l.Expires, nil
+}
+
+// ReleaseLease ends a lease early and sets the control back to the value before
+// the lease. The revert is recorded in the audit log for requester.
+func ReleaseLease(key, requester string) error {
+	l := removeLease(key)
+	if l == nil {
+		return withErrorCode(errorNoSuchLease, fmt.Errorf("No lease for %s", key))
+	}
+	return revertLease(l, requester)
+}
+
+// DropLease removes a lease without reverting it, e.g. because the control was
+// set to a new value without lease
+func DropLease(key string) {
+	if l := removeLease(key); l != nil {
+		cclog.ComponentDebug("Lease", "Dropped lease for", key)
+	}
+}
+
+func removeLease(key string) *Lease {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+
+	l, ok := leases[key]
+	if !ok {
+		return nil
+	}
+	l.timer.Stop()
+	delete(leases, key)
+	StateChanged()
+	return l
+}
+
+// expireLease queues the revert of an expired lease, so it is ordered with
+// other requests for the same control and device
+func expireLease(key string) {
+	SubmitBackground(key, func() {
+		leasesMutex.Lock()
+		l, ok := leases[key]
+		// The lease may have been renewed or released in the meantime
+		if !ok || time.Now().Before(l.Expires) {
+			leasesMutex.Unlock()
+			return
+		}
+		l.timer.Stop()
+		delete(leases, key)
+		leasesMutex.Unlock()
+		StateChanged()
+
+		cclog.ComponentInfo("Lease", "Lease for", key, "expired")
+		if err := revertLease(l, requesterLeaseExpiry); err != nil {
+			cclog.ComponentError("Lease", err.Error())
+		}
+	})
+}
+
+// recoverLease restores a lease of a previous run. If the control does not have
+// the leased value anymore, the lease was superseded and is dropped. Expired
+// leases are reverted immediately.
+func recoverLease(l Lease) {
+	key := ControlKey(l.Control, l.DeviceType, l.DeviceId)
+	provider, entry, err := ccprovider.Lookup(l.Control)
+	if err != nil {
+		cclog.ComponentWarn("Lease", "Dropping lease for", key, ":", err.Error())
+		return
+	}
+	current, err := provider.Get(entry.Control(), l.DeviceType, l.DeviceId)
+	if err != nil {
+		cclog.ComponentWarn("Lease", "Dropping lease for", key, ":", err.Error())
+		return
+	}
+	if current != l.Value {
+		cclog.ComponentWarn("Lease", "Dropping lease for", key, ": value changed to", current, "since the lease was saved")
+		return
+	}
+	remaining := time.Until(l.Expires)
+	if remaining <= 0 {
+		cclog.ComponentInfo("Lease", "Lease for", key, "expired while not running")
+		if err := revertLease(&l, requesterLeaseExpiry); err != nil {
+			cclog.ComponentError("Lease", err.Error())
+		}
+		return
+	}
+
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+	if old, ok := leases[key]; ok {
+		old.timer.Stop()
+	}
+	l.timer = time.AfterFunc(remaining, func() { expireLease(key) })
+	leases[key] = &l
+	cclog.ComponentInfo("Lease", "Recovered lease for", key, "expiring at", l.Expires.Format(time.RFC3339))
+}
+
+// HasLease returns whether there is an active lease for a control on a device
+func HasLease(key string) bool {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+	_, ok := leases[key]
+	return ok
+}
+
+// revertLease sets a control back to the value before the lease
+func revertLease(l *Lease, requester string) error {
+	provider, entry, err := ccprovider.Lookup(l.Control)
+	if err != nil {
+		return err
+	}
+	if cc_node_control_pretend {
+		cclog.ComponentInfo("Lease", "Pretend: would revert", l.Control, "for device", l.DeviceType, l.DeviceId, "to", l.Previous)
+		return nil
+	}
+	cclog.ComponentDebug("Lease", "Reverting", l.Control, "for device", l.DeviceType, l.DeviceId, "to", l.Previous)
+	err = provider.Set(entry.Control(), l.DeviceType, l.DeviceId, l.Previous)
+	Audit(AuditEntry{
+		Requester:  requester,
+		Control:    l.Control,
+		DeviceType: l.DeviceType,
+		DeviceId:   l.DeviceId,
+		OldValue:   l.Value,
+		NewValue:   l.Previous,
+	}, err)
+	if err != nil {
+		return fmt.Errorf("Failed to revert %s for device %s/%s to %s: %w", l.Control, l.DeviceType, l.DeviceId, l.Previous, err)
+	}
+	return nil
+}
+
+// ProcessLease handles 'renew' and 'release' control messages. The tag 'control'
+// and the device tags select the lease, 'renew' requires the tag 'lease' with
+// the new duration.
+func ProcessLease(request lp.CCMessage, ctx RequestContext) (lp.CCMessage, error) {
+	result := newControlResult(request)
+	makeReply := func(level, fmtStr string, args ...any) (lp.CCMessage, error) {
+		return makeControlReply(request, level, result, fmt.Sprintf(fmtStr, args...))
+	}
+	makeErrorReply := func(code, fmtStr string, args ...any) (lp.CCMessage, error) {
+		result.Error = code
+		return makeReply("ERROR", fmtStr, args...)
+	}
+
+	if method, _ := request.GetControlMethod(); method != "PUT" {
+		return makeErrorReply(errorInvalidRequest, "Invalid method '%s' for %s, only PUT is supported", method, request.Name())
+	}
+
+	control, ok := request.GetTag("control")
+	if !ok {
+		return makeErrorReply(errorInvalidRequest, "No 'control' tag in request: %v", request)
+	}
+	_, entry, err := ccprovider.Lookup(control)
+	if err != nil {
+		return makeErrorReply(errorNoSuchControl, "%v", err)
+	}
+	result.Control = entry.FullName()
+	deviceType, ok := request.GetTag("type")
+	if !ok {
+		return makeErrorReply(errorInvalidRequest, "No 'type' tag in request: %v", request)
+	}
+	deviceId, _ := request.GetTag("type-id")
+	key := ControlKey(entry.FullName(), deviceType, deviceId)
+
+	switch request.Name() {
+	case "renew":
+		duration, err := parseLeaseDuration(request)
+		if err != nil {
+			return makeErrorReply(errorInvalidRequest, "%v", err)
+		}
+		if cc_node_control_pretend {
+			return makeReply("INFO", "Pretend: would renew lease for '%s' on device '%s:%s' for %s", entry.Control(), deviceType, deviceId, duration)
+		}
+		expires, err := RenewLease(key, duration)
+		if err != nil {
+			return makeErrorReply(errorCode(err, errorBackendFailure), "%v", err)
+		}
+		return makeReply("INFO", "Renewed lease for '%s' on device '%s:%s', expires at %s", entry.Control(), deviceType, deviceId, expires.Format(time.RFC3339))
+	case "release":
+		if cc_node_control_pretend {
+			return makeReply("INFO", "Pretend: would release lease for '%s' on device '%s:%s'", entry.Control(), deviceType, deviceId)
+		}
+		err := ReleaseLease(key, ctx.Identity)
+		if err != nil {
+			return makeErrorReply(errorCode(err, backendErrorCode(deviceType, deviceId)), "%v", err)
+		}
+		return makeReply("INFO", "Released lease for '%s' on device '%s:%s'", entry.Control(), deviceType, deviceId)
+	}
+	return makeErrorReply(errorInvalidRequest, "Invalid lease request '%s'", request.Name())
+}
+
+// parseLeaseDuration parses the duration in the 'lease' tag of a request
+func parseLeaseDuration(request lp.CCMessage) (time.Duration, error) {
+	lease, ok := request.GetTag("lease")
+	if !ok {
+		return 0, fmt.Errorf("No 'lease' tag in request: %v", request)
+	}
+	duration, err := time.ParseDuration(lease)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("Invalid lease duration '%s'", lease)
+	}
+	return duration, nil
+}
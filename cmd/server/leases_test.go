@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecoverExpiredLease(t *testing.T) {
+	setupSim(t)
+	expired := Lease{
+		Control:    "sysfeatures/rapl.pkg_limit_1",
+		DeviceType: "socket",
+		DeviceId:   "1",
+		Value:      "140000",
+		Previous:   "130000",
+		Expires:    time.Now().Add(-time.Minute),
+	}
+	request := newRequest(t, "rapl.pkg_limit_1", "socket", "1", "")
+
+	tests := []struct {
+		pretend  bool
+		expected string
+	}{
+		{true, "140000"},
+		{false, "130000"},
+	}
+	for _, tc := range tests {
+		cc_node_control_pretend = tc.pretend
+		recoverLease(expired)
+		cc_node_control_pretend = false
+		if _, _, value := process(t, request, RequestContext{}); value != tc.expected {
+			t.Errorf("pretend %v: expected '%s' but got '%s'", tc.pretend, tc.expected, value)
+		}
+		if HasLease(ControlKey(expired.Control, expired.DeviceType, expired.DeviceId)) {
+			t.Errorf("pretend %v: expired lease recovered", tc.pretend)
+		}
+	}
+}
+
+func TestFailedPutKeepsLease(t *testing.T) {
+	setupSim(t)
+	ctx := RequestContext{}
+	key := ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "0")
+	if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", "120000", "lease", "1h"), ctx); level != "INFO" {
+		t.Fatalf("PUT with lease failed: %s", msg)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		level string
+		lease bool
+	}{
+		{"failed write", "250000", "ERROR", true},
+		{"successful write", "110000", "INFO", false},
+	}
+	for _, tc := range tests {
+		if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", tc.value), ctx); level != tc.level {
+			t.Errorf("%s: expected %s but got %s: %s", tc.name, tc.level, level, msg)
+		}
+		if HasLease(key) != tc.lease {
+			t.Errorf("%s: expected lease %v", tc.name, tc.lease)
+		}
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	setupSim(t)
+	key := ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "0")
+	get := newRequest(t, "rapl.pkg_limit_1", "socket", "0", "")
+	if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", "120000", "lease", "1h"), RequestContext{}); level != "INFO" {
+		t.Fatalf("PUT with lease failed: %s", msg)
+	}
+	// A second lease keeps the value before the first lease
+	if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", "110000", "lease", "1h"), RequestContext{}); level != "INFO" {
+		t.Fatalf("second PUT with lease failed: %s", msg)
+	}
+	if _, err := RenewLease(key, 10*time.Millisecond); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for HasLease(key) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if HasLease(key) {
+		t.Fatalf("lease did not expire")
+	}
+	if _, _, value := process(t, get, RequestContext{}); value != "150000" {
+		t.Errorf("expected reverted value '150000' but got '%s'", value)
+	}
+}
+
+func TestProcessLease(t *testing.T) {
+	setupSim(t)
+	ctx := RequestContext{}
+	key := ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "0")
+	lease := func(op string, value string, tags ...string) []string {
+		return append([]string{op, value}, tags...)
+	}
+	if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", "120000", "lease", "1h"), ctx); level != "INFO" {
+		t.Fatalf("PUT with lease failed: %s", msg)
+	}
+
+	tests := []struct {
+		name    string
+		request []string // name, value and additional tags
+		pretend bool
+		level   string
+		code    string
+		expires time.Duration // Expected remaining time of the lease, 0 without lease
+		value   string
+	}{
+		{"renew without duration", lease("renew", "0", "control", "rapl.pkg_limit_1"), false, "ERROR", errorInvalidRequest, time.Hour, "120000"},
+		{"renew invalid duration", lease("renew", "0", "control", "rapl.pkg_limit_1", "lease", "soon"), false, "ERROR", errorInvalidRequest, time.Hour, "120000"},
+		{"renew without control", lease("renew", "0", "lease", "2h"), false, "ERROR", errorInvalidRequest, time.Hour, "120000"},
+		{"renew unknown control", lease("renew", "0", "control", "rapl.pkg_limit_9", "lease", "2h"), false, "ERROR", errorNoSuchControl, time.Hour, "120000"},
+		{"renew with GET", lease("renew", "", "control", "rapl.pkg_limit_1", "lease", "2h"), false, "ERROR", errorInvalidRequest, time.Hour, "120000"},
+		{"renew other control", lease("renew", "0", "control", "rapl.pkg_max_limit", "lease", "2h"), false, "ERROR", errorNoSuchLease, time.Hour, "120000"},
+		{"pretend renew", lease("renew", "0", "control", "rapl.pkg_limit_1", "lease", "3h"), true, "INFO", "", time.Hour, "120000"},
+		{"renew", lease("renew", "0", "control", "rapl.pkg_limit_1", "lease", "2h"), false, "INFO", "", 2 * time.Hour, "120000"},
+		{"pretend release", lease("release", "0", "control", "rapl.pkg_limit_1"), true, "INFO", "", 2 * time.Hour, "120000"},
+		{"release", lease("release", "0", "control", "rapl.pkg_limit_1"), false, "INFO", "", 0, "150000"},
+		{"release again", lease("release", "0", "control", "rapl.pkg_limit_1"), false, "ERROR", errorNoSuchLease, 0, "150000"},
+		{"renew released", lease("renew", "0", "control", "rapl.pkg_limit_1", "lease", "2h"), false, "ERROR", errorNoSuchLease, 0, "150000"},
+	}
+	for _, tc := range tests {
+		cc_node_control_pretend = tc.pretend
+		level, code, msg := process(t, newRequest(t, tc.request[0], "socket", "0", tc.request[1], tc.request[2:]...), ctx)
+		cc_node_control_pretend = false
+		if level != tc.level || code != tc.code {
+			t.Errorf("%s: expected %s '%s' but got %s '%s': %s", tc.name, tc.level, tc.code, level, code, msg)
+		}
+
+		leasesMutex.Lock()
+		l, ok := leases[key]
+		var remaining time.Duration
+		if ok {
+			remaining = time.Until(l.Expires)
+		}
+		leasesMutex.Unlock()
+		if ok != (tc.expires > 0) || ok && (remaining > tc.expires || remaining < tc.expires-time.Minute) {
+			t.Errorf("%s: expected lease expiring in %s but got %v expiring in %s", tc.name, tc.expires, ok, remaining)
+		}
+		if _, _, value := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", ""), ctx); value != tc.value {
+			t.Errorf("%s: expected value '%s' but got '%s'", tc.name, tc.value, value)
+		}
+	}
+}
@@ -2,30 +2,56 @@ package main
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
 	"github.com/nats-io/nats.go"
 )
 
 type NatsConnection struct {
-	conn       *nats.Conn
-	sub        *nats.Subscription
-	ch         chan *nats.Msg
+	conn     *nats.Conn
+	subs     []*nats.Subscription
+	subsLock sync.Mutex
+	ch       chan *nats.Msg
 }
 
 type NatsConfig struct {
-	Server              string `json:"server"`
-	Port                int    `json:"port"`
-	RequestSubject      string `json:"requestSubject"`
+	Server               string   `json:"server"`
+	Port                 int      `json:"port"`
+	Servers              []string `json:"servers,omitempty"`       // List of server URLs, replaces server and port
+	ReconnectWait        string   `json:"reconnectWait,omitempty"` // Time between reconnect attempts, e.g. '2s'
+	MaxReconnects        int      `json:"maxReconnects,omitempty"` // Maximal reconnect attempts, negative for unlimited
+	RequestSubject       string   `json:"requestSubject"`
+	RequestSubjectPrefix string   `json:"requestSubjectPrefix,omitempty"` // Subscribe to per-host subject <prefix>.<hostname>
+	BroadcastSubject     string   `json:"broadcastSubject,omitempty"`     // Subscribe to cluster-wide subject
 	//ReplySubject      string `json:"replySubject"`
 	User                string `json:"user"`
 	Password            string `json:"password"`
 	CredsFile           string `json:"credsFile"`
 	NKeySeedFile        string `json:"nkeySeedFile"`
 	OutstandingMessages int    `json:"outstandingMessagesInQueue,omitempty"`
+	Workers             int    `json:"workers,omitempty"` // Number of requests processed in parallel
 }
 
-func ConnectNats(config NatsConfig) (*NatsConnection, error) {
+// RequestSubjects returns all subjects to subscribe to for requests
+func (config NatsConfig) RequestSubjects(hostname string) []string {
+	subjects := make([]string, 0)
+	if len(config.RequestSubject) > 0 {
+		subjects = append(subjects, config.RequestSubject)
+	}
+	if len(config.RequestSubjectPrefix) > 0 {
+		subjects = append(subjects, fmt.Sprintf("%s.%s", config.RequestSubjectPrefix, hostname))
+	}
+	if len(config.BroadcastSubject) > 0 {
+		subjects = append(subjects, config.BroadcastSubject)
+	}
+	return subjects
+}
+
+func ConnectNats(config NatsConfig, hostname string) (*NatsConnection, error) {
 	options := make([]nats.Option, 0)
 	if len(config.Password) > 0 {
 		options = append(options, nats.UserInfo(config.User, config.Password))
@@ -42,30 +68,118 @@ func ConnectNats(config NatsConfig) (*NatsConnection, error) {
 		options = append(options, r)
 	}
 
-	uri := fmt.Sprintf("nats://%s:%d", config.Server, config.Port)
+	if len(config.ReconnectWait) > 0 {
+		wait, err := time.ParseDuration(config.ReconnectWait)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse reconnectWait '%s': %w", config.ReconnectWait, err)
+		}
+		options = append(options, nats.ReconnectWait(wait))
+	}
+	if config.MaxReconnects != 0 {
+		options = append(options, nats.MaxReconnects(config.MaxReconnects))
+	}
+
+	c := &NatsConnection{
+		// All subscriptions deliver into the same channel
+		ch:   make(chan *nats.Msg, config.OutstandingMessages),
+		subs: make([]*nats.Subscription, 0),
+	}
+	options = append(options,
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				cclog.ComponentWarn("NATS", "disconnected from", nc.ConnectedUrlRedacted(), ":", err.Error())
+			} else {
+				cclog.ComponentWarn("NATS", "disconnected")
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			cclog.ComponentInfo("NATS", "reconnected to", nc.ConnectedUrlRedacted())
+			c.verifySubscriptions()
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			if err := nc.LastError(); err != nil {
+				cclog.ComponentError("NATS", "connection closed:", err.Error())
+			} else {
+				cclog.ComponentDebug("NATS", "connection closed")
+			}
+		}),
+	)
+
+	uri := strings.Join(config.Servers, ",")
+	if len(uri) == 0 {
+		uri = fmt.Sprintf("nats://%s:%d", config.Server, config.Port)
+	}
 	cclog.ComponentDebug("NATS", "connecting to", uri)
 	conn, err := nats.Connect(uri, options...)
 	if err != nil {
 		return nil, err
 	}
+	c.conn = conn
 
-	ch := make(chan *nats.Msg, config.OutstandingMessages)
-	cclog.ComponentDebugf("NATS", "subscribing to %s", config.RequestSubject)
-	sub, err := conn.ChanSubscribe(config.RequestSubject, ch)
+	c.subsLock.Lock()
+	defer c.subsLock.Unlock()
+	for _, subject := range config.RequestSubjects(hostname) {
+		cclog.ComponentDebugf("NATS", "subscribing to %s", subject)
+		sub, err := conn.ChanSubscribe(subject, c.ch)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.subs = append(c.subs, sub)
+	}
+
+	return c, nil
+}
+
+// verifySubscriptions checks after a reconnect that all subscriptions are active
+// again and subscribes anew otherwise
+func (c *NatsConnection) verifySubscriptions() {
+	c.subsLock.Lock()
+	defer c.subsLock.Unlock()
+
+	for i, sub := range c.subs {
+		if sub.IsValid() {
+			cclog.ComponentDebugf("NATS", "subscription to %s active", sub.Subject)
+			continue
+		}
+		cclog.ComponentWarn("NATS", "subscription to", sub.Subject, "lost, subscribing again")
+		newSub, err := c.conn.ChanSubscribe(sub.Subject, c.ch)
+		if err != nil {
+			cclog.ComponentError("NATS", "failed to subscribe to", sub.Subject, ":", err.Error())
+			continue
+		}
+		c.subs[i] = newSub
+	}
+
+	// Make sure the server processed the subscriptions
+	err := c.conn.FlushTimeout(5 * time.Second)
 	if err != nil {
-		return nil, err
+		cclog.ComponentError("NATS", "failed to verify subscriptions:", err.Error())
 	}
+}
 
-	return &NatsConnection{
-		conn: conn,
-		ch: ch,
-		sub: sub,
-	}, nil
+// ConnectionEquals checks whether two configurations result in the same
+// connection and subscriptions
+func (config NatsConfig) ConnectionEquals(other NatsConfig) bool {
+	// The number of workers does not affect the connection
+	config.Workers = other.Workers
+	return reflect.DeepEqual(config, other)
+}
+
+// UnsubscribeNats stops receiving requests. Requests already in the channel stay there.
+func UnsubscribeNats(conn *NatsConnection) {
+	conn.subsLock.Lock()
+	defer conn.subsLock.Unlock()
+	for _, sub := range conn.subs {
+		if sub.IsValid() {
+			sub.Unsubscribe()
+		}
+	}
 }
 
 func DisconnectNats(conn *NatsConnection) {
 	cclog.ComponentDebug("NATS", "disconnecting ...")
-	conn.sub.Unsubscribe()
+	UnsubscribeNats(conn)
 	close(conn.ch)
 	conn.conn.Close()
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+)
+
+// PolicyRule restricts the values that may be written to a control. All
+// restrictions given in a rule have to be fulfilled.
+type PolicyRule struct {
+	// Pattern of the control name (shell glob). Patterns containing the provider
+	// separator '/' are matched against <provider>/<category>.<name>, all
+	// others against <category>.<name>.
+	Control string `json:"control"`
+	// Device type the rule applies to, empty or '*' for all device types
+	DeviceType string   `json:"type,omitempty"`
+	Forbidden  bool     `json:"forbidden,omitempty"` // Reject all writes
+	Min        *float64 `json:"min,omitempty"`       // Minimal numeric value
+	Max        *float64 `json:"max,omitempty"`       // Maximal numeric value
+	Values     []string `json:"values,omitempty"`    // List of allowed values
+	Regex      string   `json:"regex,omitempty"`     // Regular expression the whole value has to match
+	regex      *regexp.Regexp
+}
+
+// Policy is a list of rules. For a write, all rules matching the control and
+// device type are checked.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+var (
+	policyLock sync.RWMutex
+	policy     Policy
+)
+
+// LoadPolicy reads a policy file. An empty filename returns an empty policy
+// that allows all writes.
+func LoadPolicy(filename string) (Policy, error) {
+	var p Policy
+	if len(filename) == 0 {
+		return p, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return p, fmt.Errorf("Failed to read policy file %s: %w", filename, err)
+	}
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return p, fmt.Errorf("Failed to parse policy file %s: %w", filename, err)
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if len(r.Control) == 0 {
+			return p, fmt.Errorf("Policy rule %d has no control", i)
+		}
+		if _, err := path.Match(r.Control, ""); err != nil {
+			return p, fmt.Errorf("Invalid control pattern '%s' in policy rule %d: %w", r.Control, i, err)
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return p, fmt.Errorf("Policy rule %d for '%s' has min %v greater than max %v", i, r.Control, *r.Min, *r.Max)
+		}
+		if len(r.Regex) > 0 {
+			// Anchored, so the regex has to match the whole value
+			r.regex, err = regexp.Compile("^(?:" + r.Regex + ")$")
+			if err != nil {
+				return p, fmt.Errorf("Invalid regex '%s' in policy rule %d: %w", r.Regex, i, err)
+			}
+		}
+	}
+	return p, nil
+}
+
+// SetPolicy replaces the active policy
+func SetPolicy(p Policy) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	policy = p
+}
+
+// matches returns whether the rule applies to a control on a device type
+func (r *PolicyRule) matches(entry ccprovider.ControlEntry, deviceType string) bool {
+	if len(r.DeviceType) > 0 && r.DeviceType != "*" && r.DeviceType != deviceType {
+		return false
+	}
+	return matchControl(r.Control, entry.Control(), entry.FullName())
+}
+
+// matchControl matches a control pattern against <category>.<name> or, if the
+// pattern contains the provider separator, against <provider>/<category>.<name>
+func matchControl(pattern, control, fullName string) bool {
+	name := control
+	if strings.Contains(pattern, ccprovider.NamespaceSeparator) {
+		name = fullName
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// check returns an error if the value violates the rule
+func (r *PolicyRule) check(value string) error {
+	if r.Forbidden {
+		return fmt.Errorf("control must not be changed")
+	}
+	if len(r.Values) > 0 && !slices.Contains(r.Values, value) {
+		return fmt.Errorf("value '%s' not in allowed values %s", value, strings.Join(r.Values, ","))
+	}
+	if r.regex != nil && !r.regex.MatchString(value) {
+		return fmt.Errorf("value '%s' does not match '%s'", value, r.Regex)
+	}
+	if r.Min != nil || r.Max != nil {
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return fmt.Errorf("value '%s' is not numeric", value)
+		}
+		if r.Min != nil && f < *r.Min {
+			return fmt.Errorf("value %s is below minimum %v", value, *r.Min)
+		}
+		if r.Max != nil && f > *r.Max {
+			return fmt.Errorf("value %s is above maximum %v", value, *r.Max)
+		}
+	}
+	return nil
+}
+
+// CheckPolicy returns an error if writing value to the control on a device of
+// the given type violates the active policy
+func CheckPolicy(entry ccprovider.ControlEntry, deviceType, value string) error {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+
+	for i := range policy.Rules {
+		r := &policy.Rules[i]
+		if !r.matches(entry, deviceType) {
+			continue
+		}
+		if err := r.check(value); err != nil {
+			return fmt.Errorf("Policy violation for '%s' on device type '%s' (rule '%s'): %w", entry.Control(), deviceType, r.Control, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+)
+
+// loadTestPolicy writes a policy file and loads it
+func loadTestPolicy(t *testing.T, content string) (Policy, error) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatal(err.Error())
+	}
+	return LoadPolicy(filename)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"valid", `{"rules": [{"control": "rapl.*", "min": 1, "max": 2}, {"control": "cpu_freq.governor", "regex": "[a-z]+"}]}`, true},
+		{"no control", `{"rules": [{"min": 1}]}`, false},
+		{"invalid pattern", `{"rules": [{"control": "rapl.[", "forbidden": true}]}`, false},
+		{"min above max", `{"rules": [{"control": "rapl.*", "min": 3, "max": 2}]}`, false},
+		{"invalid regex", `{"rules": [{"control": "rapl.*", "regex": "("}]}`, false},
+		{"invalid json", `{"rules": [`, false},
+	}
+	for _, tc := range tests {
+		_, err := loadTestPolicy(t, tc.content)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v but got error %v", tc.name, tc.valid, err)
+		}
+	}
+
+	if p, err := LoadPolicy(""); err != nil || len(p.Rules) != 0 {
+		t.Errorf("empty filename should return an empty policy")
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	p, err := loadTestPolicy(t, `{"rules": [
+		{"control": "rapl.pkg_limit_*", "type": "socket", "min": 100000, "max": 250000},
+		{"control": "cpu_freq.governor", "values": ["performance", "powersave"]},
+		{"control": "cpu_freq.energy_perf_pref", "regex": "[a-z_]+"},
+		{"control": "prefetch.*", "forbidden": true},
+		{"control": "sysfeatures/rapl.dram_limit", "forbidden": true},
+		{"control": "cpu_freq.max_cpu_freq", "min": 800000},
+		{"control": "cpu_freq.max_cpu_freq", "max": 3600000}
+	]}`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SetPolicy(p)
+	defer SetPolicy(Policy{})
+
+	entry := func(provider, category, name string) ccprovider.ControlEntry {
+		return ccprovider.ControlEntry{Provider: provider, Category: category, Name: name}
+	}
+	pkgLimit := entry("sysfeatures", "rapl", "pkg_limit_1")
+	governor := entry("cpufreq", "cpu_freq", "governor")
+	maxFreq := entry("cpufreq", "cpu_freq", "max_cpu_freq")
+
+	tests := []struct {
+		name       string
+		entry      ccprovider.ControlEntry
+		deviceType string
+		value      string
+		allowed    bool
+	}{
+		{"within range", pkgLimit, "socket", "150000", true},
+		{"minimum", pkgLimit, "socket", "100000", true},
+		{"below minimum", pkgLimit, "socket", "99999", false},
+		{"above maximum", pkgLimit, "socket", "250001", false},
+		{"not numeric", pkgLimit, "socket", "much", false},
+		{"other device type", pkgLimit, "node", "1", true},
+		{"allowed value", governor, "hwthread", "powersave", true},
+		{"value not allowed", governor, "hwthread", "ondemand", false},
+		{"regex", entry("cpufreq", "cpu_freq", "energy_perf_pref"), "hwthread", "balance_power", true},
+		{"regex partial match", entry("cpufreq", "cpu_freq", "energy_perf_pref"), "hwthread", "balance power", false},
+		{"forbidden", entry("sysfeatures", "prefetch", "hwpf_reset"), "node", "1", false},
+		{"forbidden for provider", entry("sysfeatures", "rapl", "dram_limit"), "socket", "1", false},
+		{"other provider", entry("powercap", "rapl", "dram_limit"), "socket", "1", true},
+		{"all rules within", maxFreq, "hwthread", "2000000", true},
+		{"first of two rules", maxFreq, "hwthread", "400000", false},
+		{"second of two rules", maxFreq, "hwthread", "4000000", false},
+		{"no rule", entry("sysfeatures", "uncore", "max_freq"), "socket", "anything", true},
+	}
+	for _, tc := range tests {
+		err := CheckPolicy(tc.entry, tc.deviceType, tc.value)
+		if (err == nil) != tc.allowed {
+			t.Errorf("%s: expected allowed %v but got error %v", tc.name, tc.allowed, err)
+		}
+	}
+}
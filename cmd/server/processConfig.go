@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
 	topo "github.com/ClusterCockpit/cc-node-controller/pkg/ccTopology"
 
 	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
@@ -45,10 +46,12 @@ func ProcessTopologyConfig(input lp.CCMessage) (lp.CCMessage, error) {
 }
 
 type CCControlListEntry struct {
+	Provider    string `json:"provider"`
 	Category    string `json:"category"`
 	Name        string `json:"name"`
 	DeviceType  string `json:"device_type"`
 	Description string `json:"description"`
+	Unit        string `json:"unit,omitempty"`
 	Methods     string `json:"methods"`
 }
 
@@ -68,13 +71,18 @@ func ProcessControlsConfig(input lp.CCMessage) (lp.CCMessage, error) {
 
 	controls := make([]CCControlListEntry, 0)
 
-	sysfeatures_controls, err := ProcessSysfeaturesConfig()
-	if err == nil {
-		controls = append(controls, sysfeatures_controls...)
+	for _, c := range ccprovider.List() {
+		controls = append(controls, CCControlListEntry{
+			Provider:    c.Provider,
+			Category:    c.Category,
+			Name:        c.Name,
+			DeviceType:  c.DeviceType,
+			Description: c.Description,
+			Unit:        c.Unit,
+			Methods:     c.Methods(),
+		})
 	}
 
-	// if we want other sources, add them here
-
 	cl := CCControlList{
 		Controls: controls,
 	}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+	sim "github.com/ClusterCockpit/cc-node-controller/pkg/sysfeaturesSim"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+)
+
+// simSysfeaturesProvider exposes the controls of the simulated sysfeatures backend.
+// It uses the same namespace as sysfeaturesProvider, so clients cannot tell the difference.
+type simSysfeaturesProvider struct {
+	filename string
+}
+
+func (p *simSysfeaturesProvider) Name() string {
+	return "sysfeatures"
+}
+
+func (p *simSysfeaturesProvider) Init() error {
+	return sim.SysFeaturesInit(p.filename)
+}
+
+func (p *simSysfeaturesProvider) Close() {
+	sim.SysFeaturesClose()
+}
+
+func (p *simSysfeaturesProvider) List() ([]ccprovider.ControlEntry, error) {
+	out := make([]ccprovider.ControlEntry, 0)
+	sysfList, err := sim.SysFeaturesList()
+	if err != nil {
+		return out, err
+	}
+
+	for _, c := range sysfList {
+		out = append(out, ccprovider.ControlEntry{
+			Category:    c.Category,
+			Name:        c.Name,
+			DeviceType:  c.DevTypeName,
+			Description: c.Description,
+			ReadOnly:    c.ReadOnly,
+			WriteOnly:   c.WriteOnly,
+		})
+	}
+
+	return out, nil
+}
+
+func (p *simSysfeaturesProvider) Get(control, deviceType, deviceId string) (string, error) {
+	cclog.ComponentDebug("SysfeaturesSim", "Creating simulated device", deviceType, " ", deviceId)
+	dev, err := sim.LikwidDeviceCreateByTypeName(deviceType, deviceId)
+	if err != nil {
+		return "", err
+	}
+	defer sim.LikwidDeviceDestroy(dev)
+
+	return sim.SysFeaturesGetByNameAndDevice(control, dev)
+}
+
+func (p *simSysfeaturesProvider) Set(control, deviceType, deviceId, value string) error {
+	cclog.ComponentDebug("SysfeaturesSim", "Creating simulated device", deviceType, " ", deviceId)
+	dev, err := sim.LikwidDeviceCreateByTypeName(deviceType, deviceId)
+	if err != nil {
+		return err
+	}
+	defer sim.LikwidDeviceDestroy(dev)
+
+	return sim.SysFeaturesSetByNameAndDevice(control, dev, value)
+}
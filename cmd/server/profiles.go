@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+)
+
+// ProfileEntry is a single value of a profile. DeviceId '*' applies the value to
+// all devices of the type.
+type ProfileEntry struct {
+	Control    string `json:"control"`
+	DeviceType string `json:"type"`
+	DeviceId   string `json:"type-id"`
+	Value      string `json:"value"`
+}
+
+// profileWrite is a profile entry expanded to a single device
+type profileWrite struct {
+	provider   ccprovider.ControlProvider
+	entry      ccprovider.ControlEntry
+	deviceType string
+	deviceId   string
+	value      string
+	old        string
+}
+
+// AppliedProfile is the last successfully applied profile
+type AppliedProfile struct {
+	Name    string    `json:"name"`
+	Applied time.Time `json:"applied"`
+}
+
+var (
+	profilesLock   sync.RWMutex
+	profiles       map[string][]ProfileEntry
+	appliedProfile *AppliedProfile
+)
+
+// SetProfiles replaces the available profiles
+func SetProfiles(p map[string][]ProfileEntry) {
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+	profiles = p
+}
+
+// ValidateProfiles checks that all controls of the profiles exist and are
+// writable and that their devices are part of the local topology
+func ValidateProfiles(p map[string][]ProfileEntry) error {
+	for name, entries := range p {
+		writes, err := expandProfileEntries(name, entries)
+		if err != nil {
+			return err
+		}
+		for _, w := range writes {
+			if w.entry.ReadOnly {
+				return fmt.Errorf("Profile '%s': control '%s' is readonly", name, w.entry.Control())
+			}
+		}
+	}
+	return nil
+}
+
+// expandProfile resolves the controls of a profile and expands '*' to all devices
+func expandProfile(name string) ([]profileWrite, error) {
+	profilesLock.RLock()
+	entries, ok := profiles[name]
+	profilesLock.RUnlock()
+	if !ok {
+		return nil, withErrorCode(errorNoSuchProfile, fmt.Errorf("Unknown profile '%s'", name))
+	}
+	return expandProfileEntries(name, entries)
+}
+
+// expandProfileEntries resolves the controls of the entries of a profile and
+// expands '*' to all devices
+func expandProfileEntries(name string, entries []ProfileEntry) ([]profileWrite, error) {
+	writes := make([]profileWrite, 0, len(entries))
+	for _, e := range entries {
+		provider, entry, err := ccprovider.Lookup(e.Control)
+		if err != nil {
+			return nil, fmt.Errorf("Profile '%s': %w", name, withErrorCode(errorNoSuchControl, err))
+		}
+		if len(e.DeviceType) == 0 || (e.DeviceType != "node" && len(e.DeviceId) == 0) {
+			return nil, fmt.Errorf("Profile '%s': '%s' requires type and type-id", name, e.Control)
+		}
+		ids, err := expandDeviceIds(e.DeviceType, e.DeviceId)
+		if err != nil {
+			return nil, fmt.Errorf("Profile '%s': %w", name, err)
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("Profile '%s': no devices of type '%s' for '%s'", name, e.DeviceType, e.Control)
+		}
+		for _, id := range ids {
+			writes = append(writes, profileWrite{
+				provider:   provider,
+				entry:      entry,
+				deviceType: e.DeviceType,
+				deviceId:   id,
+				value:      e.Value,
+			})
+		}
+	}
+	return writes, nil
+}
+
+// ApplyProfile writes all values of a profile. All writes are checked against the
+// ACL and the policy before the first value is written. If a write fails, all
+// values written before are reverted in reverse order. Leases and desired values
+// of the written controls are dropped and their cooldowns started only after all
+// values are written. It returns the number of written values.
+func ApplyProfile(name string, ctx RequestContext) (int, error) {
+	writes, err := expandProfile(name)
+	if err != nil {
+		return 0, err
+	}
+	cooldowns := make([]cooldownWrite, 0, len(writes))
+	for _, w := range writes {
+		if err := Authorize(ctx, "PUT", w.entry.Control(), w.entry.FullName(), w.deviceType); err != nil {
+			return 0, fmt.Errorf("Profile '%s': %w", name, err)
+		}
+		if err := CheckPolicy(w.entry, w.deviceType, w.value); err != nil {
+			return 0, fmt.Errorf("Profile '%s': %w", name, withErrorCode(errorInvalidValue, err))
+		}
+		if w.entry.ReadOnly {
+			return 0, withErrorCode(errorReadOnly, fmt.Errorf("Profile '%s': control '%s' is readonly", name, w.entry.Control()))
+		}
+		cooldowns = append(cooldowns, cooldownWrite{
+			key:        ControlKey(w.entry.FullName(), w.deviceType, w.deviceId),
+			entry:      w.entry,
+			deviceType: w.deviceType,
+			deviceId:   w.deviceId,
+		})
+	}
+	if cc_node_control_pretend {
+		return len(writes), nil
+	}
+	if err := CheckCooldowns(cooldowns); err != nil {
+		return 0, fmt.Errorf("Profile '%s': %w", name, err)
+	}
+
+	for i := range writes {
+		w := &writes[i]
+		knob := w.entry.Control()
+		if !w.entry.WriteOnly {
+			w.old, err = w.provider.Get(knob, w.deviceType, w.deviceId)
+			if err != nil {
+				err = fmt.Errorf("Failed to get %s for device %s/%s: %w", knob, w.deviceType, w.deviceId, err)
+			}
+		}
+		if err == nil {
+			cclog.ComponentDebug("Profile", "Set", knob, "for device", w.deviceType, w.deviceId, "to", w.value, "request-id", ctx.RequestId)
+			err = w.provider.Set(knob, w.deviceType, w.deviceId, w.value)
+			Audit(AuditEntry{
+				Requester:  ctx.Identity,
+				RequestId:  ctx.RequestId,
+				Control:    w.entry.FullName(),
+				DeviceType: w.deviceType,
+				DeviceId:   w.deviceId,
+				OldValue:   w.old,
+				NewValue:   w.value,
+			}, err)
+			if err != nil {
+				err = fmt.Errorf("Failed to set %s=%s for device %s/%s: %w", knob, w.value, w.deviceType, w.deviceId, err)
+			}
+		}
+		if err != nil {
+			rollbackErr := rollbackProfile(writes[:i], ctx)
+			if rollbackErr != nil {
+				return 0, fmt.Errorf("Profile '%s': %w, rollback failed: %w", name, err, rollbackErr)
+			}
+			return 0, fmt.Errorf("Profile '%s': %w, rolled back %d values", name, err, i)
+		}
+	}
+
+	// The profile supersedes leases and desired values set by requests
+	for _, c := range cooldowns {
+		DropLease(c.key)
+		DropDesiredValue(c.key)
+		RecordWrite(c.key, c.entry, c.deviceType)
+	}
+
+	profilesLock.Lock()
+	appliedProfile = &AppliedProfile{
+		Name:    name,
+		Applied: time.Now(),
+	}
+	profilesLock.Unlock()
+	StateChanged()
+	return len(writes), nil
+}
+
+// checkAppliedProfile compares the values of a profile with the current values
+// and logs all differences
+func checkAppliedProfile(name string) {
+	writes, err := expandProfile(name)
+	if err != nil {
+		cclog.ComponentWarn("Profile", "Cannot check applied profile:", err.Error())
+		return
+	}
+	differing := 0
+	for _, w := range writes {
+		if w.entry.WriteOnly {
+			continue
+		}
+		current, err := w.provider.Get(w.entry.Control(), w.deviceType, w.deviceId)
+		if err != nil || current != w.value {
+			differing++
+			cclog.ComponentWarn("Profile", "Value of", w.entry.Control(), "for device", w.deviceType, w.deviceId, "differs from applied profile", name, ":", current)
+		}
+	}
+	if differing == 0 {
+		cclog.ComponentInfo("Profile", "Values of applied profile", name, "are unchanged")
+	}
+}
+
+// rollbackProfile reverts already written values of a profile in reverse order.
+// Writeonly controls cannot be reverted.
+func rollbackProfile(writes []profileWrite, ctx RequestContext) error {
+	var errs []error
+	for i := len(writes) - 1; i >= 0; i-- {
+		w := writes[i]
+		if w.entry.WriteOnly {
+			errs = append(errs, fmt.Errorf("cannot revert writeonly %s for device %s/%s", w.entry.Control(), w.deviceType, w.deviceId))
+			continue
+		}
+		err := w.provider.Set(w.entry.Control(), w.deviceType, w.deviceId, w.old)
+		Audit(AuditEntry{
+			Requester:  ctx.Identity,
+			RequestId:  ctx.RequestId,
+			Control:    w.entry.FullName(),
+			DeviceType: w.deviceType,
+			DeviceId:   w.deviceId,
+			OldValue:   w.value,
+			NewValue:   w.old,
+		}, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s for device %s/%s: %w", w.entry.Control(), w.deviceType, w.deviceId, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d values not reverted: %v", len(errs), errs)
+	}
+	return nil
+}
+
+// ProcessProfile handles 'profile' control messages. The value of the PUT request
+// is the name of the profile to apply.
+func ProcessProfile(request lp.CCMessage, ctx RequestContext) (lp.CCMessage, error) {
+	result := newControlResult(request)
+	makeReply := func(level, fmtStr string, args ...any) (lp.CCMessage, error) {
+		return makeControlReply(request, level, result, fmt.Sprintf(fmtStr, args...))
+	}
+	makeErrorReply := func(code, fmtStr string, args ...any) (lp.CCMessage, error) {
+		result.Error = code
+		return makeReply("ERROR", fmtStr, args...)
+	}
+
+	if method, _ := request.GetControlMethod(); method != "PUT" {
+		return makeErrorReply(errorInvalidRequest, "Invalid method '%s' for profile, only PUT is supported", method)
+	}
+	name, _ := request.GetControlValue()
+
+	written, err := ApplyProfile(name, ctx)
+	if errors.Is(err, ErrPermissionDenied) {
+		cclog.ComponentWarn("ACL", err.Error())
+		return makePermissionReply(request, err)
+	} else if err != nil {
+		return makeErrorReply(errorCode(err, errorBackendFailure), "%v", err)
+	}
+	if cc_node_control_pretend {
+		return makeReply("INFO", "Pretend: would apply profile '%s' with %d values", name, written)
+	}
+	return makeReply("INFO", "Applied profile '%s' with %d values", name, written)
+}
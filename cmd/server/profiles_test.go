@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateProfiles(t *testing.T) {
+	setupSim(t)
+
+	tests := []struct {
+		name    string
+		entries []ProfileEntry
+		valid   bool
+	}{
+		{"valid", []ProfileEntry{{Control: "rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "*", Value: "100000"}}, true},
+		{"node", []ProfileEntry{{Control: "prefetch.hwpf_reset", DeviceType: "node", Value: "1"}}, true},
+		{"unknown control", []ProfileEntry{{Control: "rapl.pkg_limit_9", DeviceType: "socket", DeviceId: "0", Value: "100000"}}, false},
+		{"readonly control", []ProfileEntry{{Control: "rapl.pkg_energy", DeviceType: "socket", DeviceId: "0", Value: "0"}}, false},
+		{"no type-id", []ProfileEntry{{Control: "rapl.pkg_limit_1", DeviceType: "socket", Value: "100000"}}, false},
+		{"unknown device", []ProfileEntry{{Control: "rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "0-2", Value: "100000"}}, false},
+	}
+	for _, tc := range tests {
+		err := ValidateProfiles(map[string][]ProfileEntry{tc.name: tc.entries})
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v but got error %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestProfileRollback(t *testing.T) {
+	setupSim(t)
+	SetProfiles(map[string][]ProfileEntry{
+		// Writing socket 1 fails, the simulated limit is at most 200000
+		"broken": {
+			{Control: "rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "0", Value: "110000"},
+			{Control: "rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "1", Value: "250000"},
+		},
+		"low": {{Control: "rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "*", Value: "100000"}},
+	})
+	ctx := RequestContext{}
+	// A lease on socket 0, a desired value on socket 1
+	requests := []struct {
+		deviceId string
+		value    string
+		tags     []string
+	}{
+		{"0", "130000", []string{"lease", "1h"}},
+		{"1", "120000", []string{"enforce", desiredModeReport}},
+	}
+	for _, r := range requests {
+		if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", r.deviceId, r.value, r.tags...), ctx); level != "INFO" {
+			t.Fatalf("PUT failed: %s", msg)
+		}
+	}
+	setCooldowns(t, CooldownRule{Control: "rapl.pkg_limit_1", Interval: "1h"})
+	key := ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "0")
+	desiredKey := ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "1")
+	hasDesired := func() bool {
+		desiredLock.Lock()
+		defer desiredLock.Unlock()
+		_, ok := desiredState[desiredKey]
+		return ok
+	}
+
+	tests := []struct {
+		profile string
+		level   string
+		value   string
+		kept    bool
+	}{
+		{"broken", "ERROR", "130000", true},
+		{"low", "INFO", "100000", false},
+	}
+	for _, tc := range tests {
+		if level, _, msg := process(t, newRequest(t, "profile", "node", "0", tc.profile), ctx); level != tc.level {
+			t.Errorf("%s: expected %s but got %s: %s", tc.profile, tc.level, level, msg)
+		}
+		if _, _, value := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", ""), ctx); value != tc.value {
+			t.Errorf("%s: expected '%s' on socket 0 but got '%s'", tc.profile, tc.value, value)
+		}
+		if HasLease(key) != tc.kept || hasDesired() != tc.kept {
+			t.Errorf("%s: expected lease and desired value kept %v", tc.profile, tc.kept)
+		}
+		// Only a profile that was applied starts the cooldowns
+		cooldownLock.Lock()
+		_, cooldown := lastWrite[key]
+		cooldownLock.Unlock()
+		if cooldown == tc.kept {
+			t.Errorf("%s: expected cooldown started %v", tc.profile, !tc.kept)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+)
+
+// Modes of cooldowns
+const (
+	cooldownModeReject   = "reject"   // Writes during the cooldown are rejected
+	cooldownModeCoalesce = "coalesce" // Writes during the cooldown are deferred, the last value wins
+)
+
+// CooldownRule configures the minimal interval between two writes to the same
+// control and device
+type CooldownRule struct {
+	Control    string `json:"control"`        // Pattern of the control name, see matchControl
+	DeviceType string `json:"type,omitempty"` // Device type, empty or '*' for all device types
+	Interval   string `json:"interval"`       // Minimal interval between writes, e.g. '10s'
+	Mode       string `json:"mode"`           // reject or coalesce, default reject
+	interval   time.Duration
+}
+
+// pendingWrite is a coalesced PUT request, written when the cooldown ends
+type pendingWrite struct {
+	request lp.CCMessage
+	ctx     RequestContext
+	timer   *time.Timer
+	gen     uint64
+}
+
+var (
+	cooldownLock  sync.Mutex
+	cooldownRules []CooldownRule
+	lastWrite     map[string]time.Time    = make(map[string]time.Time)
+	pendingWrites map[string]pendingWrite = make(map[string]pendingWrite)
+	// Incremented on every write and coalesced request, so a coalesced request
+	// superseded by a later write is not written
+	writeGen map[string]uint64 = make(map[string]uint64)
+)
+
+// ParseCooldowns validates the configured cooldown rules
+func ParseCooldowns(rules []CooldownRule) ([]CooldownRule, error) {
+	out := make([]CooldownRule, 0, len(rules))
+	for i, r := range rules {
+		if len(r.Control) == 0 {
+			return nil, fmt.Errorf("Cooldown rule %d has no control", i)
+		}
+		d, err := time.ParseDuration(r.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid interval '%s' in cooldown rule %d", r.Interval, i)
+		}
+		r.interval = d
+		switch r.Mode {
+		case "":
+			r.Mode = cooldownModeReject
+		case cooldownModeReject, cooldownModeCoalesce:
+		default:
+			return nil, fmt.Errorf("Invalid mode '%s' in cooldown rule %d, use '%s' or '%s'", r.Mode, i, cooldownModeReject, cooldownModeCoalesce)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// SetCooldowns replaces the active cooldown rules
+func SetCooldowns(rules []CooldownRule) {
+	cooldownLock.Lock()
+	defer cooldownLock.Unlock()
+	cooldownRules = rules
+}
+
+// cooldownWrite is a write of a request writing several controls, like 'profile'
+type cooldownWrite struct {
+	key        string
+	entry      ccprovider.ControlEntry
+	deviceType string
+	deviceId   string
+}
+
+// matchCooldownRule returns the first cooldown rule matching a control on a device
+// of deviceType or nil. cooldownLock must be held.
+func matchCooldownRule(entry ccprovider.ControlEntry, deviceType string) *CooldownRule {
+	for i := range cooldownRules {
+		r := &cooldownRules[i]
+		if len(r.DeviceType) > 0 && r.DeviceType != "*" && r.DeviceType != deviceType {
+			continue
+		}
+		if matchControl(r.Control, entry.Control(), entry.FullName()) {
+			return r
+		}
+	}
+	return nil
+}
+
+// CheckCooldown checks whether a PUT request may write a control on a device now.
+// An allowed write has to be recorded with RecordWrite once it succeeded, so a
+// failed write does not start the cooldown. Otherwise, it returns the time the
+// cooldown ends and whether the request was coalesced, i.e. it is written when
+// the cooldown ends unless a later request replaces it.
+func CheckCooldown(key string, entry ccprovider.ControlEntry, deviceType string, request lp.CCMessage, ctx RequestContext) (bool, time.Time, bool) {
+	cooldownLock.Lock()
+	defer cooldownLock.Unlock()
+
+	rule := matchCooldownRule(entry, deviceType)
+	now := time.Now()
+	if rule == nil {
+		return true, now, false
+	}
+
+	next := lastWrite[key].Add(rule.interval)
+	if !now.Before(next) {
+		return true, now, false
+	}
+	if rule.Mode == cooldownModeReject {
+		return false, next, false
+	}
+
+	// Only the last coalesced request is written
+	dropPendingWrite(key)
+	pendingWrites[key] = pendingWrite{
+		request: request,
+		ctx:     ctx,
+		timer:   time.AfterFunc(time.Until(next), func() { writePending(key) }),
+		gen:     writeGen[key],
+	}
+	return false, next, true
+}
+
+// CheckCooldowns checks whether all writes of a request writing several controls
+// may be done now. Such requests are not coalesced, a single write within its
+// cooldown rejects the whole request. The writes are not recorded, see RecordWrite.
+func CheckCooldowns(writes []cooldownWrite) error {
+	cooldownLock.Lock()
+	defer cooldownLock.Unlock()
+
+	now := time.Now()
+	for _, w := range writes {
+		rule := matchCooldownRule(w.entry, w.deviceType)
+		if rule == nil {
+			continue
+		}
+		if next := lastWrite[w.key].Add(rule.interval); now.Before(next) {
+			return withErrorCode(errorCooldown, fmt.Errorf("Cooldown: '%s' for device '%s:%s' was written recently, next write allowed at %s", w.entry.Control(), w.deviceType, w.deviceId, next.Format(time.RFC3339)))
+		}
+	}
+	return nil
+}
+
+// RecordWrite records a successful write, so the cooldown of the control and
+// device starts now. A coalesced request is discarded.
+func RecordWrite(key string, entry ccprovider.ControlEntry, deviceType string) {
+	cooldownLock.Lock()
+	defer cooldownLock.Unlock()
+	if matchCooldownRule(entry, deviceType) != nil {
+		lastWrite[key] = time.Now()
+	}
+	dropPendingWrite(key)
+}
+
+// dropPendingWrite discards the coalesced request of a control and device.
+// cooldownLock must be held.
+func dropPendingWrite(key string) {
+	if p, ok := pendingWrites[key]; ok {
+		p.timer.Stop()
+		delete(pendingWrites, key)
+	}
+	writeGen[key]++
+}
+
+// writePending processes a coalesced PUT request when the cooldown has ended
+func writePending(key string) {
+	cooldownLock.Lock()
+	p, ok := pendingWrites[key]
+	delete(pendingWrites, key)
+	cooldownLock.Unlock()
+	if !ok {
+		return
+	}
+	SubmitBackground(key, func() {
+		cooldownLock.Lock()
+		superseded := writeGen[key] != p.gen
+		cooldownLock.Unlock()
+		if superseded {
+			cclog.ComponentDebug("Cooldown", "Coalesced write for", key, "superseded")
+			return
+		}
+		r, err := ProcessPutGet(p.request, p.ctx)
+		if err != nil {
+			cclog.ComponentError("Cooldown", err.Error())
+		} else if r != nil {
+			v, _ := r.GetLogValue()
+			cclog.ComponentDebug("Cooldown", "Coalesced write for", key, ":", v)
+		}
+	})
+}
+
+// tokenBucket holds the tokens of a requester. Each request takes one token,
+// tokens are refilled with the configured rate up to the burst size.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the rate of requests per requester
+type RateLimiter struct {
+	lock      sync.Mutex
+	rate      float64 // Requests per second, 0 for unlimited
+	burst     float64
+	buckets   map[string]*tokenBucket
+	nextPrune time.Time
+}
+
+// Interval in which buckets of idle requesters are evicted
+const rateLimitPruneInterval = time.Minute
+
+var rateLimiter = &RateLimiter{
+	buckets: make(map[string]*tokenBucket),
+}
+
+// SetRateLimit configures the rate limit of all requesters. If burst is not
+// set, it is the rate rounded up.
+func (l *RateLimiter) SetRateLimit(rate float64, burst int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = rate
+	l.burst = float64(burst)
+	if burst <= 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	l.buckets = make(map[string]*tokenBucket)
+}
+
+// RateLimitKey returns the requester a request is counted for. Anonymous requests
+// are counted per connection of the sender: NATS request/reply sends the replies
+// of all requests of a connection to '<inbox prefix>.<token>' with the same prefix.
+// The reply subject is chosen by the client, so this is no protection against
+// malicious anonymous clients, which may change the prefix for each request. Clients
+// sending old style requests with a unique reply subject '_INBOX.<id>' share one
+// requester. Only identities give reliable rate limits.
+func RateLimitKey(identity, reply string) string {
+	if len(identity) > 0 {
+		return identity
+	}
+	if i := strings.LastIndex(reply, "."); i > 0 {
+		reply = reply[:i]
+	}
+	return "reply:" + reply
+}
+
+// Allow takes a token of the requester if available
+func (l *RateLimiter) Allow(requester string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.After(l.nextPrune) {
+		l.prune(now)
+	}
+	b, ok := l.buckets[requester]
+	if !ok {
+		b = &tokenBucket{
+			tokens: l.burst,
+			last:   now,
+		}
+		l.buckets[requester] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune evicts the buckets that are refilled completely. They are equal to the
+// bucket of a new requester. l.lock must be held.
+func (l *RateLimiter) prune(now time.Time) {
+	for requester, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, requester)
+		}
+	}
+	l.nextPrune = now.Add(rateLimitPruneInterval)
+}
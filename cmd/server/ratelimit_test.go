@@ -0,0 +1,262 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+)
+
+func TestParseCooldowns(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  CooldownRule
+		valid bool
+		mode  string
+	}{
+		{"default mode", CooldownRule{Control: "rapl.*", Interval: "10s"}, true, cooldownModeReject},
+		{"coalesce", CooldownRule{Control: "rapl.*", Interval: "1m", Mode: cooldownModeCoalesce}, true, cooldownModeCoalesce},
+		{"no control", CooldownRule{Interval: "10s"}, false, ""},
+		{"invalid interval", CooldownRule{Control: "rapl.*", Interval: "soon"}, false, ""},
+		{"negative interval", CooldownRule{Control: "rapl.*", Interval: "-1s"}, false, ""},
+		{"invalid mode", CooldownRule{Control: "rapl.*", Interval: "10s", Mode: "drop"}, false, ""},
+	}
+	for _, tc := range tests {
+		rules, err := ParseCooldowns([]CooldownRule{tc.rule})
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v but got error %v", tc.name, tc.valid, err)
+			continue
+		}
+		if tc.valid && rules[0].Mode != tc.mode {
+			t.Errorf("%s: expected mode %s but got %s", tc.name, tc.mode, rules[0].Mode)
+		}
+	}
+}
+
+// setCooldowns activates a single cooldown rule for the test
+func setCooldowns(t *testing.T, rule CooldownRule) {
+	t.Helper()
+	rules, err := ParseCooldowns([]CooldownRule{rule})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SetCooldowns(rules)
+}
+
+func TestCheckCooldown(t *testing.T) {
+	setupSim(t)
+	_, entry, err := ccprovider.Lookup("rapl.pkg_limit_1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	request := newRequest(t, "rapl.pkg_limit_1", "socket", "0", "120000")
+	key0 := ControlKey(entry.FullName(), "socket", "0")
+	key1 := ControlKey(entry.FullName(), "socket", "1")
+
+	tests := []struct {
+		name       string
+		mode       string
+		deviceType string
+		key        string
+		written    bool // Whether the allowed write succeeded
+		allowed    bool
+		coalesced  bool
+	}{
+		{"failed write", cooldownModeReject, "socket", key0, false, true, false},
+		{"retry", cooldownModeReject, "socket", key0, true, true, false},
+		{"second write", cooldownModeReject, "socket", key0, false, false, false},
+		{"other device", cooldownModeReject, "socket", key1, false, true, false},
+		{"coalesce", cooldownModeCoalesce, "socket", key0, false, false, true},
+		{"coalesce again", cooldownModeCoalesce, "socket", key0, false, false, true},
+		{"other device type", cooldownModeReject, "hwthread", key0, false, true, false},
+	}
+	for _, tc := range tests {
+		setCooldowns(t, CooldownRule{Control: "rapl.pkg_limit_*", DeviceType: "socket", Interval: "1h", Mode: tc.mode})
+		ok, next, coalesced := CheckCooldown(tc.key, entry, tc.deviceType, request, RequestContext{})
+		if ok != tc.allowed || coalesced != tc.coalesced {
+			t.Errorf("%s: expected (%v, %v) but got (%v, %v)", tc.name, tc.allowed, tc.coalesced, ok, coalesced)
+		}
+		if !ok && time.Until(next) < 59*time.Minute {
+			t.Errorf("%s: unexpected end of cooldown %v", tc.name, next)
+		}
+		if ok && tc.written {
+			RecordWrite(tc.key, entry, tc.deviceType)
+		}
+	}
+
+	cooldownLock.Lock()
+	pending := len(pendingWrites)
+	cooldownLock.Unlock()
+	if pending != 1 {
+		t.Errorf("expected 1 coalesced request but got %d", pending)
+	}
+	RecordWrite(key0, entry, "socket")
+	cooldownLock.Lock()
+	pending = len(pendingWrites)
+	cooldownLock.Unlock()
+	if pending != 0 {
+		t.Errorf("coalesced request not discarded by write")
+	}
+}
+
+func TestCooldownFailedWrite(t *testing.T) {
+	setupSim(t)
+	setCooldowns(t, CooldownRule{Control: "rapl.pkg_limit_1", Interval: "1h"})
+
+	// The simulated limit is at most 200000, so the first write fails
+	tests := []struct {
+		value string
+		level string
+		code  string
+	}{
+		{"250000", "ERROR", errorBackendFailure},
+		{"120000", "INFO", ""},
+		{"110000", "ERROR", errorCooldown},
+	}
+	for _, tc := range tests {
+		level, code, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", tc.value), RequestContext{})
+		if level != tc.level || code != tc.code {
+			t.Errorf("%s: expected %s '%s' but got %s '%s': %s", tc.value, tc.level, tc.code, level, code, msg)
+		}
+	}
+}
+
+func TestCheckCooldowns(t *testing.T) {
+	setupSim(t)
+	_, entry, err := ccprovider.Lookup("rapl.pkg_limit_1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	setCooldowns(t, CooldownRule{Control: "rapl.pkg_limit_1", Interval: "1h", Mode: cooldownModeCoalesce})
+	writes := []cooldownWrite{
+		{ControlKey(entry.FullName(), "socket", "0"), entry, "socket", "0"},
+		{ControlKey(entry.FullName(), "socket", "1"), entry, "socket", "1"},
+	}
+
+	if err := CheckCooldowns(writes); err != nil {
+		t.Errorf("writes rejected without previous write: %v", err)
+	}
+	// Checking does not record the writes
+	if err := CheckCooldowns(writes); err != nil {
+		t.Errorf("writes rejected after check: %v", err)
+	}
+	RecordWrite(writes[1].key, entry, "socket")
+	err = CheckCooldowns(writes)
+	if err == nil || errorCode(err, "") != errorCooldown {
+		t.Errorf("expected cooldown error but got %v", err)
+	}
+}
+
+func TestCooldownMultiWrite(t *testing.T) {
+	setupSim(t)
+	SetProfiles(map[string][]ProfileEntry{
+		"low": {{Control: "rapl.pkg_limit_1", DeviceType: "socket", DeviceId: "*", Value: "100000"}},
+	})
+	setCooldowns(t, CooldownRule{Control: "rapl.pkg_limit_1", Interval: "1h"})
+	CaptureBaseline()
+
+	// The first write starts the cooldown of socket 1
+	if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "1", "120000"), RequestContext{}); level != "INFO" {
+		t.Fatalf("PUT failed: %s", msg)
+	}
+	tests := []struct {
+		name    string
+		request string
+		value   string
+	}{
+		{"profile", "profile", "low"},
+		{"restore", "restore", "0"},
+	}
+	for _, tc := range tests {
+		level, code, msg := process(t, newRequest(t, tc.request, "node", "0", tc.value), RequestContext{})
+		if level != "ERROR" || code != errorCooldown {
+			t.Errorf("%s: expected cooldown error but got %s '%s': %s", tc.name, level, code, msg)
+		}
+	}
+	if _, _, value := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", "0", ""), RequestContext{}); value != "150000" {
+		t.Errorf("rejected profile changed socket 0 to '%s'", value)
+	}
+
+	// The restore on shutdown ignores cooldowns
+	restored, err := RestoreBaseline("", "", "", requesterShutdown, true)
+	if err != nil || restored != 1 {
+		t.Errorf("expected 1 value restored on shutdown but got %d: %v", restored, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &RateLimiter{buckets: make(map[string]*tokenBucket)}
+	if !l.Allow("alice") {
+		t.Errorf("request rejected without rate limit")
+	}
+
+	l.SetRateLimit(0.001, 2)
+	tests := []struct {
+		requester string
+		allowed   bool
+	}{
+		{"alice", true},
+		{"alice", true},
+		{"alice", false},
+		{"bob", true},
+		{RateLimitKey("", "_INBOX.abc.1"), true},
+		{RateLimitKey("", "_INBOX.abc.2"), true},
+		{RateLimitKey("", "_INBOX.abc.3"), false},
+		{RateLimitKey("", "_INBOX.def.1"), true},
+	}
+	for i, tc := range tests {
+		if allowed := l.Allow(tc.requester); allowed != tc.allowed {
+			t.Errorf("request %d of '%s': expected %v but got %v", i, tc.requester, tc.allowed, allowed)
+		}
+	}
+
+	// Without burst, the rate rounded up is allowed at once
+	l.SetRateLimit(2.5, 0)
+	for i := range 3 {
+		if !l.Allow("carol") {
+			t.Errorf("request %d rejected within burst", i)
+		}
+	}
+	if l.Allow("carol") {
+		t.Errorf("request accepted above burst")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := &RateLimiter{buckets: make(map[string]*tokenBucket)}
+	l.SetRateLimit(1, 2)
+	for _, requester := range []string{"alice", "bob", RateLimitKey("", "_INBOX.abc.1")} {
+		l.Allow(requester)
+	}
+
+	// alice is still refilling, the other buckets are full again
+	now := time.Now()
+	l.buckets["alice"].last = now
+	l.buckets["bob"].last = now.Add(-2 * time.Second)
+	l.buckets["reply:_INBOX.abc"].last = now.Add(-time.Hour)
+	l.prune(now)
+	if len(l.buckets) != 1 || l.buckets["alice"] == nil {
+		t.Errorf("expected only the bucket of alice but got %v", l.buckets)
+	}
+	if !l.nextPrune.After(now) {
+		t.Errorf("next pruning not scheduled")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		identity string
+		reply    string
+		expected string
+	}{
+		{"alice", "_INBOX.abc.1", "alice"},
+		{"", "_INBOX.abc.1", "reply:_INBOX.abc"},
+		{"", "_INBOX", "reply:_INBOX"},
+		{"", "", "reply:"},
+	}
+	for _, tc := range tests {
+		if key := RateLimitKey(tc.identity, tc.reply); key != tc.expected {
+			t.Errorf("(%s, %s): expected '%s' but got '%s'", tc.identity, tc.reply, tc.expected, key)
+		}
+	}
+}
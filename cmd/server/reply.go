@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+)
+
+// Error codes of ERROR replies. They are sent in the tag 'error' and in the
+// field 'error' of structured replies.
+const (
+	errorNoSuchControl  = "no-such-control"
+	errorNoSuchDevice   = "no-such-device"
+	errorPermission     = "permission"
+	errorReadOnly       = "readonly"
+	errorWriteOnly      = "writeonly"
+	errorInvalidValue   = "invalid-value"
+	errorInvalidRequest = "invalid-request"
+	errorBackendFailure = "backend-failure"
+	errorCooldown       = "cooldown"
+	errorRateLimit      = "ratelimit"
+	errorNoSuchLease    = "no-such-lease"
+	errorNoSuchProfile  = "no-such-profile"
+)
+
+// codeError attaches the error code of the reply to an error
+type codeError struct {
+	code string
+	err  error
+}
+
+func (e *codeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codeError) Unwrap() error {
+	return e.err
+}
+
+// withErrorCode returns err with the error code sent in the reply
+func withErrorCode(code string, err error) error {
+	return &codeError{code: code, err: err}
+}
+
+// errorCode returns the error code attached to err. Errors without code get
+// fallback.
+func errorCode(err error, fallback string) string {
+	var ce *codeError
+	switch {
+	case errors.As(err, &ce):
+		return ce.code
+	case errors.Is(err, ErrPermissionDenied):
+		return errorPermission
+	case errors.Is(err, errNoSuchDevice):
+		return errorNoSuchDevice
+	}
+	return fallback
+}
+
+// ControlResult is the payload of structured replies to control requests with
+// the tag 'format=json'
+type ControlResult struct {
+	Control    string    `json:"control"` // Namespaced name <provider>/<category>.<name> if the control exists
+	DeviceType string    `json:"device_type"`
+	DeviceId   string    `json:"device_id"`
+	Value      string    `json:"value,omitempty"`     // Value read or written, the effective value if verified
+	Requested  string    `json:"requested,omitempty"` // Requested value of verified PUT requests
+	Unit       string    `json:"unit,omitempty"`
+	Min        string    `json:"min,omitempty"`      // Minimal value of a fan-out GET request, if all values are numeric
+	Max        string    `json:"max,omitempty"`      // Maximal value of a fan-out GET request, if all values are numeric
+	Uniform    *bool     `json:"uniform,omitempty"`  // Whether all values of a fan-out GET request are equal
+	Devices    int       `json:"devices,omitempty"`  // Number of hwthreads of a fan-out request
+	Deferred   string    `json:"deferred,omitempty"` // End of the cooldown a coalesced PUT request is deferred to
+	Timestamp  time.Time `json:"timestamp"`          // Time the value was read or written
+	Error      string    `json:"error,omitempty"`    // Error code
+	Message    string    `json:"message,omitempty"`  // Human-readable message
+}
+
+// newControlResult creates the result of a request with the control and device
+// given in the request
+func newControlResult(request lp.CCMessage) ControlResult {
+	deviceType, _ := request.GetTag("type")
+	deviceId, _ := request.GetTag("type-id")
+	return ControlResult{
+		Control:    request.Name(),
+		DeviceType: deviceType,
+		DeviceId:   deviceId,
+	}
+}
+
+// makeControlReply creates the reply of a control request. Requests with the tag
+// 'format=json' get the JSON encoded result as log value, all others msg.
+func makeControlReply(request lp.CCMessage, level string, result ControlResult, msg string) (lp.CCMessage, error) {
+	logMsg := msg
+	if format, _ := request.GetTag("format"); format == "json" {
+		if msg != result.Value {
+			result.Message = msg
+		}
+		if result.Timestamp.IsZero() {
+			result.Timestamp = time.Now()
+		}
+		payload, err := json.Marshal(result)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encode reply: %w", err)
+		}
+		logMsg = string(payload)
+	}
+	resp, err := lp.NewLog(request.Name(), request.Tags(), request.Meta(), logMsg, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create log message: %w", err)
+	}
+	resp.AddTag("level", level)
+	if len(result.Error) > 0 {
+		resp.AddTag("error", result.Error)
+	}
+	return resp, nil
+}
+
+// makeErrorCodeReply creates an ERROR reply with the tag 'error' set to code, so
+// clients can distinguish errors like denied permissions
+func makeErrorCodeReply(request lp.CCMessage, code string, err error) (lp.CCMessage, error) {
+	result := newControlResult(request)
+	result.Error = code
+	return makeControlReply(request, "ERROR", result, err.Error())
+}
+
+// backendErrorCode returns the error code of a failed provider call. Providers
+// report unknown devices like any other failure, so the device is checked
+// against the local topology.
+func backendErrorCode(deviceType, deviceId string) string {
+	if !deviceExists(deviceType, deviceId) {
+		return errorNoSuchDevice
+	}
+	return errorBackendFailure
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+)
+
+const stateVersion = 1
+
+// State is the persistent state of cc-node-controller. It is written to the
+// state file on every change and reloaded on startup.
+type State struct {
+	Version  int             `json:"version"`
+	BootId   string          `json:"boot_id"` // To detect reboots, the baseline is captured again after a reboot
+	Saved    time.Time       `json:"saved"`
+	Baseline []BaselineEntry `json:"baseline"`
+	Leases   []Lease         `json:"leases"`
+	// Desired values set by requests, the configured ones are read from the configuration
+	Desired []DesiredValue  `json:"desired"`
+	Profile *AppliedProfile `json:"profile,omitempty"` // Last applied profile
+}
+
+var (
+	stateLock     sync.Mutex
+	stateFilename string
+	stateDirty    = make(chan struct{}, 1)
+)
+
+// readBootId returns the ID of the current boot or an empty string if unknown
+func readBootId() string {
+	data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SetStateFile sets the file the state is written to. An empty filename disables
+// the persistent state.
+func SetStateFile(filename string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	stateFilename = filename
+}
+
+// StateChanged marks the state as changed, so it is written by the state saver.
+// It does not block and may be called while holding other locks.
+func StateChanged() {
+	select {
+	case stateDirty <- struct{}{}:
+	default:
+	}
+}
+
+// collectState takes a snapshot of the current state
+func collectState() State {
+	s := State{
+		Version: stateVersion,
+		BootId:  readBootId(),
+		Saved:   time.Now(),
+	}
+
+	baselineMutex.Lock()
+	s.Baseline = append([]BaselineEntry{}, baseline...)
+	baselineMutex.Unlock()
+
+	leasesMutex.Lock()
+	s.Leases = make([]Lease, 0, len(leases))
+	for _, l := range leases {
+		s.Leases = append(s.Leases, *l)
+	}
+	leasesMutex.Unlock()
+
+	desiredLock.Lock()
+	s.Desired = make([]DesiredValue, 0)
+	for _, d := range desiredState {
+		if d.Runtime {
+			s.Desired = append(s.Desired, d)
+		}
+	}
+	desiredLock.Unlock()
+
+	profilesLock.RLock()
+	if appliedProfile != nil {
+		p := *appliedProfile
+		s.Profile = &p
+	}
+	profilesLock.RUnlock()
+	return s
+}
+
+// SaveState writes the current state to the state file. The file is replaced
+// atomically, so it is never left partially written.
+func SaveState() error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if len(stateFilename) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(collectState(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode state: %w", err)
+	}
+
+	dir := filepath.Dir(stateFilename)
+	tmp, err := os.CreateTemp(dir, filepath.Base(stateFilename)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary state file in %s: %w", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write state file %s: %w", tmp.Name(), err)
+	}
+	err = os.Rename(tmp.Name(), stateFilename)
+	if err != nil {
+		return fmt.Errorf("Failed to replace state file %s: %w", stateFilename, err)
+	}
+	// Persist the rename
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// LoadState reads the state file. If there is no state file, it returns nil.
+func LoadState(filename string) (*State, error) {
+	if len(filename) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read state file %s: %w", filename, err)
+	}
+	var s State
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse state file %s: %w", filename, err)
+	}
+	if s.Version != stateVersion {
+		return nil, fmt.Errorf("Unsupported version %d of state file %s", s.Version, filename)
+	}
+	return &s, nil
+}
+
+// startState validates the desired state and the reconcile interval of the
+// configuration, recovers the state of a previous run and starts the state
+// saver afterwards. If the configuration is invalid, the state file is left
+// untouched. The returned function stops the state saver.
+func startState(config Config) (func(), time.Duration, error) {
+	desired, err := ExpandDesiredState(config.DesiredState)
+	if err != nil {
+		return nil, 0, err
+	}
+	interval, err := time.ParseDuration(config.ReconcileInterval)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid reconcileInterval: %w", err)
+	}
+
+	SetStateFile(config.StateFile)
+	state, err := LoadState(config.StateFile)
+	if err != nil {
+		cclog.ComponentError("CONFIG", "Ignoring state of previous run:", err.Error())
+	}
+	cclog.ComponentDebug("CONFIG", "Recovering or capturing baseline")
+	RecoverBaseline(state)
+	SetDesiredState(desired)
+	RecoverState(state)
+	return StartStateSaver(), interval, nil
+}
+
+// StartStateSaver writes the state whenever it changed. The returned function
+// stops the saver after writing the state a last time.
+func StartStateSaver() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	save := func() {
+		if err := SaveState(); err != nil {
+			cclog.ComponentError("State", err.Error())
+		}
+	}
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stateDirty:
+				save()
+			case <-stop:
+				save()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// RecoverBaseline takes the baseline from the state of a previous run, because
+// the current values may contain changes of the previous run. After a reboot or
+// without state, the baseline is captured again.
+func RecoverBaseline(s *State) {
+	if s == nil || len(s.Baseline) == 0 {
+		CaptureBaseline()
+		return
+	}
+	if bootId := readBootId(); len(bootId) > 0 && len(s.BootId) > 0 && bootId != s.BootId {
+		cclog.ComponentInfo("State", "Node was rebooted since the state was saved, capturing baseline")
+		CaptureBaseline()
+		return
+	}
+
+	entries := make([]BaselineEntry, 0, len(s.Baseline))
+	for _, b := range s.Baseline {
+		provider, entry, err := ccprovider.Lookup(b.Control)
+		if err != nil {
+			cclog.ComponentWarn("State", "Dropping baseline of", b.Control, ":", err.Error())
+			continue
+		}
+		if _, err := provider.Get(entry.Control(), b.DeviceType, b.DeviceId); err != nil {
+			cclog.ComponentWarn("State", "Dropping baseline of", b.Control, "for device", b.DeviceType, b.DeviceId, ":", err.Error())
+			continue
+		}
+		entries = append(entries, b)
+	}
+	baselineMutex.Lock()
+	baseline = entries
+	baselineMutex.Unlock()
+	cclog.ComponentInfo("State", "Recovered baseline with", len(entries), "values")
+	StateChanged()
+}
+
+// RecoverState restores leases, desired values and the applied profile of a
+// previous run. Leases which expired meanwhile are reverted, leases whose value
+// was changed by someone else are dropped. The values of the last applied
+// profile are checked against the hardware.
+func RecoverState(s *State) {
+	if s == nil {
+		return
+	}
+	for _, l := range s.Leases {
+		recoverLease(l)
+	}
+	for _, d := range s.Desired {
+		if _, _, err := ccprovider.Lookup(d.Control); err != nil {
+			cclog.ComponentWarn("State", "Dropping desired value of", d.Control, ":", err.Error())
+			continue
+		}
+		AddDesiredValue(ControlKey(d.Control, d.DeviceType, d.DeviceId), d)
+	}
+	if s.Profile != nil {
+		profilesLock.Lock()
+		p := *s.Profile
+		appliedProfile = &p
+		profilesLock.Unlock()
+		checkAppliedProfile(p.Name)
+	}
+	StateChanged()
+}
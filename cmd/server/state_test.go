@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// saveTestState writes a state with a lease, a desired value and an applied
+// profile to a new state file and returns the filename
+func saveTestState(t *testing.T) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "state.json")
+	SetStateFile(filename)
+	CaptureBaseline()
+	leasesMutex.Lock()
+	leases[ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "1")] = &Lease{
+		Control:    "sysfeatures/rapl.pkg_limit_1",
+		DeviceType: "socket",
+		DeviceId:   "1",
+		Value:      "140000",
+		Previous:   "130000",
+		Expires:    time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+	leasesMutex.Unlock()
+	AddDesiredValue(ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "0"), DesiredValue{
+		Control:    "sysfeatures/rapl.pkg_limit_1",
+		DeviceType: "socket",
+		DeviceId:   "0",
+		Value:      "150000",
+		Mode:       desiredModeReport,
+	})
+	profilesLock.Lock()
+	appliedProfile = &AppliedProfile{Name: "default", Applied: time.Now().Truncate(time.Second)}
+	profilesLock.Unlock()
+	if err := SaveState(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return filename
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	setupSim(t)
+	filename := saveTestState(t)
+
+	s, err := LoadState(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(s.Baseline) == 0 {
+		t.Errorf("baseline not saved")
+	}
+	if len(s.Leases) != 1 || s.Leases[0].Value != "140000" || s.Leases[0].Previous != "130000" {
+		t.Errorf("unexpected leases %+v", s.Leases)
+	}
+	if len(s.Desired) != 1 || s.Desired[0].DeviceId != "0" || !s.Desired[0].Runtime {
+		t.Errorf("unexpected desired values %+v", s.Desired)
+	}
+	if s.Profile == nil || s.Profile.Name != "default" {
+		t.Errorf("unexpected profile %+v", s.Profile)
+	}
+
+	if s, err := LoadState(filepath.Join(t.TempDir(), "missing.json")); s != nil || err != nil {
+		t.Errorf("missing state file should return no state and no error")
+	}
+	broken := filepath.Join(t.TempDir(), "broken.json")
+	os.WriteFile(broken, []byte(`{"version": 99}`), 0o600)
+	if _, err := LoadState(broken); err == nil {
+		t.Errorf("unsupported state version accepted")
+	}
+}
+
+func TestStartStateInvalidConfig(t *testing.T) {
+	setupSim(t)
+	filename := saveTestState(t)
+	saved, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"interval", Config{StateFile: filename, ReconcileInterval: "soon"}},
+		{"desired state", Config{StateFile: filename, ReconcileInterval: "60s", DesiredState: []DesiredStateEntry{
+			{Control: "rapl.pkg_limit_9", DeviceType: "socket", DeviceId: "0", Value: "100000"},
+		}}},
+	}
+	for _, tc := range tests {
+		// Startup begins without state
+		resetServerState()
+		if _, _, err := startState(tc.config); err == nil {
+			t.Errorf("%s: invalid configuration accepted", tc.name)
+		}
+		current, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(current, saved) {
+			t.Errorf("%s: state file changed by failed startup", tc.name)
+		}
+	}
+
+	resetServerState()
+	stop, interval, err := startState(Config{StateFile: filename, ReconcileInterval: "30s"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stop()
+	if interval != 30*time.Second {
+		t.Errorf("expected interval 30s but got %v", interval)
+	}
+	if !HasLease(ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "1")) {
+		t.Errorf("lease not recovered")
+	}
+	s, err := LoadState(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(s.Leases) != 1 || len(s.Desired) != 1 || s.Profile == nil {
+		t.Errorf("recovered state not saved again: %+v", s)
+	}
+}
+
+func TestRestoreDropsLeasesAndDesiredValues(t *testing.T) {
+	setupSim(t)
+	CaptureBaseline()
+	ctx := RequestContext{}
+
+	requests := []struct {
+		deviceId string
+		tags     []string
+	}{
+		{"0", []string{"lease", "1h"}},
+		{"1", []string{"enforce", desiredModeCorrect}},
+	}
+	for _, r := range requests {
+		if level, _, msg := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", r.deviceId, "120000", r.tags...), ctx); level != "INFO" {
+			t.Fatalf("PUT failed: %s", msg)
+		}
+	}
+	if level, _, msg := process(t, newRequest(t, "restore", "node", "0", "0", "control", "rapl.pkg_limit_1"), ctx); level != "INFO" {
+		t.Fatalf("restore failed: %s", msg)
+	}
+
+	lease := ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "0")
+	desired := ControlKey("sysfeatures/rapl.pkg_limit_1", "socket", "1")
+	if HasLease(lease) {
+		t.Errorf("lease of %s not dropped by restore", lease)
+	}
+	desiredLock.Lock()
+	_, ok := desiredState[desired]
+	desiredLock.Unlock()
+	if ok {
+		t.Errorf("desired value of %s not dropped by restore", desired)
+	}
+	for deviceId, expected := range []string{"150000", "140000"} {
+		if _, _, value := process(t, newRequest(t, "rapl.pkg_limit_1", "socket", fmt.Sprint(deviceId), ""), ctx); value != expected {
+			t.Errorf("socket %d: expected baseline '%s' but got '%s'", deviceId, expected, value)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+)
+
+// WorkerPool processes jobs with a fixed number of workers. Jobs are distributed
+// by key and each worker processes its jobs in order of submission, so jobs with
+// the same key are strictly ordered while jobs with different keys may run in parallel.
+type WorkerPool struct {
+	queues    []chan func()
+	wg        sync.WaitGroup
+	lock      sync.RWMutex
+	exclusive sync.Mutex
+	closed    bool
+}
+
+// NewWorkerPool starts a pool of workers. Each worker queues up to queueSize jobs.
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WorkerPool{
+		queues: make([]chan func(), workers),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		p.wg.Add(1)
+		go func(queue chan func()) {
+			defer p.wg.Done()
+			for job := range queue {
+				job()
+			}
+		}(p.queues[i])
+	}
+	cclog.ComponentDebug("POOL", "Started", workers, "workers")
+	return p
+}
+
+// Submit queues a job for the worker responsible for key. It blocks if the queue
+// of the worker is full. Jobs submitted after Close are dropped.
+func (p *WorkerPool) Submit(key string, job func()) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		cclog.ComponentDebug("POOL", "Dropping job for", key, "after close")
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- job
+	return true
+}
+
+// SubmitExclusive queues a job that runs while no other job is processed. It runs
+// after all jobs queued before and before all jobs queued after it, whatever their
+// key. It blocks if the queue of any worker is full. Jobs submitted after Close
+// are dropped.
+func (p *WorkerPool) SubmitExclusive(job func()) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		cclog.ComponentDebug("POOL", "Dropping exclusive job after close")
+		return false
+	}
+	// Exclusive jobs have to be queued in the same order on all workers
+	p.exclusive.Lock()
+	defer p.exclusive.Unlock()
+
+	// All workers wait at the barrier, the first one runs the job
+	var arrived sync.WaitGroup
+	arrived.Add(len(p.queues))
+	done := make(chan struct{})
+	p.queues[0] <- func() {
+		arrived.Done()
+		arrived.Wait()
+		defer close(done)
+		job()
+	}
+	for _, queue := range p.queues[1:] {
+		queue <- func() {
+			arrived.Done()
+			<-done
+		}
+	}
+	return true
+}
+
+// Close stops accepting jobs and waits until all queued jobs are processed
+func (p *WorkerPool) Close() {
+	p.lock.Lock()
+	p.closed = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.lock.Unlock()
+	p.wg.Wait()
+	cclog.ComponentDebug("POOL", "Stopped all workers")
+}
+
+// ReplaceWorkerPool starts a new pool for background jobs and closes the old
+// pool. The new pool holds its jobs until the old pool processed all queued jobs,
+// so ordering per key is kept. Background jobs submitted meanwhile, also by the
+// jobs of the old pool, are queued to the new pool.
+func ReplaceWorkerPool(old *WorkerPool, workers, queueSize int) *WorkerPool {
+	p := NewWorkerPool(workers, queueSize)
+	drained := make(chan struct{})
+	p.SubmitExclusive(func() { <-drained })
+	SetBackgroundPool(p)
+	old.Close()
+	close(drained)
+	return p
+}
+
+var (
+	backgroundLock   sync.RWMutex
+	backgroundSubmit func(key string, job func()) bool
+)
+
+// SetBackgroundPool sets the pool used for jobs not triggered by requests, like
+// reverts of expired leases
+func SetBackgroundPool(p *WorkerPool) {
+	backgroundLock.Lock()
+	defer backgroundLock.Unlock()
+	backgroundSubmit = p.Submit
+}
+
+// SubmitBackground queues a job not triggered by a request, so it is ordered with
+// requests for the same key. If there is no pool or it is closed on shutdown, the
+// job is executed directly.
+func SubmitBackground(key string, job func()) {
+	backgroundLock.RLock()
+	submit := backgroundSubmit
+	backgroundLock.RUnlock()
+	if submit == nil || !submit(key, job) {
+		job()
+	}
+}
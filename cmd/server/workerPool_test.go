@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	const keys = 8
+	const jobs = 100
+	p := NewWorkerPool(4, 10)
+
+	var lock sync.Mutex
+	order := make(map[string][]int)
+	for i := range jobs {
+		for k := range keys {
+			key := fmt.Sprintf("cpu_freq.max_cpu_freq@hwthread-%d", k)
+			p.Submit(key, func() {
+				lock.Lock()
+				defer lock.Unlock()
+				order[key] = append(order[key], i)
+			})
+		}
+	}
+	p.Close()
+
+	if len(order) != keys {
+		t.Fatalf("expected jobs of %d keys but got %d", keys, len(order))
+	}
+	for key, seq := range order {
+		if len(seq) != jobs {
+			t.Errorf("%s: expected %d jobs but got %d", key, jobs, len(seq))
+			continue
+		}
+		for i, v := range seq {
+			if v != i {
+				t.Errorf("%s: job %d processed at position %d", key, v, i)
+				break
+			}
+		}
+	}
+
+	if p.Submit("cpu_freq.max_cpu_freq@hwthread-0", func() {}) {
+		t.Errorf("job accepted after close")
+	}
+	if p.SubmitExclusive(func() {}) {
+		t.Errorf("exclusive job accepted after close")
+	}
+}
+
+func TestWorkerPoolExclusive(t *testing.T) {
+	const jobs = 50
+	p := NewWorkerPool(4, 100)
+
+	var running, finished atomic.Int32
+	job := func() {
+		running.Add(1)
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		finished.Add(1)
+	}
+	for i := range jobs {
+		p.Submit(fmt.Sprintf("key-%d", i), job)
+	}
+	var exclusiveRunning, exclusiveFinished int32
+	p.SubmitExclusive(func() {
+		exclusiveRunning = running.Load()
+		exclusiveFinished = finished.Load()
+	})
+	for i := range jobs {
+		p.Submit(fmt.Sprintf("key-%d", i), job)
+	}
+	p.Close()
+
+	if exclusiveRunning != 0 {
+		t.Errorf("%d jobs running in parallel to the exclusive job", exclusiveRunning)
+	}
+	if exclusiveFinished != jobs {
+		t.Errorf("expected %d jobs finished before the exclusive job but got %d", jobs, exclusiveFinished)
+	}
+	if finished.Load() != 2*jobs {
+		t.Errorf("expected %d jobs finished but got %d", 2*jobs, finished.Load())
+	}
+}
+
+func TestReplaceWorkerPool(t *testing.T) {
+	old := NewWorkerPool(2, 10)
+	SetBackgroundPool(old)
+	defer func() {
+		backgroundLock.Lock()
+		backgroundSubmit = nil
+		backgroundLock.Unlock()
+	}()
+
+	var lock sync.Mutex
+	var order []int
+	add := func(i int) {
+		lock.Lock()
+		defer lock.Unlock()
+		order = append(order, i)
+	}
+	var inline atomic.Bool
+	old.Submit("key", func() {
+		time.Sleep(10 * time.Millisecond)
+		add(1)
+		// Submitted while the pool is replaced
+		var ran atomic.Bool
+		SubmitBackground("key", func() {
+			ran.Store(true)
+			add(3)
+		})
+		inline.Store(ran.Load())
+	})
+	old.Submit("key", func() { add(2) })
+	p := ReplaceWorkerPool(old, 3, 10)
+	SubmitBackground("key", func() { add(4) })
+	p.Close()
+
+	if inline.Load() {
+		t.Errorf("background job executed inline during the replacement")
+	}
+	if len(order) != 4 || order[0] != 1 || order[1] != 2 || order[2] != 3 || order[3] != 4 {
+		t.Errorf("unexpected order of jobs %v", order)
+	}
+}
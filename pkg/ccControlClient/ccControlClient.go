@@ -1,23 +1,114 @@
 package cccontrolclient
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
+	ccidentity "github.com/ClusterCockpit/cc-node-controller/pkg/ccIdentity"
 	topo "github.com/ClusterCockpit/cc-node-controller/pkg/ccTopology"
 	"github.com/nats-io/nats.go"
 )
 
+// ErrPermissionDenied is returned if the server denied a request because of
+// missing permissions of the identity
+var ErrPermissionDenied = errors.New("permission denied")
+
+// RequestIdTag is the tag with the unique ID of a request. The server echoes it
+// in all replies to the request and logs it.
+const RequestIdTag = "request-id"
+
+// Default reply timeouts if NatsConfig.RequestTimeout or NatsConfig.MultiRequestTimeout
+// are not set
+const (
+	DefaultRequestTimeout      = time.Second
+	DefaultMultiRequestTimeout = 10 * time.Second
+)
+
+// ValueMismatchError is returned if the server verified a PUT request and the
+// effective value differs from the requested value, e.g. because the hardware
+// rounded or clamped it. The value was written nevertheless.
+type ValueMismatchError struct {
+	Control   string
+	Requested string
+	Effective string
+}
+
+func (e *ValueMismatchError) Error() string {
+	return fmt.Sprintf("Control '%s' was set to '%s' instead of requested '%s'", e.Control, e.Effective, e.Requested)
+}
+
+// Error codes of failed requests, see ControlError
+const (
+	ErrorNoSuchControl  = "no-such-control"
+	ErrorNoSuchDevice   = "no-such-device"
+	ErrorPermission     = "permission"
+	ErrorReadOnly       = "readonly"
+	ErrorWriteOnly      = "writeonly"
+	ErrorInvalidValue   = "invalid-value"
+	ErrorInvalidRequest = "invalid-request"
+	ErrorBackendFailure = "backend-failure"
+	ErrorTimeout        = "timeout"
+	ErrorCooldown       = "cooldown"
+	ErrorRateLimit      = "ratelimit"
+	ErrorNoSuchLease    = "no-such-lease"
+	ErrorNoSuchProfile  = "no-such-profile"
+)
+
+// ControlError is returned if the server replied with an error code or did not
+// reply in time (ErrorTimeout)
+type ControlError struct {
+	Code      string
+	Message   string
+	RequestId string // ID of the failed request, if known
+}
+
+func (e *ControlError) Error() string {
+	if len(e.RequestId) > 0 {
+		return fmt.Sprintf("%s: %s (request-id %s)", e.Code, e.Message, e.RequestId)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is reports denied requests as ErrPermissionDenied
+func (e *ControlError) Is(target error) bool {
+	return target == ErrPermissionDenied && e.Code == ErrorPermission
+}
+
+// ControlResult is the structured reply to a control request
+type ControlResult struct {
+	Control    string    `json:"control"` // Namespaced name <provider>/<category>.<name> if the control exists
+	DeviceType string    `json:"device_type"`
+	DeviceId   string    `json:"device_id"`
+	Value      string    `json:"value,omitempty"`     // Value read or written, the effective value if verified
+	Requested  string    `json:"requested,omitempty"` // Requested value of verified PUT requests
+	Unit       string    `json:"unit,omitempty"`
+	Min        string    `json:"min,omitempty"`      // Minimal value of a fan-out GET request, if all values are numeric
+	Max        string    `json:"max,omitempty"`      // Maximal value of a fan-out GET request, if all values are numeric
+	Uniform    *bool     `json:"uniform,omitempty"`  // Whether all values of a fan-out GET request are equal
+	Devices    int       `json:"devices,omitempty"`  // Number of hwthreads of a fan-out request
+	Deferred   string    `json:"deferred,omitempty"` // End of the cooldown a coalesced PUT request is deferred to
+	Timestamp  time.Time `json:"timestamp"`          // Time the value was read or written
+	Error      string    `json:"error,omitempty"`    // Error code
+	Message    string    `json:"message,omitempty"`  // Human-readable message
+	Level      string    `json:"-"`                  // Level of the reply: INFO, WARN or ERROR
+	RequestId  string    `json:"-"`                  // ID of the request, see RequestIdTag
+}
+
 type CCControlListEntry struct {
+	Provider    string `json:"provider"`
 	Category    string `json:"category"`
 	Name        string `json:"name"`
 	DeviceType  string `json:"device_type"`
 	Description string `json:"description"`
+	Unit        string `json:"unit,omitempty"`
 	Methods     string `json:"methods"`
 }
 
@@ -31,9 +122,11 @@ type CCControlTopology struct {
 }
 
 type ccControlClient struct {
-	conn     *nats.Conn
-	hostname string
-	natsCfg  NatsConfig
+	conn                *nats.Conn
+	hostname            string
+	natsCfg             NatsConfig
+	requestTimeout      time.Duration
+	multiRequestTimeout time.Duration
 }
 
 type CCControlClient interface {
@@ -41,14 +134,35 @@ type CCControlClient interface {
 	GetControls(hostname string) (*CCControlList, error)
 	GetTopology(hostname string) (*CCControlTopology, error)
 	GetControlValue(hostname, control string, device string, deviceID string) (string, error)
+	// SetControlValue sets a control. Servers with verifyWrites read back every
+	// written value, so it returns a *ValueMismatchError if the effective value
+	// differs from value, even without requesting verification. The value was
+	// written nevertheless, use errors.As to tell this apart from failed writes.
 	SetControlValue(hostname, control string, device string, deviceID string, value string) error
+	SetControlValueVerified(hostname, control string, device string, deviceID string, value string) (string, error)
+	GetControlValues(hostname, control string, device string, deviceIDs string) (map[string]string, error)
+	SetControlValues(hostname, control string, device string, deviceIDs string, value string) error
+	GetControlResult(hostname, control string, device string, deviceID string) (*ControlResult, error)
+	SetControlResult(hostname, control string, device string, deviceID string, value string, verify bool) (*ControlResult, error)
+	ApplyProfile(hostname, profile string) error
+	GetControlValueHosts(hosts []string, control string, device string, deviceID string) (*HostResults[string], error)
+	// SetControlValueHosts sets a control on several hosts. The error of a host
+	// may be a *ValueMismatchError like for SetControlValue.
+	SetControlValueHosts(hosts []string, control string, device string, deviceID string, value string) (*HostResults[string], error)
+	ApplyProfileHosts(hosts []string, profile string) (*HostResults[string], error)
 	Close()
 }
 
 type NatsConfig struct {
-	Server         string `json:"server"`
-	Port           uint16 `json:"port"`
-	RequestSubject string `json:"requestSubject"`
+	Server         string   `json:"server"`
+	Port           uint16   `json:"port"`
+	Servers        []string `json:"servers,omitempty"`       // List of server URLs, replaces Server and Port
+	ReconnectWait  string   `json:"reconnectWait,omitempty"` // Time between reconnect attempts, e.g. '2s'
+	MaxReconnects  int      `json:"maxReconnects,omitempty"` // Maximal reconnect attempts, negative for unlimited
+	RequestSubject string   `json:"requestSubject"`
+	// If set, requests are sent to the per-host subject <prefix>.<hostname>
+	// instead of RequestSubject
+	RequestSubjectPrefix string `json:"requestSubjectPrefix,omitempty"`
 	// TODO actually implement ReplySubject. Currently, we use NATS request/reply,
 	// which by default uses subject `_INBOX.XXXXXXXXX` as reply subject.
 	// However, this is difficult to restrict in terms of permissions.
@@ -57,6 +171,19 @@ type NatsConfig struct {
 	Password     string `json:"password"`
 	CredsFile    string `json:"credsFile"`
 	NKeySeedFile string `json:"nkeySeedFile"`
+	// Identity sent with each request. If IdentitySecret is set, a signed token
+	// is sent, otherwise the identity is sent in plain text.
+	Identity       string `json:"identity,omitempty"`
+	IdentitySecret string `json:"identitySecret,omitempty"`
+	// Maximal number of concurrent requests of the multi-host methods, default DefaultParallelism
+	Parallelism int `json:"parallelism,omitempty"`
+	// Time to wait for the reply to a request for a single device, e.g. '2s',
+	// default DefaultRequestTimeout
+	RequestTimeout string `json:"requestTimeout,omitempty"`
+	// Time to wait for the reply to a request that touches several devices (device
+	// sets, devices containing several hwthreads, profiles, restores and batches),
+	// default DefaultMultiRequestTimeout
+	MultiRequestTimeout string `json:"multiRequestTimeout,omitempty"`
 }
 
 func NewCCControlClient(natsConfig NatsConfig) (CCControlClient, error) {
@@ -84,16 +211,41 @@ func (c *ccControlClient) Init(natsCfg NatsConfig) error {
 
 	c.natsCfg = natsCfg
 	c.hostname = h
+	c.requestTimeout, err = parseTimeout(natsCfg.RequestTimeout, DefaultRequestTimeout)
+	if err != nil {
+		return fmt.Errorf("Unable to parse RequestTimeout '%s': %w", natsCfg.RequestTimeout, err)
+	}
+	c.multiRequestTimeout, err = parseTimeout(natsCfg.MultiRequestTimeout, DefaultMultiRequestTimeout)
+	if err != nil {
+		return fmt.Errorf("Unable to parse MultiRequestTimeout '%s': %w", natsCfg.MultiRequestTimeout, err)
+	}
 	return c.connect()
 }
 
+// parseTimeout parses a positive timeout, an empty string returns the default
+func parseTimeout(timeout string, def time.Duration) (time.Duration, error) {
+	if len(timeout) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("timeout must be positive")
+	}
+	return d, nil
+}
+
 func (c *ccControlClient) Close() {
 	c.conn.Close()
 }
 
 func (c *ccControlClient) connect() error {
 	addr := nats.DefaultURL
-	if len(c.natsCfg.Server) > 0 {
+	if len(c.natsCfg.Servers) > 0 {
+		addr = strings.Join(c.natsCfg.Servers, ",")
+	} else if len(c.natsCfg.Server) > 0 {
 		addr = c.natsCfg.Server
 		if c.natsCfg.Port > 0 {
 			addr = fmt.Sprintf("nats://%s:%d", addr, c.natsCfg.Port)
@@ -114,6 +266,35 @@ func (c *ccControlClient) connect() error {
 		}
 		options = append(options, r)
 	}
+	if len(c.natsCfg.ReconnectWait) > 0 {
+		wait, err := time.ParseDuration(c.natsCfg.ReconnectWait)
+		if err != nil {
+			return fmt.Errorf("Unable to parse ReconnectWait '%s': %w", c.natsCfg.ReconnectWait, err)
+		}
+		options = append(options, nats.ReconnectWait(wait))
+	}
+	if c.natsCfg.MaxReconnects != 0 {
+		options = append(options, nats.MaxReconnects(c.natsCfg.MaxReconnects))
+	}
+	options = append(options,
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				cclog.ComponentWarn("CCControlClient", "Disconnected from", nc.ConnectedUrlRedacted(), ":", err.Error())
+			} else {
+				cclog.ComponentWarn("CCControlClient", "Disconnected")
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			cclog.ComponentInfo("CCControlClient", "Reconnected to", nc.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			if err := nc.LastError(); err != nil {
+				cclog.ComponentError("CCControlClient", "Connection closed:", err.Error())
+			} else {
+				cclog.ComponentDebug("CCControlClient", "Connection closed")
+			}
+		}),
+	)
 
 	conn, err := nats.Connect(addr, options...)
 	if err != nil {
@@ -126,31 +307,224 @@ func (c *ccControlClient) connect() error {
 	return nil
 }
 
-func (c *ccControlClient) sendRequestAndCheckReply(request lp.CCMessage) (value, level string, err error) {
-	resp, err := c.conn.Request(c.natsCfg.RequestSubject, []byte(request.ToLineProtocol(nil)), time.Second)
+// requestSubject returns the subject to address a host
+func (c *ccControlClient) requestSubject(hostname string) string {
+	if len(c.natsCfg.RequestSubjectPrefix) > 0 {
+		return fmt.Sprintf("%s.%s", c.natsCfg.RequestSubjectPrefix, hostname)
+	}
+	return c.natsCfg.RequestSubject
+}
+
+// controlReply is the checked content of a single reply line
+type controlReply struct {
+	value     string
+	level     string
+	deviceId  string
+	code      string // Error code of ERROR replies
+	effective string // Value read back by the server, if it verified a PUT request
+	requestId string
+}
+
+// err returns a *ControlError if the reply has an error code, otherwise an
+// error with the reply value
+func (r controlReply) err() error {
+	if len(r.code) > 0 {
+		return &ControlError{
+			Code:      r.code,
+			Message:   r.value,
+			RequestId: r.requestId,
+		}
+	}
+	return errors.New(r.value)
+}
+
+// sendRequestsAndCheckReplies sends all requests as one multi-line batch request.
+// The server replies with one multi-line reply containing a reply for each request
+// in request order.
+func (c *ccControlClient) sendRequestsAndCheckReplies(requests []lp.CCMessage) ([]controlReply, error) {
+	replyList, err := c.sendRequests(requests)
 	if err != nil {
-		err = fmt.Errorf("NATS Request on subject '%s' failed: %w", c.natsCfg.RequestSubject, err)
-		return
+		return nil, err
+	}
+
+	if len(replyList) != len(requests) {
+		return nil, fmt.Errorf("Received reply with %d CCMessages for %d requests", len(replyList), len(requests))
+	}
+
+	out := make([]controlReply, 0, len(replyList))
+	for i, reply := range replyList {
+		r, err := newControlReply(requests[i], reply)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// sendDeviceSetRequest sends a request for a set of devices. The server replies
+// with one reply per device.
+func (c *ccControlClient) sendDeviceSetRequest(request lp.CCMessage) ([]controlReply, error) {
+	replyList, err := c.sendRequests([]lp.CCMessage{request})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]controlReply, 0, len(replyList))
+	for _, reply := range replyList {
+		r, err := newControlReply(request, reply)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// newRequestId creates a random request ID
+func newRequestId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create request ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isMultiDeviceRequest checks whether the server processes a request on several
+// devices: a device set, a device containing several hwthreads or a request writing
+// many controls
+func isMultiDeviceRequest(request lp.CCMessage) bool {
+	switch request.Name() {
+	case "profile", "restore":
+		return true
+	}
+	deviceType, _ := request.GetTag("type")
+	deviceId, _ := request.GetTag("type-id")
+	switch deviceType {
+	case "node", "socket", "numa", "memoryDomain", "die", "core":
+		return true
+	}
+	return deviceId == "*" || strings.ContainsAny(deviceId, ",-")
+}
+
+// timeout returns the time to wait for the reply to a batch of requests
+func (c *ccControlClient) timeout(requests []lp.CCMessage) time.Duration {
+	if len(requests) > 1 || isMultiDeviceRequest(requests[0]) {
+		return c.multiRequestTimeout
+	}
+	return c.requestTimeout
+}
+
+// sendRequests sends all requests as one multi-line batch request and returns
+// the lines of the reply. Requests without request ID get a new one, so the
+// replies can be correlated with the requests.
+func (c *ccControlClient) sendRequests(requests []lp.CCMessage) ([]lp.CCMessage, error) {
+	lines := make([]string, 0, len(requests))
+	for _, r := range requests {
+		if _, ok := r.GetTag(RequestIdTag); !ok {
+			id, err := newRequestId()
+			if err != nil {
+				return nil, err
+			}
+			r.AddTag(RequestIdTag, id)
+		}
+		lines = append(lines, r.ToLineProtocol(nil))
+	}
+
+	hostname, _ := requests[0].GetTag("hostname")
+	subject := c.requestSubject(hostname)
+	msg := nats.NewMsg(subject)
+	msg.Data = []byte(strings.Join(lines, "\n"))
+	if len(c.natsCfg.Identity) > 0 {
+		if len(c.natsCfg.IdentitySecret) > 0 {
+			// Each request message gets a token of its own, bound to its payload and host
+			tokenId, err := newRequestId()
+			if err != nil {
+				return nil, err
+			}
+			token, err := ccidentity.NewToken(c.natsCfg.Identity, c.natsCfg.IdentitySecret, time.Now().Add(ccidentity.DefaultTokenValidity), tokenId, hostname, msg.Data)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to create token: %w", err)
+			}
+			msg.Header.Set(ccidentity.TokenHeader, token)
+		} else {
+			msg.Header.Set(ccidentity.IdentityHeader, c.natsCfg.Identity)
+		}
+	}
+	cclog.ComponentDebug("CCControlClient", "Sending request to", subject, ":", string(msg.Data))
+	resp, err := c.conn.RequestMsg(msg, c.timeout(requests))
+	if errors.Is(err, nats.ErrTimeout) {
+		cerr := &ControlError{
+			Code:    ErrorTimeout,
+			Message: fmt.Sprintf("No reply on subject '%s'", subject),
+		}
+		if len(requests) == 1 {
+			cerr.RequestId, _ = requests[0].GetTag(RequestIdTag)
+		}
+		return nil, cerr
+	} else if err != nil {
+		return nil, fmt.Errorf("NATS Request on subject '%s' failed: %w", subject, err)
 	}
 
 	replyList, err := NatsReceive(resp)
 	if err != nil {
-		err = fmt.Errorf("NatsReceive failed: %w", err)
-		return
+		return nil, fmt.Errorf("NatsReceive failed: %w", err)
 	}
 
 	if len(replyList) == 0 {
-		err = fmt.Errorf("Received reply with no CCMessage")
+		return nil, fmt.Errorf("Received reply with no CCMessage")
+	}
+	return replyList, nil
+}
+
+// newControlReply checks a reply line and extracts its content
+func newControlReply(request, reply lp.CCMessage) (controlReply, error) {
+	value, level, err := checkReply(request, reply)
+	if err != nil {
+		return controlReply{}, err
+	}
+	deviceId, _ := reply.GetTag("type-id")
+	code, _ := reply.GetTag("error")
+	effective, _ := reply.GetTag("effective")
+	requestId, _ := reply.GetTag(RequestIdTag)
+	return controlReply{
+		value:     value,
+		level:     level,
+		deviceId:  deviceId,
+		code:      code,
+		effective: effective,
+		requestId: requestId,
+	}, nil
+}
+
+func (c *ccControlClient) sendRequestAndCheckReply(request lp.CCMessage) (value, level string, err error) {
+	replies, err := c.sendRequestsAndCheckReplies([]lp.CCMessage{request})
+	if err != nil {
 		return
 	}
+	return replies[0].value, replies[0].level, nil
+}
 
-	if len(replyList) > 1 {
-		cclog.ComponentError("Received reply with more than one CCMessage:", replyList)
+// checkReply checks that a reply belongs to the request and returns its value and
+// level. If the request has a request ID, the reply must have the same. ERROR
+// replies, also denied requests, are valid replies, their error is returned by
+// controlReply.err after decoding.
+func checkReply(request, reply lp.CCMessage) (value, level string, err error) {
+	if requestId, ok := request.GetTag(RequestIdTag); ok {
+		replyId, ok := reply.GetTag(RequestIdTag)
+		if !ok {
+			err = fmt.Errorf("Received reply without request-id, expected '%s': %v", requestId, reply)
+			return
+		}
+		if replyId != requestId {
+			err = fmt.Errorf("Received reply request-id '%s' mismatches expected '%s': %v", replyId, requestId, reply)
+			return
+		}
 	}
 
-	reply := replyList[0]
 	if reply.Name() != request.Name() {
-		err = fmt.Errorf("Received reply name '%s' mismatches expected 'controls': %v", reply.Name(), reply)
+		err = fmt.Errorf("Received reply name '%s' mismatches expected '%s': %v", reply.Name(), request.Name(), reply)
 		return
 	}
 
@@ -247,38 +621,259 @@ func (c *ccControlClient) GetControlValue(hostname, control string, device strin
 		return "", fmt.Errorf("Failed to create message to '%s' to get controls: %w", hostname, err)
 	}
 
-	value, level, err := c.sendRequestAndCheckReply(request)
+	replies, err := c.sendRequestsAndCheckReplies([]lp.CCMessage{request})
 	if err != nil {
 		return "", fmt.Errorf("Request failed: %w", err)
 	}
+	reply := replies[0]
 
-	if level == "INFO" {
-		return value, nil
+	if reply.level == "INFO" {
+		return reply.value, nil
 	} else {
-		return "", fmt.Errorf("Getting control '%s' from host '%s' failed: %s", control, hostname, value)
+		return "", fmt.Errorf("Getting control '%s' from host '%s' failed: %w", control, hostname, reply.err())
 	}
 }
 
+// GetControlValues reads a control on a set of devices. deviceIDs is '*' for all
+// devices of the type or a list like '0-15,32-47'. It returns the values by device
+// ID. Devices that could not be read are missing in the result and reported in
+// the error.
+func (c *ccControlClient) GetControlValues(hostname, control string, device string, deviceIDs string) (map[string]string, error) {
+	tags := map[string]string{
+		"hostname": hostname,
+		"method":   "GET",
+		"type":     device,
+		"type-id":  deviceIDs,
+	}
+
+	request, err := lp.NewGetControl(control, tags, nil, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create message to '%s' to get controls: %w", hostname, err)
+	}
+
+	replies, err := c.sendDeviceSetRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("Request failed: %w", err)
+	}
+
+	values := make(map[string]string, len(replies))
+	errs := make([]error, 0)
+	for _, reply := range replies {
+		if reply.level == "INFO" {
+			values[reply.deviceId] = reply.value
+		} else {
+			errs = append(errs, fmt.Errorf("Device '%s-%s': %w", device, reply.deviceId, reply.err()))
+		}
+	}
+	if len(errs) > 0 {
+		return values, fmt.Errorf("Getting control '%s' from host '%s' failed for %d devices: %w", control, hostname, len(errs), errors.Join(errs...))
+	}
+	return values, nil
+}
+
+// GetControlResult reads a control and returns the structured reply of the
+// server. If the server replied with an error, the result is returned together
+// with a *ControlError.
+func (c *ccControlClient) GetControlResult(hostname, control string, device string, deviceID string) (*ControlResult, error) {
+	tags := map[string]string{
+		"hostname": hostname,
+		"method":   "GET",
+		"type":     device,
+		"type-id":  deviceID,
+		"format":   "json",
+	}
+
+	request, err := lp.NewGetControl(control, tags, nil, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create message to '%s' to get controls: %w", hostname, err)
+	}
+
+	replies, err := c.sendRequestsAndCheckReplies([]lp.CCMessage{request})
+	if err != nil {
+		return nil, fmt.Errorf("Request failed: %w", err)
+	}
+	return decodeResult(replies[0])
+}
+
+// SetControlValue sets a control. If the server verifies all writes, a differing
+// effective value is returned as *ValueMismatchError.
 func (c *ccControlClient) SetControlValue(hostname, control string, device string, deviceID string, value string) error {
+	_, err := c.setControlValue(hostname, control, device, deviceID, value, false)
+	return err
+}
+
+// SetControlValueVerified sets a control and lets the server read it back. It
+// returns the effective value and a *ValueMismatchError if it differs from value.
+func (c *ccControlClient) SetControlValueVerified(hostname, control string, device string, deviceID string, value string) (string, error) {
+	return c.setControlValue(hostname, control, device, deviceID, value, true)
+}
+
+func (c *ccControlClient) setControlValue(hostname, control string, device string, deviceID string, value string, verify bool) (string, error) {
 	tags := map[string]string{
 		"hostname": hostname,
 		"method":   "PUT",
 		"type":     device,
 		"type-id":  deviceID,
 	}
+	if verify {
+		tags["verify"] = "true"
+	}
+
+	request, err := lp.NewPutControl(control, tags, nil, value, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("Failed to create control message to '%s' to set control: %w", hostname, err)
+	}
+
+	replies, err := c.sendRequestsAndCheckReplies([]lp.CCMessage{request})
+	if err != nil {
+		return "", fmt.Errorf("Request failed: %w", err)
+	}
+	reply := replies[0]
+
+	if reply.level == "ERROR" {
+		return "", fmt.Errorf("Setting control '%s' from host '%s' to value '%s' failed: %w", control, hostname, value, reply.err())
+	}
+
+	// Servers verify all PUT requests if configured, so a mismatch may also be
+	// reported without verify. The server replies with WARN on mismatch.
+	if len(reply.effective) > 0 && reply.level == "WARN" {
+		return reply.effective, &ValueMismatchError{
+			Control:   control,
+			Requested: value,
+			Effective: reply.effective,
+		}
+	}
+	if len(reply.effective) == 0 {
+		return value, nil
+	}
+	return reply.effective, nil
+}
+
+// SetControlValues sets a control on a set of devices, see GetControlValues.
+// Devices that could not be set are reported in the error, effective values
+// differing from value as *ValueMismatchError.
+func (c *ccControlClient) SetControlValues(hostname, control string, device string, deviceIDs string, value string) error {
+	tags := map[string]string{
+		"hostname": hostname,
+		"method":   "PUT",
+		"type":     device,
+		"type-id":  deviceIDs,
+	}
 
 	request, err := lp.NewPutControl(control, tags, nil, value, time.Now())
 	if err != nil {
 		return fmt.Errorf("Failed to create control message to '%s' to set control: %w", hostname, err)
 	}
 
-	value, level, err := c.sendRequestAndCheckReply(request)
+	replies, err := c.sendDeviceSetRequest(request)
+	if err != nil {
+		return fmt.Errorf("Request failed: %w", err)
+	}
+
+	errs := make([]error, 0)
+	for _, reply := range replies {
+		if reply.level == "ERROR" {
+			errs = append(errs, fmt.Errorf("Device '%s-%s': %w", device, reply.deviceId, reply.err()))
+		} else if len(reply.effective) > 0 && reply.level == "WARN" {
+			errs = append(errs, fmt.Errorf("Device '%s-%s': %w", device, reply.deviceId, &ValueMismatchError{
+				Control:   control,
+				Requested: value,
+				Effective: reply.effective,
+			}))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Setting control '%s' on host '%s' to value '%s' failed for %d devices: %w", control, hostname, value, len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// SetControlResult sets a control and returns the structured reply of the
+// server. With verify, the server reads the control back and the result contains
+// the effective value. If the server replied with an error, the result is
+// returned together with a *ControlError, if the effective value differs, with
+// a *ValueMismatchError.
+func (c *ccControlClient) SetControlResult(hostname, control string, device string, deviceID string, value string, verify bool) (*ControlResult, error) {
+	tags := map[string]string{
+		"hostname": hostname,
+		"method":   "PUT",
+		"type":     device,
+		"type-id":  deviceID,
+		"format":   "json",
+	}
+	if verify {
+		tags["verify"] = "true"
+	}
+
+	request, err := lp.NewPutControl(control, tags, nil, value, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create control message to '%s' to set control: %w", hostname, err)
+	}
+
+	replies, err := c.sendRequestsAndCheckReplies([]lp.CCMessage{request})
+	if err != nil {
+		return nil, fmt.Errorf("Request failed: %w", err)
+	}
+	result, err := decodeResult(replies[0])
+	if err != nil {
+		return result, err
+	}
+	if len(result.Requested) > 0 && result.Level == "WARN" {
+		return result, &ValueMismatchError{
+			Control:   control,
+			Requested: result.Requested,
+			Effective: result.Value,
+		}
+	}
+	return result, nil
+}
+
+// decodeResult decodes the structured reply of a request with the tag 'format=json'
+func decodeResult(reply controlReply) (*ControlResult, error) {
+	var result ControlResult
+	err := json.Unmarshal([]byte(reply.value), &result)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode reply '%s': %w", reply.value, err)
+	}
+	result.Level = reply.level
+	result.RequestId = reply.requestId
+	if reply.level == "ERROR" {
+		if len(result.Error) == 0 {
+			result.Error = reply.code
+		}
+		return &result, &ControlError{
+			Code:      result.Error,
+			Message:   result.Message,
+			RequestId: reply.requestId,
+		}
+	}
+	return &result, nil
+}
+
+// ApplyProfile applies a profile defined in the configuration of the server. The
+// server either applies all values of the profile or none. If the server replied
+// with an error, it wraps a *ControlError.
+func (c *ccControlClient) ApplyProfile(hostname, profile string) error {
+	tags := map[string]string{
+		"hostname": hostname,
+		"method":   "PUT",
+		"type":     "node",
+		"type-id":  "0",
+	}
+
+	request, err := lp.NewPutControl("profile", tags, nil, profile, time.Now())
+	if err != nil {
+		return fmt.Errorf("Failed to create control message to '%s' to apply profile: %w", hostname, err)
+	}
+
+	replies, err := c.sendRequestsAndCheckReplies([]lp.CCMessage{request})
 	if err != nil {
 		return fmt.Errorf("Request failed: %w", err)
 	}
+	reply := replies[0]
 
-	if level == "ERROR" {
-		return fmt.Errorf("Setting control '%s' from host '%s' to value '%s' failed: %s", control, hostname, value, value)
+	if reply.level == "ERROR" {
+		return fmt.Errorf("Applying profile '%s' on host '%s' failed: %w", profile, hostname, reply.err())
 	}
 
 	return nil
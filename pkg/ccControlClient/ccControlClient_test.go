@@ -1,8 +1,14 @@
 package cccontrolclient
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	lp "github.com/ClusterCockpit/cc-lib/v2/ccMessage"
 )
 
 var (
@@ -13,12 +19,30 @@ var (
 	}
 )
 
-func TestGetControls(t *testing.T) {
+// newTestClient connects to the NATS server of natsConfig and returns the
+// client and the target host, which is taken from CC_CONTROL_TEST_HOST or
+// defaults to the short hostname of the local host. The test is skipped if no
+// NATS server is reachable.
+func newTestClient(t *testing.T) (CCControlClient, string) {
+	t.Helper()
+	target := os.Getenv("CC_CONTROL_TEST_HOST")
+	if len(target) == 0 {
+		h, err := os.Hostname()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		target = strings.SplitN(h, ".", 2)[0]
+	}
 	c, err := NewCCControlClient(natsConfig)
 	if err != nil {
-		t.Fatal(err.Error())
+		t.Skipf("No NATS server available: %v", err)
 	}
-	control, err := c.GetControls("nuc")
+	return c, target
+}
+
+func TestGetControls(t *testing.T) {
+	c, target := newTestClient(t)
+	control, err := c.GetControls(target)
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -33,11 +57,7 @@ func TestGetControls(t *testing.T) {
 }
 
 func TestGetTopology(t *testing.T) {
-	target := "nuc"
-	c, err := NewCCControlClient(natsConfig)
-	if err != nil {
-		t.Fatal(err.Error())
-	}
+	c, target := newTestClient(t)
 	topo, err := c.GetTopology(target)
 	if err != nil {
 		t.Error(err.Error())
@@ -51,15 +71,11 @@ func TestGetTopology(t *testing.T) {
 }
 
 func TestGetControlValue(t *testing.T) {
-	target := "nuc"
 	control := "rapl.pkg_max_limit"
 	device := "socket"
 	deviceID := "0"
 
-	c, err := NewCCControlClient(natsConfig)
-	if err != nil {
-		t.Fatal(err.Error())
-	}
+	c, target := newTestClient(t)
 	value, err := c.GetControlValue(target, control, device, deviceID)
 	if err != nil {
 		t.Error(err.Error())
@@ -70,17 +86,13 @@ func TestGetControlValue(t *testing.T) {
 }
 
 func TestSetControlValue(t *testing.T) {
-	target := "nuc"
 	control := "rapl.pkg_limit_1"
 	max_control := "rapl.pkg_max_limit"
 	device := "socket"
 	deviceID := "0"
 	var outerr error = nil
 
-	c, err := NewCCControlClient(natsConfig)
-	if err != nil {
-		t.Fatal(err.Error())
-	}
+	c, target := newTestClient(t)
 	defer c.Close()
 	cur, err := c.GetControlValue(target, control, device, deviceID)
 	if err != nil {
@@ -108,6 +120,202 @@ func TestSetControlValue(t *testing.T) {
 		t.Error(err.Error())
 	}
 	if outerr != nil {
+		t.Error(outerr.Error())
+	}
+}
+
+func TestCheckReply(t *testing.T) {
+	tags := map[string]string{
+		"hostname": "nuc",
+		"method":   "GET",
+		"type":     "socket",
+		"type-id":  "0",
+	}
+	request, err := lp.NewGetControl("rapl.pkg_limit_1", tags, nil, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	batch, err := lp.FromBytes([]byte(strings.Join([]string{
+		`rapl.pkg_limit_1,hostname=nuc,level=INFO,method=GET,type=socket,type-id=0 log="150000" 1700000000000000000`,
+		`rapl.pkg_limit_2,hostname=nuc,level=INFO,method=GET,type=socket,type-id=0 log="180000" 1700000000000000000`,
+		`rapl.pkg_limit_1,hostname=other,level=INFO,method=GET,type=socket,type-id=0 log="150000" 1700000000000000000`,
+		`rapl.pkg_limit_1,hostname=nuc,method=GET,type=socket,type-id=0 log="150000" 1700000000000000000`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(batch) != 4 {
+		t.Fatalf("expected 4 reply lines but got %d", len(batch))
+	}
+
+	value, level, err := checkReply(request, batch[0])
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if value != "150000" || level != "INFO" {
+		t.Errorf("unexpected reply value '%s' and level '%s'", value, level)
+	}
+	for i, reply := range batch[1:] {
+		if _, _, err := checkReply(request, reply); err == nil {
+			t.Errorf("mismatching reply %d accepted", i+1)
+		}
+	}
+
+	denied, err := lp.FromBytes([]byte(`rapl.pkg_limit_1,hostname=nuc,level=ERROR,error=permission,method=GET,type=socket,type-id=0 log="Permission denied" 1700000000000000000`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Denied requests are decoded like other errors
+	reply, err := newControlReply(request, denied[0])
+	if err != nil {
+		t.Fatalf("denied reply rejected: %v", err)
+	}
+	var cerr *ControlError
+	if rerr := reply.err(); !errors.Is(rerr, ErrPermissionDenied) || !errors.As(rerr, &cerr) || reply.level != "ERROR" {
+		t.Errorf("expected ControlError with ErrPermissionDenied but got %s %v", reply.level, rerr)
+	}
+
+	request.AddTag(RequestIdTag, "0123abcd")
+	batch, err = lp.FromBytes([]byte(strings.Join([]string{
+		`rapl.pkg_limit_1,hostname=nuc,level=INFO,method=GET,request-id=0123abcd,type=socket,type-id=0 log="150000" 1700000000000000000`,
+		`rapl.pkg_limit_1,hostname=nuc,level=INFO,method=GET,request-id=4567ef01,type=socket,type-id=0 log="150000" 1700000000000000000`,
+		`rapl.pkg_limit_1,hostname=nuc,level=INFO,method=GET,type=socket,type-id=0 log="150000" 1700000000000000000`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, err := checkReply(request, batch[0]); err != nil {
 		t.Error(err.Error())
 	}
+	for i, reply := range batch[1:] {
+		if _, _, err := checkReply(request, reply); err == nil {
+			t.Errorf("reply %d with mismatching request-id accepted", i+1)
+		}
+	}
+}
+
+func TestNewRequestId(t *testing.T) {
+	a, err := newRequestId()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := newRequestId()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(a) != 32 || a == b {
+		t.Errorf("unexpected request IDs '%s' and '%s'", a, b)
+	}
+}
+
+func TestDecodeResult(t *testing.T) {
+	result, err := decodeResult(controlReply{
+		value: `{"control":"sysfeatures/rapl.pkg_limit_1","device_type":"socket","device_id":"0","value":"150000","unit":"uW","timestamp":"2024-05-06T10:11:12Z"}`,
+		level: "INFO",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Value != "150000" || result.Unit != "uW" || result.DeviceId != "0" || result.Level != "INFO" {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	result, err = decodeResult(controlReply{
+		value: `{"control":"rapl.pkg_limit_9","device_type":"socket","device_id":"0","timestamp":"2024-05-06T10:11:12Z","error":"no-such-control","message":"Unknown control 'rapl.pkg_limit_9'"}`,
+		level: "ERROR",
+		code:  ErrorNoSuchControl,
+	})
+	var cerr *ControlError
+	if !errors.As(err, &cerr) || cerr.Code != ErrorNoSuchControl {
+		t.Errorf("expected ControlError with code %s but got %v", ErrorNoSuchControl, err)
+	}
+	if result == nil || result.Error != ErrorNoSuchControl {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	if _, err := decodeResult(controlReply{value: "150000", level: "INFO"}); err == nil {
+		t.Error("plain reply accepted as structured reply")
+	}
+
+	err = fmt.Errorf("Request failed: %w", &ControlError{Code: ErrorPermission, Message: "Permission denied"})
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected ErrPermissionDenied but got %v", err)
+	}
+
+	// Denied requests keep their structured result
+	request, err := lp.NewGetControl("rapl.pkg_limit_1", map[string]string{"hostname": "nuc", "method": "GET", "type": "socket", "type-id": "0", "format": "json"}, nil, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	denied, err := lp.FromBytes([]byte(`rapl.pkg_limit_1,error=permission,format=json,hostname=nuc,level=ERROR,method=GET,type=socket,type-id=0 log="{\"control\":\"sysfeatures/rapl.pkg_limit_1\",\"device_type\":\"socket\",\"device_id\":\"0\",\"timestamp\":\"2024-05-06T10:11:12Z\",\"error\":\"permission\",\"message\":\"Permission denied\"}" 1700000000000000000`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reply, err := newControlReply(request, denied[0])
+	if err != nil {
+		t.Fatalf("denied reply rejected: %v", err)
+	}
+	result, err = decodeResult(reply)
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected ErrPermissionDenied but got %v", err)
+	}
+	if result == nil || result.Control != "sysfeatures/rapl.pkg_limit_1" || result.Error != ErrorPermission {
+		t.Errorf("unexpected result of denied request %+v", result)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		timeout  string
+		expected time.Duration
+		valid    bool
+	}{
+		{"", DefaultRequestTimeout, true},
+		{"5s", 5 * time.Second, true},
+		{"250ms", 250 * time.Millisecond, true},
+		{"0s", 0, false},
+		{"-1s", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tc := range tests {
+		d, err := parseTimeout(tc.timeout, DefaultRequestTimeout)
+		if (err == nil) != tc.valid {
+			t.Errorf("'%s': expected valid %v but got error %v", tc.timeout, tc.valid, err)
+			continue
+		}
+		if tc.valid && d != tc.expected {
+			t.Errorf("'%s': expected %v but got %v", tc.timeout, tc.expected, d)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	c := &ccControlClient{requestTimeout: time.Second, multiRequestTimeout: time.Minute}
+	request := func(name, deviceType, deviceId string) lp.CCMessage {
+		tags := map[string]string{"hostname": "nuc", "method": "GET", "type": deviceType, "type-id": deviceId}
+		m, err := lp.NewGetControl(name, tags, nil, time.Now())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		requests []lp.CCMessage
+		expected time.Duration
+	}{
+		{"hwthread", []lp.CCMessage{request("cpu_freq.max_cpu_freq", "hwthread", "3")}, time.Second},
+		{"all hwthreads", []lp.CCMessage{request("cpu_freq.max_cpu_freq", "hwthread", "*")}, time.Minute},
+		{"hwthread list", []lp.CCMessage{request("cpu_freq.max_cpu_freq", "hwthread", "0-3")}, time.Minute},
+		{"socket", []lp.CCMessage{request("rapl.pkg_limit_1", "socket", "0")}, time.Minute},
+		{"profile", []lp.CCMessage{request("profile", "node", "0")}, time.Minute},
+		{"batch", []lp.CCMessage{request("cpu_freq.max_cpu_freq", "hwthread", "0"), request("cpu_freq.max_cpu_freq", "hwthread", "1")}, time.Minute},
+	}
+	for _, tc := range tests {
+		if d := c.timeout(tc.requests); d != tc.expected {
+			t.Errorf("%s: expected timeout %v but got %v", tc.name, tc.expected, d)
+		}
+	}
 }
@@ -0,0 +1,103 @@
+package cccontrolclient
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ExpandHostlist expands a hostlist expression like 'node[001-128]' or
+// 'node[01-04,08],login1' into hostnames. Ranges keep the zero padding of their
+// start value. Several bracket groups in one hostname (e.g. 'r[1-2]n[01-04]')
+// are expanded to all combinations.
+func ExpandHostlist(expr string) ([]string, error) {
+	items, err := splitHostlist(expr)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0, len(items))
+	for _, item := range items {
+		expanded, err := expandHostlistItem(item)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid hostlist '%s': %w", expr, err)
+		}
+		for _, h := range expanded {
+			if !slices.Contains(hosts, h) {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// splitHostlist splits a hostlist expression at commas outside of brackets
+func splitHostlist(expr string) ([]string, error) {
+	items := make([]string, 0)
+	depth := 0
+	start := 0
+	for i, c := range expr {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, expr[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 || depth > 1 {
+			return nil, fmt.Errorf("Invalid hostlist '%s': unbalanced brackets", expr)
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("Invalid hostlist '%s': unbalanced brackets", expr)
+	}
+	items = append(items, expr[start:])
+	return items, nil
+}
+
+// expandHostlistItem expands the bracket groups of a single hostname
+func expandHostlistItem(item string) ([]string, error) {
+	open := strings.IndexByte(item, '[')
+	if open < 0 {
+		if len(item) == 0 {
+			return nil, fmt.Errorf("empty hostname")
+		}
+		return []string{item}, nil
+	}
+	end := strings.IndexByte(item, ']')
+	prefix := item[:open]
+	suffixes := []string{""}
+	if end+1 < len(item) {
+		var err error
+		suffixes, err = expandHostlistItem(item[end+1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hosts := make([]string, 0)
+	for _, r := range strings.Split(item[open+1:end], ",") {
+		lo, hi, isRange := strings.Cut(r, "-")
+		if !isRange {
+			hi = lo
+		}
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid range '%s'", r)
+		}
+		last, err := strconv.Atoi(hi)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid range '%s'", r)
+		}
+		for i := first; i <= last; i++ {
+			for _, s := range suffixes {
+				hosts = append(hosts, fmt.Sprintf("%s%0*d%s", prefix, len(lo), i, s))
+			}
+		}
+	}
+	return hosts, nil
+}
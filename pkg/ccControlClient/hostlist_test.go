@@ -0,0 +1,32 @@
+package cccontrolclient
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExpandHostlist(t *testing.T) {
+	tests := map[string][]string{
+		"node001":                {"node001"},
+		"node[001-003]":          {"node001", "node002", "node003"},
+		"node[8-10,12],login1":   {"node8", "node9", "node10", "node12", "login1"},
+		"r[1-2]n[01-02]":         {"r1n01", "r1n02", "r2n01", "r2n02"},
+		"node[1-2],node[2-3]":    {"node1", "node2", "node3"},
+		"node[09-10].example.de": {"node09.example.de", "node10.example.de"},
+	}
+	for expr, expected := range tests {
+		hosts, err := ExpandHostlist(expr)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err.Error())
+			continue
+		}
+		if fmt.Sprint(hosts) != fmt.Sprint(expected) {
+			t.Errorf("%s: expected %v but got %v", expr, expected, hosts)
+		}
+	}
+	for _, invalid := range []string{"", "node[1-2", "node1-2]", "node[2-1]", "node[a-b]", "node[[1]]", "a,,b", "node[]"} {
+		if hosts, err := ExpandHostlist(invalid); err == nil {
+			t.Errorf("invalid hostlist '%s' accepted: %v", invalid, hosts)
+		}
+	}
+}
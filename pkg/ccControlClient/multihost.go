@@ -0,0 +1,115 @@
+package cccontrolclient
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultParallelism is the number of concurrent requests of the multi-host
+// methods if NatsConfig.Parallelism is not set
+const DefaultParallelism = 16
+
+// HostResults is the result of a request sent to several hosts. Every host is
+// in exactly one of the maps.
+type HostResults[T any] struct {
+	Success     map[string]T     // Results of the hosts that processed the request
+	Errors      map[string]error // Hosts that replied with an error
+	Unreachable map[string]error // Hosts that did not reply
+}
+
+// ScatterGather runs fn for all hosts concurrently, with at most parallelism
+// calls at once, and sorts the results by success, error and unreachable host.
+// It allows running any request of CCControlClient on several hosts.
+func ScatterGather[T any](hosts []string, parallelism int, fn func(hostname string) (T, error)) *HostResults[T] {
+	if parallelism <= 0 {
+		parallelism = DefaultParallelism
+	}
+	results := &HostResults[T]{
+		Success:     make(map[string]T),
+		Errors:      make(map[string]error),
+		Unreachable: make(map[string]error),
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallelism)
+	for _, h := range hosts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			value, err := fn(h)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err == nil {
+				results.Success[h] = value
+			} else if isUnreachable(err) {
+				results.Unreachable[h] = err
+			} else {
+				results.Errors[h] = err
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// isUnreachable checks whether a request failed because the host did not reply
+func isUnreachable(err error) bool {
+	var cerr *ControlError
+	if errors.As(err, &cerr) && cerr.Code == ErrorTimeout {
+		return true
+	}
+	return errors.Is(err, nats.ErrTimeout) || errors.Is(err, nats.ErrNoResponders)
+}
+
+// expandHosts expands the hostlist expressions in hosts
+func expandHosts(hosts []string) ([]string, error) {
+	out := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		expanded, err := ExpandHostlist(h)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+// GetControlValueHosts reads a control on several hosts. Each entry of hosts
+// may be a hostlist expression like 'node[001-128]'.
+func (c *ccControlClient) GetControlValueHosts(hosts []string, control string, device string, deviceID string) (*HostResults[string], error) {
+	hostnames, err := expandHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return ScatterGather(hostnames, c.natsCfg.Parallelism, func(hostname string) (string, error) {
+		return c.GetControlValue(hostname, control, device, deviceID)
+	}), nil
+}
+
+// SetControlValueHosts sets a control on several hosts, see GetControlValueHosts
+func (c *ccControlClient) SetControlValueHosts(hosts []string, control string, device string, deviceID string, value string) (*HostResults[string], error) {
+	hostnames, err := expandHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return ScatterGather(hostnames, c.natsCfg.Parallelism, func(hostname string) (string, error) {
+		return value, c.SetControlValue(hostname, control, device, deviceID, value)
+	}), nil
+}
+
+// ApplyProfileHosts applies a profile on several hosts, see GetControlValueHosts
+func (c *ccControlClient) ApplyProfileHosts(hosts []string, profile string) (*HostResults[string], error) {
+	hostnames, err := expandHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return ScatterGather(hostnames, c.natsCfg.Parallelism, func(hostname string) (string, error) {
+		return profile, c.ApplyProfile(hostname, profile)
+	}), nil
+}
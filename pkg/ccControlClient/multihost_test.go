@@ -0,0 +1,50 @@
+package cccontrolclient
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScatterGather(t *testing.T) {
+	hosts, err := ExpandHostlist("node[01-10]")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var running, maxRunning atomic.Int32
+	results := ScatterGather(hosts, 3, func(hostname string) (string, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		switch hostname {
+		case "node03":
+			return "", fmt.Errorf("Request failed: %w", &ControlError{Code: ErrorTimeout, Message: "No reply"})
+		case "node07":
+			return "", fmt.Errorf("Request failed: %w", &ControlError{Code: ErrorNoSuchControl, Message: "Unknown control"})
+		}
+		return hostname, nil
+	})
+
+	if maxRunning.Load() > 3 {
+		t.Errorf("expected at most 3 concurrent requests but got %d", maxRunning.Load())
+	}
+	if len(results.Success) != 8 || results.Success["node01"] != "node01" {
+		t.Errorf("unexpected successes %v", results.Success)
+	}
+	if _, ok := results.Unreachable["node03"]; !ok || len(results.Unreachable) != 1 {
+		t.Errorf("unexpected unreachable hosts %v", results.Unreachable)
+	}
+	var cerr *ControlError
+	if err, ok := results.Errors["node07"]; !ok || len(results.Errors) != 1 || !errors.As(err, &cerr) {
+		t.Errorf("unexpected errors %v", results.Errors)
+	}
+}
@@ -0,0 +1,172 @@
+package cccontrolprovider
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+)
+
+// NamespaceSeparator separates the provider name from the control name
+// in fully qualified control names like 'sysfeatures/rapl.pkg_limit_1'
+const NamespaceSeparator = "/"
+
+// ControlEntry describes a single control offered by a provider
+type ControlEntry struct {
+	Provider    string // Name of the provider, filled by the registry
+	Category    string
+	Name        string
+	DeviceType  string
+	Description string
+	Unit        string // Unit of the values, empty if unknown or without unit
+	ReadOnly    bool
+	WriteOnly   bool
+}
+
+// Control returns the provider-local name of the control (<category>.<name>)
+func (e *ControlEntry) Control() string {
+	if len(e.Category) == 0 {
+		return e.Name
+	}
+	return fmt.Sprintf("%s.%s", e.Category, e.Name)
+}
+
+// FullName returns the namespaced name of the control (<provider>/<category>.<name>)
+func (e *ControlEntry) FullName() string {
+	return e.Provider + NamespaceSeparator + e.Control()
+}
+
+// Methods returns the control methods supported by the control
+func (e *ControlEntry) Methods() string {
+	if e.ReadOnly && e.WriteOnly {
+		return "ERROR"
+	} else if e.ReadOnly && (!e.WriteOnly) {
+		return "GET"
+	} else if (!e.ReadOnly) && e.WriteOnly {
+		return "PUT"
+	} else {
+		return "ALL"
+	}
+}
+
+// ControlProvider is a source of controls. Control names passed to Get and Set
+// are provider-local (<category>.<name>), the namespacing is done by the registry.
+type ControlProvider interface {
+	// Name returns the namespace of the provider's controls
+	Name() string
+	Init() error
+	Close()
+	List() ([]ControlEntry, error)
+	Get(control, deviceType, deviceId string) (string, error)
+	Set(control, deviceType, deviceId, value string) error
+}
+
+type registeredProvider struct {
+	provider ControlProvider
+	controls []ControlEntry
+}
+
+var (
+	providersMutex sync.RWMutex
+	providers      []registeredProvider
+)
+
+// Register initializes a provider and adds it to the registry. The controls of
+// the provider are listed once at registration.
+func Register(p ControlProvider) error {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+
+	name := p.Name()
+	if len(name) == 0 || strings.Contains(name, NamespaceSeparator) {
+		return fmt.Errorf("Invalid provider name '%s'", name)
+	}
+	for _, r := range providers {
+		if r.provider.Name() == name {
+			return fmt.Errorf("Provider '%s' already registered", name)
+		}
+	}
+
+	cclog.ComponentDebug("ControlProvider", "Initializing provider", name)
+	err := p.Init()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize provider '%s': %w", name, err)
+	}
+
+	controls, err := p.List()
+	if err != nil {
+		p.Close()
+		return fmt.Errorf("Failed to list controls of provider '%s': %w", name, err)
+	}
+	for i := range controls {
+		controls[i].Provider = name
+	}
+
+	providers = append(providers, registeredProvider{
+		provider: p,
+		controls: controls,
+	})
+	cclog.ComponentDebug("ControlProvider", "Registered provider", name, "with", len(controls), "controls")
+	return nil
+}
+
+// Close closes all registered providers in reverse order of registration
+func Close() {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+
+	for i := len(providers) - 1; i >= 0; i-- {
+		providers[i].provider.Close()
+	}
+	providers = nil
+}
+
+// Providers returns all registered providers in order of registration
+func Providers() []ControlProvider {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	out := make([]ControlProvider, 0, len(providers))
+	for _, r := range providers {
+		out = append(out, r.provider)
+	}
+	return out
+}
+
+// List returns the merged list of controls of all registered providers
+func List() []ControlEntry {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	out := make([]ControlEntry, 0)
+	for _, r := range providers {
+		out = append(out, r.controls...)
+	}
+	return out
+}
+
+// Lookup resolves a control name to its provider and control entry. Namespaced
+// names (<provider>/<control>) are resolved directly, plain names are resolved
+// to the first provider offering the control.
+func Lookup(control string) (ControlProvider, ControlEntry, error) {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	name, local, namespaced := strings.Cut(control, NamespaceSeparator)
+	for _, r := range providers {
+		if namespaced && r.provider.Name() != name {
+			continue
+		}
+		lookup := control
+		if namespaced {
+			lookup = local
+		}
+		for _, c := range r.controls {
+			if c.Control() == lookup {
+				return r.provider, c, nil
+			}
+		}
+	}
+	return nil, ControlEntry{}, fmt.Errorf("Unknown control '%s'", control)
+}
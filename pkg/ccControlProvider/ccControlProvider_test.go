@@ -0,0 +1,118 @@
+package cccontrolprovider
+
+import (
+	"fmt"
+	"testing"
+)
+
+type testProvider struct {
+	name     string
+	controls []ControlEntry
+	values   map[string]string
+	closed   bool
+}
+
+func (p *testProvider) Name() string { return p.name }
+func (p *testProvider) Init() error  { return nil }
+func (p *testProvider) Close()       { p.closed = true }
+
+func (p *testProvider) List() ([]ControlEntry, error) {
+	return p.controls, nil
+}
+
+func (p *testProvider) Get(control, deviceType, deviceId string) (string, error) {
+	v, ok := p.values[control]
+	if !ok {
+		return "", fmt.Errorf("no value for %s", control)
+	}
+	return v, nil
+}
+
+func (p *testProvider) Set(control, deviceType, deviceId, value string) error {
+	p.values[control] = value
+	return nil
+}
+
+func newTestProvider(name string, controls ...string) *testProvider {
+	p := &testProvider{
+		name:   name,
+		values: make(map[string]string),
+	}
+	for _, c := range controls {
+		p.controls = append(p.controls, ControlEntry{
+			Category:   "test",
+			Name:       c,
+			DeviceType: "node",
+		})
+	}
+	return p
+}
+
+func TestRegister(t *testing.T) {
+	defer Close()
+	a := newTestProvider("a", "x", "y")
+	b := newTestProvider("b", "y", "z")
+	if err := Register(a); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Register(b); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Register(newTestProvider("a")); err == nil {
+		t.Errorf("registered provider 'a' twice")
+	}
+	if err := Register(newTestProvider("a/b")); err == nil {
+		t.Errorf("registered provider with namespace separator in name")
+	}
+
+	list := List()
+	if len(list) != 4 {
+		t.Errorf("expected 4 controls but got %d", len(list))
+	}
+	if list[0].FullName() != "a/test.x" || list[3].FullName() != "b/test.z" {
+		t.Errorf("unexpected control list %v", list)
+	}
+
+	Close()
+	if !a.closed || !b.closed {
+		t.Errorf("providers not closed")
+	}
+	if len(Providers()) != 0 {
+		t.Errorf("registry not empty after Close()")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	defer Close()
+	a := newTestProvider("a", "x", "y")
+	b := newTestProvider("b", "y", "z")
+	Register(a)
+	Register(b)
+
+	tests := []struct {
+		control  string
+		provider string
+		local    string
+	}{
+		{"test.x", "a", "test.x"},
+		{"test.y", "a", "test.y"},
+		{"b/test.y", "b", "test.y"},
+		{"test.z", "b", "test.z"},
+	}
+	for _, tc := range tests {
+		p, e, err := Lookup(tc.control)
+		if err != nil {
+			t.Errorf("Lookup(%s): %v", tc.control, err.Error())
+			continue
+		}
+		if p.Name() != tc.provider || e.Control() != tc.local {
+			t.Errorf("Lookup(%s) returned %s/%s, expected %s/%s", tc.control, p.Name(), e.Control(), tc.provider, tc.local)
+		}
+	}
+
+	for _, c := range []string{"test.w", "a/test.z", "c/test.x"} {
+		if _, _, err := Lookup(c); err == nil {
+			t.Errorf("Lookup(%s) succeeded for unknown control", c)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package ccidentity handles identities of requesting clients. A client either
+// sends its identity in plain text (only trusted if the server is configured to
+// do so) or a token signed with a secret shared between the client and the servers.
+//
+// A token has the format <identity>:<expiry as unix time>:<request ID>:<hex encoded HMAC-SHA256>.
+// The HMAC is computed over <identity>:<expiry>:<request ID>:<hostname>:<hex encoded SHA256
+// of the payload> with the secret of the identity. A token is thereby bound to a single
+// request message for a single host. Servers reject request IDs they have seen before
+// (see ReplayCache), so a token cannot be replayed by other receivers of the request.
+package ccidentity
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// NATS header with the identity in plain text
+	IdentityHeader = "Cc-Identity"
+	// NATS header with the signed token
+	TokenHeader = "Cc-Token"
+	// Default time a token is valid after creation
+	DefaultTokenValidity = 5 * time.Minute
+	// Maximal time a token may be valid, tokens expiring later are rejected
+	MaxTokenValidity = time.Hour
+)
+
+// Claims are the verified contents of a token
+type Claims struct {
+	Identity  string
+	RequestId string // Unique ID of the request message the token was created for
+	Expires   time.Time
+}
+
+func signature(identity, expires, requestId, hostname string, payload []byte, secret string) string {
+	digest := sha256.Sum256(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{identity, expires, requestId, hostname, hex.EncodeToString(digest[:])}, ":")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewToken creates a token for identity that is valid until expires. The token is
+// only valid for the request message with the given payload sent to hostname.
+// requestId has to be unique for each request message.
+func NewToken(identity, secret string, expires time.Time, requestId, hostname string, payload []byte) (string, error) {
+	if len(identity) == 0 || strings.Contains(identity, ":") {
+		return "", fmt.Errorf("Invalid identity '%s'", identity)
+	}
+	if len(secret) == 0 {
+		return "", fmt.Errorf("No secret for identity '%s'", identity)
+	}
+	if len(requestId) == 0 || strings.Contains(requestId, ":") {
+		return "", fmt.Errorf("Invalid request ID '%s'", requestId)
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return fmt.Sprintf("%s:%s:%s:%s", identity, exp, requestId, signature(identity, exp, requestId, hostname, payload, secret)), nil
+}
+
+// VerifyToken checks the signature and expiry of a token for a request message
+// with the given payload received by hostname. The secrets map identities to their
+// secrets.
+func VerifyToken(token string, secrets map[string]string, hostname string, payload []byte, now time.Time) (Claims, error) {
+	var c Claims
+	fields := strings.Split(token, ":")
+	if len(fields) != 4 {
+		return c, fmt.Errorf("Invalid token format")
+	}
+	identity, exp, requestId, sig := fields[0], fields[1], fields[2], fields[3]
+	secret, ok := secrets[identity]
+	if !ok || len(secret) == 0 {
+		return c, fmt.Errorf("Unknown identity '%s' in token", identity)
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(identity, exp, requestId, hostname, payload, secret))) {
+		return c, fmt.Errorf("Invalid token signature for identity '%s'", identity)
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return c, fmt.Errorf("Invalid token expiry '%s'", exp)
+	}
+	if now.Unix() > expires {
+		return c, fmt.Errorf("Token for identity '%s' expired at %s", identity, time.Unix(expires, 0).Format(time.RFC3339))
+	}
+	if time.Unix(expires, 0).Sub(now) > MaxTokenValidity {
+		return c, fmt.Errorf("Token for identity '%s' is valid for more than %s", identity, MaxTokenValidity)
+	}
+	return Claims{Identity: identity, RequestId: requestId, Expires: time.Unix(expires, 0)}, nil
+}
+
+// ReplayCache remembers the request IDs of verified tokens until the tokens expire
+type ReplayCache struct {
+	lock      sync.Mutex
+	seen      map[string]time.Time
+	nextPrune time.Time
+}
+
+// NewReplayCache creates an empty replay cache
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[string]time.Time)}
+}
+
+// Check records the request ID of verified claims. It returns an error if the
+// request ID of the identity was already seen in a token that is not expired.
+func (c *ReplayCache) Check(claims Claims, now time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if now.After(c.nextPrune) {
+		for key, expires := range c.seen {
+			if now.After(expires) {
+				delete(c.seen, key)
+			}
+		}
+		c.nextPrune = now.Add(time.Minute)
+	}
+	key := claims.Identity + ":" + claims.RequestId
+	if expires, ok := c.seen[key]; ok && !now.After(expires) {
+		return fmt.Errorf("Token with request ID '%s' of identity '%s' was already used", claims.RequestId, claims.Identity)
+	}
+	c.seen[key] = claims.Expires
+	return nil
+}
@@ -0,0 +1,107 @@
+package ccidentity
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	secrets := map[string]string{
+		"prolog": "secret1",
+		"admin":  "secret2",
+	}
+	now := time.Now()
+	payload := []byte(`cpu_freq.max_cpu_freq,hostname=node01,method=PUT,type=hwthread,type-id=0 value="2000000"`)
+
+	token, err := NewToken("prolog", secrets["prolog"], now.Add(time.Minute), "0123abcd", "node01", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := VerifyToken(token, secrets, "node01", payload, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Identity != "prolog" || claims.RequestId != "0123abcd" {
+		t.Errorf("Expected identity 'prolog' and request ID '0123abcd', got %+v", claims)
+	}
+
+	// Expired
+	if _, err := VerifyToken(token, secrets, "node01", payload, now.Add(2*time.Minute)); err == nil {
+		t.Errorf("Expected error for expired token")
+	}
+
+	// Replayed to another host or with another payload
+	if _, err := VerifyToken(token, secrets, "node02", payload, now); err == nil {
+		t.Errorf("Expected error for token of another host")
+	}
+	if _, err := VerifyToken(token, secrets, "node01", []byte(strings.Replace(string(payload), "2000000", "800000", 1)), now); err == nil {
+		t.Errorf("Expected error for token of another payload")
+	}
+
+	// Claiming another identity or request ID with the own signature
+	forged := strings.Replace(token, "prolog", "admin", 1)
+	if _, err := VerifyToken(forged, secrets, "node01", payload, now); err == nil {
+		t.Errorf("Expected error for forged token")
+	}
+	forged = strings.Replace(token, "0123abcd", "4567ef01", 1)
+	if _, err := VerifyToken(forged, secrets, "node01", payload, now); err == nil {
+		t.Errorf("Expected error for token with forged request ID")
+	}
+
+	// Signed with the wrong secret
+	wrong, _ := NewToken("admin", "secret1", now.Add(time.Minute), "0123abcd", "node01", payload)
+	if _, err := VerifyToken(wrong, secrets, "node01", payload, now); err == nil {
+		t.Errorf("Expected error for token with wrong secret")
+	}
+
+	// Valid for too long
+	long, _ := NewToken("admin", "secret2", now.Add(2*MaxTokenValidity), "0123abcd", "node01", payload)
+	if _, err := VerifyToken(long, secrets, "node01", payload, now); err == nil {
+		t.Errorf("Expected error for token valid longer than MaxTokenValidity")
+	}
+
+	// Unknown identity and invalid format
+	unknown, _ := NewToken("other", "secret3", now.Add(time.Minute), "0123abcd", "node01", payload)
+	if _, err := VerifyToken(unknown, secrets, "node01", payload, now); err == nil {
+		t.Errorf("Expected error for unknown identity")
+	}
+	if _, err := VerifyToken("prolog", secrets, "node01", payload, now); err == nil {
+		t.Errorf("Expected error for invalid token")
+	}
+
+	if _, err := NewToken("a:b", "secret", now, "0123abcd", "node01", payload); err == nil {
+		t.Errorf("Expected error for identity with ':'")
+	}
+	if _, err := NewToken("prolog", "", now, "0123abcd", "node01", payload); err == nil {
+		t.Errorf("Expected error for empty secret")
+	}
+	if _, err := NewToken("prolog", "secret", now, "", "node01", payload); err == nil {
+		t.Errorf("Expected error for empty request ID")
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	c := NewReplayCache()
+	claims := Claims{Identity: "prolog", RequestId: "0123abcd", Expires: now.Add(time.Minute)}
+
+	if err := c.Check(claims, now); err != nil {
+		t.Errorf("First use rejected: %v", err)
+	}
+	if err := c.Check(claims, now.Add(time.Second)); err == nil {
+		t.Errorf("Expected error for replayed request ID")
+	}
+	other := Claims{Identity: "admin", RequestId: "0123abcd", Expires: now.Add(time.Minute)}
+	if err := c.Check(other, now); err != nil {
+		t.Errorf("Request ID of another identity rejected: %v", err)
+	}
+
+	// Expired entries are pruned
+	if err := c.Check(Claims{Identity: "prolog", RequestId: "4567ef01", Expires: now.Add(3 * time.Minute)}, now.Add(2*time.Minute)); err != nil {
+		t.Errorf("New request ID rejected: %v", err)
+	}
+	if _, ok := c.seen["prolog:0123abcd"]; ok {
+		t.Errorf("Expired request ID not pruned")
+	}
+}
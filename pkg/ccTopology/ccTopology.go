@@ -57,9 +57,7 @@ func fileToInt(path string) int {
 	return id
 }
 
-// fileToList reads a list from a sysfs file
-// A list consists of value ranges separated by colon
-// A range can be a single value or a range of values given by a startValue-endValue
+// fileToList reads a list from a sysfs file, see ParseList
 // In case of an error nil is returned
 func fileToList(path string) []int {
 	// Read list
@@ -70,37 +68,48 @@ func fileToList(path string) []int {
 		return nil
 	}
 
-	// Create list
-	list := make([]int, 0)
-	stringBuffer := strings.TrimSpace(string(buffer))
-	for _, valueRangeString := range strings.Split(stringBuffer, ",") {
+	list, err := ParseList(string(buffer))
+	if err != nil {
+		cclogger.ComponentError("CCTopology", "fileToList", "Parsing", path, ":", err.Error())
+		return nil
+	}
+	return list
+}
+
+// ParseList parses a list in the format of sysfs CPU lists (e.g. '0-15,32-47')
+// A list consists of value ranges separated by comma
+// A range can be a single value or a range of values given by a startValue-endValue
+func ParseList(list string) ([]int, error) {
+	out := make([]int, 0)
+	for _, valueRangeString := range strings.Split(strings.TrimSpace(list), ",") {
 		valueRange := strings.Split(valueRangeString, "-")
 		switch len(valueRange) {
 		case 1:
 			singleValue, err := strconv.Atoi(valueRange[0])
 			if err != nil {
-				cclogger.ComponentError("CCTopology", "fileToList", "Parsing", valueRange[0], ":", err.Error())
-				return nil
+				return nil, fmt.Errorf("invalid value '%s' in list '%s'", valueRange[0], list)
 			}
-			list = append(list, singleValue)
+			out = append(out, singleValue)
 		case 2:
 			startValue, err := strconv.Atoi(valueRange[0])
 			if err != nil {
-				cclogger.ComponentError("CCTopology", "fileToList", "Parsing", valueRange[0], ":", err.Error())
-				return nil
+				return nil, fmt.Errorf("invalid value '%s' in list '%s'", valueRange[0], list)
 			}
 			endValue, err := strconv.Atoi(valueRange[1])
 			if err != nil {
-				cclogger.ComponentError("CCTopology", "fileToList", "Parsing", valueRange[1], ":", err.Error())
-				return nil
+				return nil, fmt.Errorf("invalid value '%s' in list '%s'", valueRange[1], list)
+			}
+			if endValue < startValue {
+				return nil, fmt.Errorf("invalid range '%s' in list '%s'", valueRangeString, list)
 			}
 			for value := startValue; value <= endValue; value++ {
-				list = append(list, value)
+				out = append(out, value)
 			}
+		default:
+			return nil, fmt.Errorf("invalid range '%s' in list '%s'", valueRangeString, list)
 		}
 	}
-
-	return list
+	return out, nil
 }
 
 // init initializes the cache structure
@@ -178,51 +187,81 @@ func init() {
 			return id
 		}
 
-	cache.HwthreadList = getHWThreads()
-	cache.CoreList = make([]int, len(cache.HwthreadList))
-	cache.SocketList = make([]int, len(cache.HwthreadList))
-	cache.DieList = make([]int, len(cache.HwthreadList))
-	cache.SMTList = make([]int, len(cache.HwthreadList))
-	cache.NumaDomainList = make([]int, len(cache.HwthreadList))
-	cache.CpuData = make([]HwthreadEntry, len(cache.HwthreadList))
-	for i, c := range cache.HwthreadList {
+	hwthreads := getHWThreads()
+	cpuData := make([]HwthreadEntry, len(hwthreads))
+	for i, c := range hwthreads {
 		// Set cpuBase directory for topology lookup
 		cpuBase := filepath.Join(SYSFS_CPUBASE, fmt.Sprintf("cpu%d", c))
 		topoBase := filepath.Join(cpuBase, "topology")
 
-		// Lookup Core ID
-		cache.CoreList[i] = fileToInt(filepath.Join(topoBase, "core_id"))
-
 		// Lookup socket / physical package ID
-		cache.SocketList[i] = fileToInt(filepath.Join(topoBase, "physical_package_id"))
+		socket := fileToInt(filepath.Join(topoBase, "physical_package_id"))
 
 		// Lookup CPU die id
-		cache.DieList[i] = fileToInt(filepath.Join(topoBase, "die_id"))
-		if cache.DieList[i] < 0 {
-			cache.DieList[i] = cache.SocketList[i]
+		die := fileToInt(filepath.Join(topoBase, "die_id"))
+		if die < 0 {
+			die = socket
 		}
 
 		// Lookup List of CPUs within the same core
 		coreCPUsList := fileToList(filepath.Join(topoBase, "core_cpus_list"))
 
-		// Find index of CPU ID in List of CPUs within the same core
-		// if not found return -1
-		cache.SMTList[i] = slices.Index(coreCPUsList, c)
-
-		// Lookup NUMA domain id
-		cache.NumaDomainList[i] = getNumaDomain(cpuBase)
-
-		cache.CpuData[i] =
+		cpuData[i] =
 			HwthreadEntry{
-				CpuID:        cache.HwthreadList[i],
-				SMT:          cache.SMTList[i],
+				CpuID: c,
+				// Find index of CPU ID in List of CPUs within the same core
+				// if not found return -1
+				SMT:          slices.Index(coreCPUsList, c),
 				CoreCPUsList: coreCPUsList,
-				Socket:       cache.SocketList[i],
-				NumaDomain:   cache.NumaDomainList[i],
-				Die:          cache.DieList[i],
-				Core:         cache.CoreList[i],
+				Socket:       socket,
+				NumaDomain:   getNumaDomain(cpuBase),
+				Die:          die,
+				Core:         fileToInt(filepath.Join(topoBase, "core_id")),
 			}
 	}
+	setCache(cpuData)
+}
+
+// SetCpuData replaces the topology read from sysfs, e.g. with the topology of a
+// simulated node. If CoreCPUsList is not set for a hardware thread, it is derived
+// from the core and socket IDs of all hardware threads, together with the SMT ID.
+// SetCpuData must not be called while the topology is used concurrently.
+func SetCpuData(cpuData []HwthreadEntry) {
+	data := slices.Clone(cpuData)
+	for i := range data {
+		d := &data[i]
+		if len(d.CoreCPUsList) > 0 {
+			d.CoreCPUsList = slices.Clone(d.CoreCPUsList)
+			continue
+		}
+		for _, o := range cpuData {
+			if o.Socket == d.Socket && o.Core == d.Core {
+				d.CoreCPUsList = append(d.CoreCPUsList, o.CpuID)
+			}
+		}
+		slices.Sort(d.CoreCPUsList)
+		d.SMT = slices.Index(d.CoreCPUsList, d.CpuID)
+	}
+	setCache(data)
+}
+
+// setCache fills the cache with the data of all hardware threads
+func setCache(cpuData []HwthreadEntry) {
+	cache.CpuData = cpuData
+	cache.HwthreadList = make([]int, len(cpuData))
+	cache.CoreList = make([]int, len(cpuData))
+	cache.SocketList = make([]int, len(cpuData))
+	cache.DieList = make([]int, len(cpuData))
+	cache.SMTList = make([]int, len(cpuData))
+	cache.NumaDomainList = make([]int, len(cpuData))
+	for i, d := range cpuData {
+		cache.HwthreadList[i] = d.CpuID
+		cache.CoreList[i] = d.Core
+		cache.SocketList[i] = d.Socket
+		cache.DieList[i] = d.Die
+		cache.SMTList[i] = d.SMT
+		cache.NumaDomainList[i] = d.NumaDomain
+	}
 
 	slices.Sort(cache.HwthreadList)
 	cache.HwthreadList = slices.Compact(cache.HwthreadList)
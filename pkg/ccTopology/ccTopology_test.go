@@ -90,3 +90,55 @@ func TestJsonCpuData(t *testing.T) {
 		fmt.Printf("%d/%d/%d/%d/%d/%d\n", t.CpuID, t.SMT, t.Core, t.Socket, t.Die, t.NumaDomain)
 	}
 }
+
+func TestParseList(t *testing.T) {
+	list, err := ParseList("0-3,8,10-11\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []int{0, 1, 2, 3, 8, 10, 11}
+	if fmt.Sprint(list) != fmt.Sprint(expected) {
+		t.Errorf("expected %v but got %v", expected, list)
+	}
+	for _, invalid := range []string{"", "a", "1-", "3-1", "1-2-3", "0,,1"} {
+		if _, err := ParseList(invalid); err == nil {
+			t.Errorf("invalid list '%s' accepted", invalid)
+		}
+	}
+}
+
+func TestSetCpuData(t *testing.T) {
+	orig := CpuData()
+	defer SetCpuData(orig)
+
+	// 2 sockets with 2 cores each and 2 hardware threads per core
+	data := make([]HwthreadEntry, 0)
+	for i := range 8 {
+		data = append(data, HwthreadEntry{
+			CpuID:      i,
+			Core:       i / 2,
+			Socket:     i / 4,
+			Die:        i / 4,
+			NumaDomain: i / 4,
+		})
+	}
+	SetCpuData(data)
+
+	info := CpuInfo()
+	if info.NumHWthreads != 8 || info.NumCores != 4 || info.NumSockets != 2 || info.SMTWidth != 2 {
+		t.Errorf("unexpected CpuInfo %+v", info)
+	}
+	if fmt.Sprint(GetSocketHwthreads(1)) != "[4 5 6 7]" {
+		t.Errorf("unexpected hwthreads of socket 1: %v", GetSocketHwthreads(1))
+	}
+	if fmt.Sprint(GetCoreHwthreads(2)) != "[4 5]" {
+		t.Errorf("unexpected hwthreads of core 2: %v", GetCoreHwthreads(2))
+	}
+	if fmt.Sprint(GetTypeList("memoryDomain")) != "[0 1]" {
+		t.Errorf("unexpected NUMA domains: %v", GetTypeList("memoryDomain"))
+	}
+	d := CpuData()[5]
+	if d.SMT != 1 || fmt.Sprint(d.CoreCPUsList) != "[4 5]" {
+		t.Errorf("unexpected SMT %d or core CPUs %v of hwthread 5", d.SMT, d.CoreCPUsList)
+	}
+}
@@ -0,0 +1,154 @@
+package cpufreq
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+	topo "github.com/ClusterCockpit/cc-node-controller/pkg/ccTopology"
+)
+
+const SYSFS_CPUBASE = `/sys/devices/system/cpu`
+
+// cpufreqControl maps a control to a file in /sys/devices/system/cpu/cpuN/cpufreq
+type cpufreqControl struct {
+	name        string
+	file        string
+	description string
+	unit        string
+	readonly    bool
+}
+
+// The control names and units (kHz) are the same as those of LIKWID's 'cpu_freq'
+// controls, so requests work with both providers.
+var cpufreqControls = []cpufreqControl{
+	{"cur_cpu_freq", "scaling_cur_freq", "Current CPU frequency (kHz)", "kHz", true},
+	{"min_cpu_freq", "scaling_min_freq", "Minimal CPU frequency (kHz)", "kHz", false},
+	{"max_cpu_freq", "scaling_max_freq", "Maximal CPU frequency (kHz)", "kHz", false},
+	{"avail_freqs", "scaling_available_frequencies", "Available CPU frequencies (kHz)", "kHz", true},
+	{"governor", "scaling_governor", "CPU frequency governor", "", false},
+	{"avail_govs", "scaling_available_governors", "Available CPU frequency governors", "", true},
+	{"energy_perf_pref", "energy_performance_preference", "Energy performance preference", "", false},
+	{"avail_energy_perf_prefs", "energy_performance_available_preferences", "Available energy performance preferences", "", true},
+}
+
+// CpufreqProvider exposes the Linux cpufreq interface as controls for device type 'hwthread'
+type CpufreqProvider struct {
+	root      string
+	hwthreads []int
+	controls  []cpufreqControl
+}
+
+// NewCpufreqProvider creates a provider reading the cpufreq interface below root.
+// If root is empty, SYSFS_CPUBASE is used.
+func NewCpufreqProvider(root string) *CpufreqProvider {
+	if len(root) == 0 {
+		root = SYSFS_CPUBASE
+	}
+	return &CpufreqProvider{
+		root: root,
+	}
+}
+
+func (p *CpufreqProvider) Name() string {
+	return "cpufreq"
+}
+
+// Init checks which cpufreq files are available. Only controls available for the
+// first hardware thread are offered.
+func (p *CpufreqProvider) Init() error {
+	if p.hwthreads == nil {
+		p.hwthreads = topo.HwthreadList()
+	}
+	if len(p.hwthreads) == 0 {
+		return fmt.Errorf("No hardware threads found")
+	}
+
+	p.controls = make([]cpufreqControl, 0)
+	for _, c := range cpufreqControls {
+		if _, err := os.Stat(p.path(p.hwthreads[0], c.file)); err == nil {
+			p.controls = append(p.controls, c)
+		}
+	}
+	if len(p.controls) == 0 {
+		return fmt.Errorf("No cpufreq interface found in %s", p.root)
+	}
+	return nil
+}
+
+func (p *CpufreqProvider) Close() {}
+
+func (p *CpufreqProvider) List() ([]ccprovider.ControlEntry, error) {
+	out := make([]ccprovider.ControlEntry, 0, len(p.controls))
+	for _, c := range p.controls {
+		out = append(out, ccprovider.ControlEntry{
+			Category:    "cpu_freq",
+			Name:        c.name,
+			DeviceType:  "hwthread",
+			Description: c.description,
+			Unit:        c.unit,
+			ReadOnly:    c.readonly,
+		})
+	}
+	return out, nil
+}
+
+func (p *CpufreqProvider) Get(control, deviceType, deviceId string) (string, error) {
+	c, hwthread, err := p.lookup(control, deviceType, deviceId)
+	if err != nil {
+		return "", err
+	}
+	buffer, err := os.ReadFile(p.path(hwthread, c.file))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buffer)), nil
+}
+
+func (p *CpufreqProvider) Set(control, deviceType, deviceId, value string) error {
+	c, hwthread, err := p.lookup(control, deviceType, deviceId)
+	if err != nil {
+		return err
+	}
+	if c.readonly {
+		return fmt.Errorf("Control %s is readonly", control)
+	}
+	f, err := os.OpenFile(p.path(hwthread, c.file), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// path returns the path of a cpufreq file of a hardware thread
+func (p *CpufreqProvider) path(hwthread int, file string) string {
+	return filepath.Join(p.root, fmt.Sprintf("cpu%d", hwthread), "cpufreq", file)
+}
+
+// lookup resolves a control name and device to the cpufreq control and hardware thread ID
+func (p *CpufreqProvider) lookup(control, deviceType, deviceId string) (cpufreqControl, int, error) {
+	if deviceType != "hwthread" {
+		return cpufreqControl{}, -1, fmt.Errorf("Invalid device type %s, cpufreq controls are only available for hwthread", deviceType)
+	}
+	hwthread, err := strconv.Atoi(deviceId)
+	if err != nil || !slices.Contains(p.hwthreads, hwthread) {
+		return cpufreqControl{}, -1, fmt.Errorf("Invalid hwthread ID '%s'", deviceId)
+	}
+	name, ok := strings.CutPrefix(control, "cpu_freq.")
+	if ok {
+		for _, c := range p.controls {
+			if c.name == name {
+				return c, hwthread, nil
+			}
+		}
+	}
+	return cpufreqControl{}, -1, fmt.Errorf("Unknown control %s", control)
+}
@@ -0,0 +1,102 @@
+package cpufreq
+
+import (
+	"os"
+	"testing"
+)
+
+// newTestProvider creates a provider on a copy of the fixture tree in testdata
+// with two hardware threads, cpu0 and cpu1
+func newTestProvider(t *testing.T) *CpufreqProvider {
+	root := t.TempDir()
+	err := os.CopyFS(root, os.DirFS("testdata"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p := NewCpufreqProvider(root)
+	p.hwthreads = []int{0, 1}
+	err = p.Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return p
+}
+
+func TestList(t *testing.T) {
+	p := newTestProvider(t)
+	list, err := p.List()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The fixture has no energy_performance_preference files
+	if len(list) != 6 {
+		t.Errorf("expected 6 controls but got %d", len(list))
+	}
+	for _, l := range list {
+		if l.DeviceType != "hwthread" {
+			t.Errorf("control %s has device type %s", l.Control(), l.DeviceType)
+		}
+		if l.Control() == "cpu_freq.energy_perf_pref" {
+			t.Errorf("control %s listed but not available", l.Control())
+		}
+		if l.Control() == "cpu_freq.max_cpu_freq" && l.Unit != "kHz" {
+			t.Errorf("control %s has unit '%s'", l.Control(), l.Unit)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	p := newTestProvider(t)
+	v, err := p.Get("cpu_freq.governor", "hwthread", "1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v != "powersave" {
+		t.Errorf("expected 'powersave' but got '%s'", v)
+	}
+	v, err = p.Get("cpu_freq.avail_freqs", "hwthread", "0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v != "3600000 2800000 1800000 800000" {
+		t.Errorf("unexpected available frequencies '%s'", v)
+	}
+}
+
+func TestSet(t *testing.T) {
+	p := newTestProvider(t)
+	err := p.Set("cpu_freq.max_cpu_freq", "hwthread", "1", "2800000")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v, err := p.Get("cpu_freq.max_cpu_freq", "hwthread", "1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v != "2800000" {
+		t.Errorf("expected '2800000' but got '%s'", v)
+	}
+	v, _ = p.Get("cpu_freq.max_cpu_freq", "hwthread", "0")
+	if v != "3600000" {
+		t.Errorf("setting hwthread 1 changed hwthread 0 to '%s'", v)
+	}
+}
+
+func TestShouldFail(t *testing.T) {
+	p := newTestProvider(t)
+	if err := p.Set("cpu_freq.avail_govs", "hwthread", "0", "performance"); err == nil {
+		t.Errorf("set readonly control")
+	}
+	if _, err := p.Get("cpu_freq.governor", "hwthread", "2"); err == nil {
+		t.Errorf("got control of unknown hwthread")
+	}
+	if _, err := p.Get("cpu_freq.governor", "socket", "0"); err == nil {
+		t.Errorf("got control for device type socket")
+	}
+	if _, err := p.Get("cpu_freq.energy_perf_pref", "hwthread", "0"); err == nil {
+		t.Errorf("got unavailable control")
+	}
+	if err := NewCpufreqProvider(t.TempDir()).Init(); err == nil {
+		t.Errorf("initialized provider without cpufreq interface")
+	}
+}
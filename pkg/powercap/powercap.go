@@ -0,0 +1,242 @@
+package powercap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	cclog "github.com/ClusterCockpit/cc-lib/v2/ccLogger"
+	ccprovider "github.com/ClusterCockpit/cc-node-controller/pkg/ccControlProvider"
+	topo "github.com/ClusterCockpit/cc-node-controller/pkg/ccTopology"
+)
+
+const SYSFS_POWERCAP_BASE = `/sys/class/powercap`
+
+// Zone kinds
+const (
+	zonePackage = "pkg"
+	zoneDram    = "dram"
+)
+
+// powercapControl maps a control to a file in a powercap zone
+type powercapControl struct {
+	name        string
+	zone        string
+	file        string
+	description string
+	unit        string
+	readonly    bool
+}
+
+// Category of all powercap controls
+const powercapCategory = "powercap"
+
+// All values are in the units of the powercap interface (uW, us, uJ), which differ
+// from the units of LIKWID's 'rapl' controls. To prevent mixing them up, the names
+// carry the unit as suffix.
+var powercapControls = []powercapControl{
+	{"pkg_energy_uj", zonePackage, "energy_uj", "Package energy counter (uJ)", "uJ", true},
+	{"pkg_enable", zonePackage, "enabled", "Package power limits enabled", "", false},
+	{"pkg_max_limit_uw", zonePackage, "constraint_0_max_power_uw", "Maximal package power limit (uW)", "uW", true},
+	{"pkg_limit_1_uw", zonePackage, "constraint_0_power_limit_uw", "Package long term power limit (uW)", "uW", false},
+	{"pkg_limit_1_time_us", zonePackage, "constraint_0_time_window_us", "Package long term time window (us)", "us", false},
+	{"pkg_limit_2_uw", zonePackage, "constraint_1_power_limit_uw", "Package short term power limit (uW)", "uW", false},
+	{"pkg_limit_2_time_us", zonePackage, "constraint_1_time_window_us", "Package short term time window (us)", "us", false},
+	{"dram_energy_uj", zoneDram, "energy_uj", "DRAM energy counter (uJ)", "uJ", true},
+	{"dram_enable", zoneDram, "enabled", "DRAM power limit enabled", "", false},
+	{"dram_limit_uw", zoneDram, "constraint_0_power_limit_uw", "DRAM power limit (uW)", "uW", false},
+	{"dram_limit_time_us", zoneDram, "constraint_0_time_window_us", "DRAM power limit time window (us)", "us", false},
+}
+
+// Top-level package zones are named 'intel-rapl:<N>', subzones 'intel-rapl:<N>:<M>'
+var zoneDirRegex = regexp.MustCompile(`^intel-rapl:([[:digit:]]+)(:[[:digit:]]+)?$`)
+
+// Package zones report their package ID in the name, e.g. 'package-0' or 'package-0-die-0'
+var packageNameRegex = regexp.MustCompile(`^package-([[:digit:]]+)(-die-([[:digit:]]+))?$`)
+
+// PowercapProvider exposes the Linux powercap (intel-rapl) interface as controls for device type 'socket'
+type PowercapProvider struct {
+	root     string
+	sockets  []int
+	zones    map[int]map[string]string // socket ID -> zone kind -> zone path
+	controls []powercapControl
+}
+
+// NewPowercapProvider creates a provider reading the powercap interface below root.
+// If root is empty, SYSFS_POWERCAP_BASE is used.
+func NewPowercapProvider(root string) *PowercapProvider {
+	if len(root) == 0 {
+		root = SYSFS_POWERCAP_BASE
+	}
+	return &PowercapProvider{
+		root: root,
+	}
+}
+
+func (p *PowercapProvider) Name() string {
+	return "powercap"
+}
+
+// Init maps the package zones and their DRAM subzones to socket IDs. Only controls
+// available for the first socket are offered.
+func (p *PowercapProvider) Init() error {
+	if p.sockets == nil {
+		p.sockets = topo.SocketList()
+	}
+	if len(p.sockets) == 0 {
+		return fmt.Errorf("No sockets found")
+	}
+
+	dirs, err := os.ReadDir(p.root)
+	if err != nil {
+		return err
+	}
+
+	// Package zones by their zone index
+	packages := make(map[int]string)
+	// DRAM subzones by the zone index of their package zone
+	drams := make(map[int]string)
+	for _, d := range dirs {
+		matches := zoneDirRegex.FindStringSubmatch(d.Name())
+		if len(matches) != 3 {
+			continue
+		}
+		index, _ := strconv.Atoi(matches[1])
+		zonePath := filepath.Join(p.root, d.Name())
+		if len(matches[2]) == 0 {
+			packages[index] = zonePath
+		} else if readFile(filepath.Join(zonePath, "name")) == "dram" {
+			drams[index] = zonePath
+		}
+	}
+
+	p.zones = make(map[int]map[string]string)
+	for index, zonePath := range packages {
+		socket := index
+		name := readFile(filepath.Join(zonePath, "name"))
+		matches := packageNameRegex.FindStringSubmatch(name)
+		if len(matches) == 4 {
+			if len(matches[3]) > 0 && matches[3] != "0" {
+				// Only the first die zone is used for the socket
+				continue
+			}
+			socket, _ = strconv.Atoi(matches[1])
+		} else if index < len(p.sockets) {
+			socket = p.sockets[index]
+		}
+		if !slices.Contains(p.sockets, socket) {
+			cclog.ComponentDebug("Powercap", "Skipping zone", zonePath, "for unknown socket", socket)
+			continue
+		}
+		p.zones[socket] = map[string]string{
+			zonePackage: zonePath,
+		}
+		if dram, ok := drams[index]; ok {
+			p.zones[socket][zoneDram] = dram
+		}
+	}
+
+	p.controls = make([]powercapControl, 0)
+	if zones, ok := p.zones[p.sockets[0]]; ok {
+		for _, c := range powercapControls {
+			if zonePath, ok := zones[c.zone]; ok {
+				if _, err := os.Stat(filepath.Join(zonePath, c.file)); err == nil {
+					p.controls = append(p.controls, c)
+				}
+			}
+		}
+	}
+	if len(p.controls) == 0 {
+		return fmt.Errorf("No powercap interface found in %s", p.root)
+	}
+	return nil
+}
+
+func (p *PowercapProvider) Close() {}
+
+func (p *PowercapProvider) List() ([]ccprovider.ControlEntry, error) {
+	out := make([]ccprovider.ControlEntry, 0, len(p.controls))
+	for _, c := range p.controls {
+		out = append(out, ccprovider.ControlEntry{
+			Category:    powercapCategory,
+			Name:        c.name,
+			DeviceType:  "socket",
+			Description: c.description,
+			Unit:        c.unit,
+			ReadOnly:    c.readonly,
+		})
+	}
+	return out, nil
+}
+
+func (p *PowercapProvider) Get(control, deviceType, deviceId string) (string, error) {
+	path, _, err := p.lookup(control, deviceType, deviceId)
+	if err != nil {
+		return "", err
+	}
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buffer)), nil
+}
+
+func (p *PowercapProvider) Set(control, deviceType, deviceId, value string) error {
+	path, c, err := p.lookup(control, deviceType, deviceId)
+	if err != nil {
+		return err
+	}
+	if c.readonly {
+		return fmt.Errorf("Control %s is readonly", control)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// lookup resolves a control name and device to the path of the powercap file
+func (p *PowercapProvider) lookup(control, deviceType, deviceId string) (string, powercapControl, error) {
+	if deviceType != "socket" {
+		return "", powercapControl{}, fmt.Errorf("Invalid device type %s, powercap controls are only available for socket", deviceType)
+	}
+	socket, err := strconv.Atoi(deviceId)
+	if err != nil {
+		return "", powercapControl{}, fmt.Errorf("Invalid socket ID '%s'", deviceId)
+	}
+	zones, ok := p.zones[socket]
+	if !ok {
+		return "", powercapControl{}, fmt.Errorf("No powercap zone for socket ID '%s'", deviceId)
+	}
+	name, ok := strings.CutPrefix(control, powercapCategory+".")
+	if ok {
+		for _, c := range p.controls {
+			if c.name == name {
+				zonePath, ok := zones[c.zone]
+				if !ok {
+					return "", c, fmt.Errorf("No %s zone for socket ID '%s'", c.zone, deviceId)
+				}
+				return filepath.Join(zonePath, c.file), c, nil
+			}
+		}
+	}
+	return "", powercapControl{}, fmt.Errorf("Unknown control %s", control)
+}
+
+// readFile reads a sysfs file and returns its trimmed content or an empty string
+func readFile(path string) string {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(buffer))
+}
@@ -0,0 +1,147 @@
+package powercap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestProvider creates a provider on a fixture tree with two package zones
+// for the sockets 0 and 1. Only socket 0 has a DRAM subzone.
+func newTestProvider(t *testing.T) *PowercapProvider {
+	root := t.TempDir()
+	zones := map[string]map[string]string{
+		"intel-rapl:0": {
+			"name":                        "package-0",
+			"enabled":                     "1",
+			"energy_uj":                   "123456789",
+			"constraint_0_name":           "long_term",
+			"constraint_0_power_limit_uw": "150000000",
+			"constraint_0_time_window_us": "999424",
+			"constraint_0_max_power_uw":   "200000000",
+			"constraint_1_name":           "short_term",
+			"constraint_1_power_limit_uw": "180000000",
+			"constraint_1_time_window_us": "2440",
+		},
+		"intel-rapl:0:0": {
+			"name":      "core",
+			"energy_uj": "1000",
+		},
+		"intel-rapl:0:1": {
+			"name":                        "dram",
+			"enabled":                     "0",
+			"energy_uj":                   "4711",
+			"constraint_0_power_limit_uw": "30000000",
+			"constraint_0_time_window_us": "976",
+		},
+		"intel-rapl:1": {
+			"name":                        "package-1",
+			"enabled":                     "1",
+			"energy_uj":                   "987654321",
+			"constraint_0_power_limit_uw": "140000000",
+			"constraint_0_time_window_us": "999424",
+			"constraint_0_max_power_uw":   "200000000",
+			"constraint_1_power_limit_uw": "180000000",
+			"constraint_1_time_window_us": "2440",
+		},
+	}
+	for zone, files := range zones {
+		err := os.Mkdir(filepath.Join(root, zone), 0755)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for file, content := range files {
+			err = os.WriteFile(filepath.Join(root, zone, file), []byte(content+"\n"), 0644)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	p := NewPowercapProvider(root)
+	p.sockets = []int{0, 1}
+	err := p.Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return p
+}
+
+func TestList(t *testing.T) {
+	p := newTestProvider(t)
+	list, err := p.List()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list) != len(powercapControls) {
+		t.Errorf("expected %d controls but got %d", len(powercapControls), len(list))
+	}
+	for _, l := range list {
+		if l.DeviceType != "socket" {
+			t.Errorf("control %s has device type %s", l.Control(), l.DeviceType)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	p := newTestProvider(t)
+	tests := []struct {
+		control  string
+		socket   string
+		expected string
+	}{
+		{"powercap.pkg_limit_1_uw", "0", "150000000"},
+		{"powercap.pkg_limit_1_uw", "1", "140000000"},
+		{"powercap.pkg_energy_uj", "1", "987654321"},
+		{"powercap.dram_energy_uj", "0", "4711"},
+		{"powercap.dram_enable", "0", "0"},
+	}
+	for _, tc := range tests {
+		v, err := p.Get(tc.control, "socket", tc.socket)
+		if err != nil {
+			t.Errorf("Get(%s, %s): %v", tc.control, tc.socket, err.Error())
+			continue
+		}
+		if v != tc.expected {
+			t.Errorf("Get(%s, %s): expected '%s' but got '%s'", tc.control, tc.socket, tc.expected, v)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	p := newTestProvider(t)
+	err := p.Set("powercap.pkg_limit_1_uw", "socket", "1", "120000000")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v, err := p.Get("powercap.pkg_limit_1_uw", "socket", "1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v != "120000000" {
+		t.Errorf("expected '120000000' but got '%s'", v)
+	}
+	v, _ = p.Get("powercap.pkg_limit_1_uw", "socket", "0")
+	if v != "150000000" {
+		t.Errorf("setting socket 1 changed socket 0 to '%s'", v)
+	}
+}
+
+func TestShouldFail(t *testing.T) {
+	p := newTestProvider(t)
+	if err := p.Set("powercap.pkg_energy_uj", "socket", "0", "0"); err == nil {
+		t.Errorf("set readonly control")
+	}
+	if _, err := p.Get("powercap.dram_energy_uj", "socket", "1"); err == nil {
+		t.Errorf("got DRAM control of socket without DRAM zone")
+	}
+	if _, err := p.Get("powercap.pkg_energy_uj", "socket", "2"); err == nil {
+		t.Errorf("got control of unknown socket")
+	}
+	if _, err := p.Get("powercap.pkg_energy_uj", "hwthread", "0"); err == nil {
+		t.Errorf("got control for device type hwthread")
+	}
+	if err := NewPowercapProvider(t.TempDir()).Init(); err == nil {
+		t.Errorf("initialized provider without powercap interface")
+	}
+}
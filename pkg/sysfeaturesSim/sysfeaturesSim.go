@@ -0,0 +1,357 @@
+package sysfeaturessim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	topo "github.com/ClusterCockpit/cc-node-controller/pkg/ccTopology"
+)
+
+type LikwidDeviceType int
+
+// Device types in the order of LIKWID's LikwidDeviceType enum
+var deviceTypeNames = []string{
+	"invalid",
+	"hwthread",
+	"core",
+	"LLC",
+	"numa",
+	"die",
+	"socket",
+	"node",
+}
+
+type SysFeature struct {
+	Name        string
+	Category    string
+	Description string
+	DevType     LikwidDeviceType
+	DevTypeName string
+	ReadOnly    bool
+	WriteOnly   bool
+}
+
+type LikwidDevice struct {
+	Id          int64
+	DevType     LikwidDeviceType
+	DevTypeName string
+}
+
+// SimFeature is the JSON representation of a simulated feature
+type SimFeature struct {
+	Name        string            `json:"name"`
+	Category    string            `json:"category"`
+	Description string            `json:"description"`
+	DeviceType  string            `json:"type"`
+	ReadOnly    bool              `json:"readonly,omitempty"`
+	WriteOnly   bool              `json:"writeonly,omitempty"`
+	Value       string            `json:"value"`            // Initial value for all devices
+	Values      map[string]string `json:"values,omitempty"` // Initial values per device ID
+	// Numeric range of the feature. Writing a value outside of the range fails,
+	// or, with Clamp, writes the nearest bound like the hardware does for some features.
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Clamp bool     `json:"clamp,omitempty"`
+}
+
+// SimConfig is the JSON representation of the simulation file
+type SimConfig struct {
+	// Hardware threads of the simulated node. If set, it replaces the local
+	// topology in ccTopology, so all users of ccTopology see the simulated
+	// devices. Otherwise, the devices of the local topology are simulated.
+	Topology []topo.HwthreadEntry `json:"topology,omitempty"`
+	Features []SimFeature         `json:"features"`
+}
+
+var (
+	simMutex    sync.Mutex
+	simConfig   *SimConfig
+	simFeatures []SysFeature
+	simValues   map[string]map[int64]string // feature name -> device ID -> value
+	simRanges   map[string]SimFeature       // feature name -> feature with numeric range
+	// Local topology, restored by SysFeaturesClose if replaced by a simulated one
+	hostTopology []topo.HwthreadEntry
+)
+
+func (s *SysFeature) String() string {
+	slist := make([]string, 0)
+	slist = append(slist, fmt.Sprintf("Category %s Name %s", s.Category, s.Name))
+	slist = append(slist, fmt.Sprintf("Description: %s", s.Description))
+	slist = append(slist, fmt.Sprintf("For type: %s", s.DevTypeName))
+	return strings.Join(slist, "\n")
+}
+
+// SysFeaturesInit loads the topology, the feature table and initial values from
+// a JSON file. In contrast to the sysfeatures package, no LIKWID library is required.
+func SysFeaturesInit(filename string) (err error) {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+
+	buffer, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Cannot read simulation file: %w", err)
+	}
+	config := new(SimConfig)
+	err = json.Unmarshal(buffer, config)
+	if err != nil {
+		return fmt.Errorf("Cannot parse simulation file %s: %w", filename, err)
+	}
+
+	if len(config.Topology) > 0 {
+		previous := topo.CpuData()
+		if hostTopology == nil {
+			hostTopology = previous
+		}
+		topo.SetCpuData(config.Topology)
+		defer func() {
+			if err != nil {
+				topo.SetCpuData(previous)
+			}
+		}()
+	}
+
+	features := make([]SysFeature, 0, len(config.Features))
+	values := make(map[string]map[int64]string)
+	ranges := make(map[string]SimFeature)
+	for _, f := range config.Features {
+		devType := deviceTypeNameToId(f.DeviceType)
+		if devType == LikwidDeviceType(0) {
+			return fmt.Errorf("Invalid device type %s for feature %s.%s", f.DeviceType, f.Category, f.Name)
+		}
+		if f.ReadOnly && f.WriteOnly {
+			return fmt.Errorf("Feature %s.%s cannot be readonly and writeonly", f.Category, f.Name)
+		}
+		sf := SysFeature{
+			Name:        f.Name,
+			Category:    f.Category,
+			Description: f.Description,
+			DevType:     devType,
+			DevTypeName: f.DeviceType,
+			ReadOnly:    f.ReadOnly,
+			WriteOnly:   f.WriteOnly,
+		}
+		name := featureName(sf)
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("Duplicate feature %s", name)
+		}
+		if f.Min != nil || f.Max != nil {
+			if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+				return fmt.Errorf("Feature %s has min above max", name)
+			}
+			ranges[name] = f
+		}
+		values[name] = make(map[int64]string)
+		for _, id := range deviceIds(f.DeviceType) {
+			values[name][int64(id)] = f.Value
+		}
+		for idStr, v := range f.Values {
+			id, err := strconv.ParseInt(idStr, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid device ID '%s' for feature %s", idStr, name)
+			}
+			if _, ok := values[name][id]; !ok {
+				return fmt.Errorf("Unknown device %s/%s for feature %s", f.DeviceType, idStr, name)
+			}
+			values[name][id] = v
+		}
+		features = append(features, sf)
+	}
+
+	simConfig = config
+	simFeatures = features
+	simValues = values
+	simRanges = ranges
+	return nil
+}
+
+func SysFeaturesClose() {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+
+	simConfig = nil
+	simFeatures = nil
+	simValues = nil
+	if hostTopology != nil {
+		topo.SetCpuData(hostTopology)
+		hostTopology = nil
+	}
+}
+
+func SysFeaturesList() ([]SysFeature, error) {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+
+	if simConfig == nil {
+		return nil, fmt.Errorf("sysfeatures simulation not initialized")
+	}
+	return slices.Clone(simFeatures), nil
+}
+
+func SysFeaturesGetByNameAndDevice(name string, dev LikwidDevice) (string, error) {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+
+	f, err := lookupFeature(name, dev)
+	if err != nil {
+		return "", err
+	}
+	if f.WriteOnly {
+		return "", fmt.Errorf("SysFeaturesGetByNameAndDevice() failed (feature=%s, devType=%s, devId=%d): feature is writeonly", name, dev.DevTypeName, dev.Id)
+	}
+	return simValues[featureName(f)][dev.Id], nil
+}
+
+func SysFeaturesGetByNameAndDevId(name string, deviceType LikwidDeviceType, deviceId string) (string, error) {
+	dev, err := LikwidDeviceCreate(deviceType, deviceId)
+	if err != nil {
+		return "", err
+	}
+	val, err := SysFeaturesGetByNameAndDevice(name, dev)
+	LikwidDeviceDestroy(dev)
+	if err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+func SysFeaturesSetByNameAndDevice(name string, dev LikwidDevice, value string) error {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+
+	f, err := lookupFeature(name, dev)
+	if err != nil {
+		return err
+	}
+	if f.ReadOnly {
+		return fmt.Errorf("SysFeaturesSetByNameAndDevice() failed (feature=%s, devType=%s, devId=%d, value=%s): feature is readonly", name, dev.DevTypeName, dev.Id, value)
+	}
+	if r, ok := simRanges[featureName(f)]; ok {
+		value, err = checkRange(r, value)
+		if err != nil {
+			return fmt.Errorf("SysFeaturesSetByNameAndDevice() failed (feature=%s, devType=%s, devId=%d, value=%s): %w", name, dev.DevTypeName, dev.Id, value, err)
+		}
+	}
+	simValues[featureName(f)][dev.Id] = value
+	return nil
+}
+
+// checkRange checks a value against the numeric range of a feature and returns
+// the value to write
+func checkRange(f SimFeature, value string) (string, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return value, fmt.Errorf("value is not numeric")
+	}
+	switch {
+	case f.Min != nil && v < *f.Min:
+		if !f.Clamp {
+			return value, fmt.Errorf("value below minimum %v", *f.Min)
+		}
+		v = *f.Min
+	case f.Max != nil && v > *f.Max:
+		if !f.Clamp {
+			return value, fmt.Errorf("value above maximum %v", *f.Max)
+		}
+		v = *f.Max
+	default:
+		return value, nil
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64), nil
+}
+
+func SysFeaturesSetByNameAndDevId(name string, deviceType LikwidDeviceType, deviceId string, value string) error {
+	dev, err := LikwidDeviceCreate(deviceType, deviceId)
+	if err != nil {
+		return err
+	}
+	err = SysFeaturesSetByNameAndDevice(name, dev, value)
+	LikwidDeviceDestroy(dev)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func LikwidDeviceTypeNameToId(deviceTypeName string) LikwidDeviceType {
+	return deviceTypeNameToId(deviceTypeName)
+}
+
+func LikwidDeviceCreateByTypeName(deviceTypeName string, deviceId string) (LikwidDevice, error) {
+	deviceTypeId := LikwidDeviceTypeNameToId(deviceTypeName)
+	if deviceTypeId == LikwidDeviceType(0) {
+		return LikwidDevice{}, fmt.Errorf("LikwidDeviceCreateByTypeName: Invalid device type %s", deviceTypeName)
+	}
+	return LikwidDeviceCreate(deviceTypeId, deviceId)
+}
+
+func LikwidDeviceDestroy(dev LikwidDevice) {}
+
+func LikwidDeviceCreate(deviceType LikwidDeviceType, deviceId string) (LikwidDevice, error) {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+
+	if simConfig == nil {
+		return LikwidDevice{}, fmt.Errorf("sysfeatures simulation not initialized")
+	}
+	if deviceType <= LikwidDeviceType(0) || int(deviceType) >= len(deviceTypeNames) {
+		return LikwidDevice{}, fmt.Errorf("LikwidDeviceCreate() failed: (type=%d, idx=%s): invalid device type", deviceType, deviceId)
+	}
+	typeName := deviceTypeNames[deviceType]
+	if typeName == "node" && len(deviceId) == 0 {
+		deviceId = "0"
+	}
+	id, err := strconv.Atoi(deviceId)
+	if err != nil || !slices.Contains(deviceIds(typeName), id) {
+		return LikwidDevice{}, fmt.Errorf("LikwidDeviceCreate() failed: (type=%d, idx=%s): no such device", deviceType, deviceId)
+	}
+	return LikwidDevice{
+		Id:          int64(id),
+		DevType:     deviceType,
+		DevTypeName: typeName,
+	}, nil
+}
+
+func deviceTypeNameToId(deviceTypeName string) LikwidDeviceType {
+	i := slices.Index(deviceTypeNames, deviceTypeName)
+	if i <= 0 {
+		return LikwidDeviceType(0)
+	}
+	return LikwidDeviceType(i)
+}
+
+// deviceIds returns the IDs of all simulated devices of a type
+func deviceIds(deviceTypeName string) []int {
+	switch deviceTypeName {
+	case "numa":
+		return topo.GetTypeList("memoryDomain")
+	case "LLC":
+		return []int{}
+	}
+	return topo.GetTypeList(deviceTypeName)
+}
+
+// featureName returns the full name <category>.<name> of a feature
+func featureName(f SysFeature) string {
+	return fmt.Sprintf("%s.%s", f.Category, f.Name)
+}
+
+// lookupFeature finds a feature by its full or short name and checks the device type
+func lookupFeature(name string, dev LikwidDevice) (SysFeature, error) {
+	if simConfig == nil {
+		return SysFeature{}, fmt.Errorf("sysfeatures simulation not initialized")
+	}
+	for _, f := range simFeatures {
+		if featureName(f) == name || f.Name == name {
+			if f.DevType != dev.DevType {
+				return SysFeature{}, fmt.Errorf("Feature %s not available for device type %s", name, dev.DevTypeName)
+			}
+			return f, nil
+		}
+	}
+	return SysFeature{}, fmt.Errorf("Unknown feature %s", name)
+}
@@ -0,0 +1,216 @@
+package sysfeaturessim
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	topo "github.com/ClusterCockpit/cc-node-controller/pkg/ccTopology"
+)
+
+// The simulation file in the repository root, also used by cmd/server
+const testFile = "../../sim.json"
+
+func TestInit(t *testing.T) {
+	err := SysFeaturesInit(testFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SysFeaturesClose()
+
+	if err := SysFeaturesInit("testdata/does_not_exist.json"); err == nil {
+		t.Errorf("initialized with missing simulation file")
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	os.WriteFile(invalid, []byte(`{"features": [{"category": "a", "name": "b", "type": "gpu"}]}`), 0644)
+	if err := SysFeaturesInit(invalid); err == nil {
+		t.Errorf("initialized with invalid device type")
+	}
+}
+
+func TestList(t *testing.T) {
+	err := SysFeaturesInit(testFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer SysFeaturesClose()
+	list, err := SysFeaturesList()
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if len(list) != 8 {
+		t.Errorf("expected 8 features but got %d", len(list))
+	}
+	for _, l := range list {
+		t.Log(l.String())
+	}
+}
+
+func TestGet(t *testing.T) {
+	err := SysFeaturesInit(testFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer SysFeaturesClose()
+
+	tests := []struct {
+		control  string
+		devType  string
+		devId    string
+		expected string
+	}{
+		{"rapl.pkg_limit_1", "socket", "0", "150000"},
+		{"rapl.pkg_limit_1", "socket", "1", "140000"},
+		{"cpu_freq.governor", "hwthread", "7", "powersave"},
+		{"governor", "hwthread", "0", "powersave"},
+	}
+	for _, tc := range tests {
+		dev, err := LikwidDeviceCreateByTypeName(tc.devType, tc.devId)
+		if err != nil {
+			t.Errorf("%v", err.Error())
+			continue
+		}
+		v, err := SysFeaturesGetByNameAndDevice(tc.control, dev)
+		if err != nil {
+			t.Errorf("Control %s: %v", tc.control, err.Error())
+		}
+		if v != tc.expected {
+			t.Errorf("Control %s: expected '%s' but got '%s'", tc.control, tc.expected, v)
+		}
+		LikwidDeviceDestroy(dev)
+	}
+}
+
+func TestSet(t *testing.T) {
+	err := SysFeaturesInit(testFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer SysFeaturesClose()
+
+	socketType := LikwidDeviceTypeNameToId("socket")
+	err = SysFeaturesSetByNameAndDevId("rapl.pkg_limit_1", socketType, "1", "100000")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v, err := SysFeaturesGetByNameAndDevId("rapl.pkg_limit_1", socketType, "1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v != "100000" {
+		t.Errorf("expected '100000' but got '%s'", v)
+	}
+	v, _ = SysFeaturesGetByNameAndDevId("rapl.pkg_limit_1", socketType, "0")
+	if v != "150000" {
+		t.Errorf("setting socket 1 changed socket 0 to '%s'", v)
+	}
+}
+
+func TestReadWriteOnly(t *testing.T) {
+	err := SysFeaturesInit(testFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer SysFeaturesClose()
+
+	socketType := LikwidDeviceTypeNameToId("socket")
+	nodeType := LikwidDeviceTypeNameToId("node")
+	if err := SysFeaturesSetByNameAndDevId("rapl.pkg_energy", socketType, "0", "0"); err == nil {
+		t.Errorf("set readonly feature")
+	}
+	if _, err := SysFeaturesGetByNameAndDevId("prefetch.hwpf_reset", nodeType, "0"); err == nil {
+		t.Errorf("got writeonly feature")
+	}
+	if err := SysFeaturesSetByNameAndDevId("prefetch.hwpf_reset", nodeType, "", "1"); err != nil {
+		t.Errorf("cannot set writeonly feature: %v", err.Error())
+	}
+}
+
+func TestDeviceCreateShouldFail(t *testing.T) {
+	err := SysFeaturesInit(testFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer SysFeaturesClose()
+
+	for _, deviceType := range []string{"hwthread", "socket", "node"} {
+		d, err := LikwidDeviceCreateByTypeName(deviceType, "-1")
+		if err == nil {
+			t.Errorf("device successfully created despite ID -1")
+			LikwidDeviceDestroy(d)
+		}
+	}
+	if _, err := LikwidDeviceCreateByTypeName("socket", "2"); err == nil {
+		t.Errorf("device successfully created despite unknown socket 2")
+	}
+	if _, err := LikwidDeviceCreateByTypeName("gpu", "0"); err == nil {
+		t.Errorf("device successfully created despite invalid device type")
+	}
+	dev, _ := LikwidDeviceCreateByTypeName("hwthread", "0")
+	if _, err := SysFeaturesGetByNameAndDevice("rapl.pkg_limit_1", dev); err == nil {
+		t.Errorf("got socket feature for hwthread device")
+	}
+}
+
+func TestTopology(t *testing.T) {
+	host := topo.CpuData()
+	err := SysFeaturesInit(testFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fmt.Sprint(topo.GetSocketHwthreads(1)) != "[4 5 6 7]" {
+		t.Errorf("simulated topology not set, hwthreads of socket 1: %v", topo.GetSocketHwthreads(1))
+	}
+	if _, err := LikwidDeviceCreateByTypeName("core", "3"); err != nil {
+		t.Errorf("cannot create simulated core 3: %v", err)
+	}
+	SysFeaturesClose()
+	if fmt.Sprint(topo.CpuData()) != fmt.Sprint(host) {
+		t.Errorf("local topology not restored")
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	os.WriteFile(invalid, []byte(`{"topology": [{"cpu_id": 0}], "features": [{"category": "a", "name": "b", "type": "gpu"}]}`), 0644)
+	if err := SysFeaturesInit(invalid); err == nil {
+		t.Errorf("initialized with invalid device type")
+	}
+	if fmt.Sprint(topo.CpuData()) != fmt.Sprint(host) {
+		t.Errorf("local topology not restored after failed initialization")
+	}
+}
+
+func TestSetRange(t *testing.T) {
+	err := SysFeaturesInit(testFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer SysFeaturesClose()
+
+	tests := []struct {
+		name     string
+		feature  string
+		devType  string
+		value    string
+		valid    bool
+		expected string
+	}{
+		{"within range", "rapl.pkg_limit_1", "socket", "120000", true, "120000"},
+		{"above maximum", "rapl.pkg_limit_1", "socket", "250000", false, "120000"},
+		{"not numeric", "rapl.pkg_limit_1", "socket", "much", false, "120000"},
+		{"clamped to maximum", "cpu_freq.max_cpu_freq", "hwthread", "4000000", true, "3600000"},
+		{"clamped to minimum", "cpu_freq.max_cpu_freq", "hwthread", "400000", true, "800000"},
+		{"no range", "cpu_freq.governor", "hwthread", "performance", true, "performance"},
+	}
+	for _, tc := range tests {
+		devType := LikwidDeviceTypeNameToId(tc.devType)
+		err := SysFeaturesSetByNameAndDevId(tc.feature, devType, "0", tc.value)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v but got error %v", tc.name, tc.valid, err)
+		}
+		if v, _ := SysFeaturesGetByNameAndDevId(tc.feature, devType, "0"); v != tc.expected {
+			t.Errorf("%s: expected '%s' but got '%s'", tc.name, tc.expected, v)
+		}
+	}
+}